@@ -26,6 +26,8 @@ type NextEventResponse struct {
 	RequestID          string    `json:"requestId"`
 	InvokedFunctionArn string    `json:"invokedFunctionArn"`
 	Tracing            Tracing   `json:"tracing"`
+	// ShutdownReason is set for SHUTDOWN events, eg 'spindown', 'timeout' or 'failure'
+	ShutdownReason string `json:"shutdownReason"`
 }
 
 // Tracing is part of the response for /event/next
@@ -56,6 +58,7 @@ const (
 
 // Client is a simple client for the Lambda Extensions API
 type Client struct {
+	runtimeAPI  string
 	baseURL     string
 	httpClient  *http.Client
 	extensionID string
@@ -65,6 +68,7 @@ type Client struct {
 func NewClient(awsLambdaRuntimeAPI string) *Client {
 	baseURL := fmt.Sprintf("http://%s/2020-01-01/extension", awsLambdaRuntimeAPI)
 	return &Client{
+		runtimeAPI: awsLambdaRuntimeAPI,
 		baseURL:    baseURL,
 		httpClient: &http.Client{},
 	}
@@ -138,43 +142,42 @@ func (e *Client) NextEvent(ctx context.Context) (*NextEventResponse, error) {
 	return &res, nil
 }
 
-// InitError reports an initialization error to the platform. Call it when you registered but failed to initialize
-func (e *Client) InitError(ctx context.Context, errorType string) (*StatusResponse, error) {
-	const action = "/init/error"
-	url := e.baseURL + action
+// ErrorRequest is the body of the request for /init/error and /exit/error
+type ErrorRequest struct {
+	ErrorMessage string   `json:"errorMessage"`
+	ErrorType    string   `json:"errorType"`
+	StackTrace   []string `json:"stackTrace"`
+}
 
-	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, nil)
-	if err != nil {
-		return nil, err
-	}
-	httpReq.Header.Set(extensionIdentiferHeader, e.extensionID)
-	httpReq.Header.Set(extensionErrorType, errorType)
-	httpRes, err := e.httpClient.Do(httpReq)
-	if err != nil {
-		return nil, err
-	}
-	if httpRes.StatusCode != 200 {
-		return nil, fmt.Errorf("request failed with status %s", httpRes.Status)
-	}
-	defer httpRes.Body.Close()
-	body, err := io.ReadAll(httpRes.Body)
-	if err != nil {
-		return nil, err
-	}
-	res := StatusResponse{}
-	err = json.Unmarshal(body, &res)
-	if err != nil {
-		return nil, err
-	}
-	return &res, nil
+// InitError reports an initialization error to the platform. Call it when you registered but failed to initialize
+// cause is optional, it's reported as the error message
+func (e *Client) InitError(ctx context.Context, errorType string, cause error) (*StatusResponse, error) {
+	return e.reportError(ctx, "/init/error", errorType, cause)
 }
 
 // ExitError reports an error to the platform before exiting. Call it when you encounter an unexpected failure
-func (e *Client) ExitError(ctx context.Context, errorType string) (*StatusResponse, error) {
-	const action = "/exit/error"
+// cause is optional, it's reported as the error message
+func (e *Client) ExitError(ctx context.Context, errorType string, cause error) (*StatusResponse, error) {
+	return e.reportError(ctx, "/exit/error", errorType, cause)
+}
+
+func (e *Client) reportError(ctx context.Context, action string, errorType string, cause error) (*StatusResponse, error) {
 	url := e.baseURL + action
 
-	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+	var reqBody io.Reader
+	if cause != nil {
+		b, err := json.Marshal(&ErrorRequest{
+			ErrorMessage: cause.Error(),
+			ErrorType:    errorType,
+			StackTrace:   []string{},
+		})
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, reqBody)
 	if err != nil {
 		return nil, err
 	}
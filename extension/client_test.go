@@ -0,0 +1,48 @@
+package extension_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/extension"
+)
+
+func TestInitError(t *testing.T) {
+	runtimeAPI := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/2020-01-01/extension/register":
+				w.Header().Set("Lambda-Extension-Identifier", "ext-id")
+				w.Write([]byte(`{"functionName": "my-function"}`))
+			case "/2020-01-01/extension/init/error":
+				assert.Equal(t, "ext-id", r.Header.Get("Lambda-Extension-Identifier"))
+				assert.Equal(t, "Extension.InvalidAuth", r.Header.Get("Lambda-Extension-Function-Error-Type"))
+
+				var body extension.ErrorRequest
+				require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+				assert.Equal(t, "Extension.InvalidAuth", body.ErrorType)
+				assert.Equal(t, "missing password", body.ErrorMessage)
+				w.Write([]byte(`{"status": "OK"}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer runtimeAPI.Close()
+
+	client := extension.NewClient(strings.TrimPrefix(runtimeAPI.URL, "http://"))
+	_, err := client.Register(context.Background(), "my-extension")
+	require.NoError(t, err)
+
+	res, err := client.InitError(context.Background(), "Extension.InvalidAuth", errors.New("missing password"))
+	require.NoError(t, err)
+	assert.Equal(t, "OK", res.Status)
+}
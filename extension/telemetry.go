@@ -0,0 +1,228 @@
+package extension
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TelemetryEventType represents the type of events received from the Telemetry API
+type TelemetryEventType string
+
+const (
+	// PlatformStart is sent when an invocation starts
+	PlatformStart TelemetryEventType = "platform.start"
+
+	// PlatformRuntimeDone is sent when the runtime finished processing an invocation
+	PlatformRuntimeDone TelemetryEventType = "platform.runtimeDone"
+
+	// PlatformReport is sent when an invocation is completely done, including extensions
+	PlatformReport TelemetryEventType = "platform.report"
+
+	telemetrySchemaVersion = "2022-12-13"
+)
+
+// TelemetryEvent is a single event pushed by the Telemetry API
+// Record is kept raw since its shape depends on the event type
+type TelemetryEvent struct {
+	Time   time.Time          `json:"time"`
+	Type   TelemetryEventType `json:"type"`
+	Record json.RawMessage    `json:"record"`
+}
+
+// PlatformRecord is the record of platform.start, platform.runtimeDone and platform.report events
+type PlatformRecord struct {
+	RequestID string          `json:"requestId"`
+	Status    string          `json:"status"`
+	Metrics   PlatformMetrics `json:"metrics"`
+	Tracing   *Tracing        `json:"tracing,omitempty"`
+}
+
+// PlatformMetrics are the metrics of platform.runtimeDone and platform.report events
+// Which fields are populated depends on the event type
+type PlatformMetrics struct {
+	DurationMs       float64 `json:"durationMs"`
+	BilledDurationMs float64 `json:"billedDurationMs"`
+	MemorySizeMB     int     `json:"memorySizeMB"`
+	MaxMemoryUsedMB  int     `json:"maxMemoryUsedMB"`
+	InitDurationMs   float64 `json:"initDurationMs"`
+	ProducedBytes    int     `json:"producedBytes"`
+}
+
+// PlatformRecord decodes the record of a platform.* event
+func (e TelemetryEvent) PlatformRecord() (*PlatformRecord, error) {
+	var r PlatformRecord
+	if err := json.Unmarshal(e.Record, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// SubscribeTelemetry subscribes to the Telemetry API, events are pushed to listenerURI
+// It has to be called after Register
+func (e *Client) SubscribeTelemetry(ctx context.Context, listenerURI string, types []string) error {
+	url := fmt.Sprintf("http://%s/2022-07-01/telemetry", e.runtimeAPI)
+
+	reqBody, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": telemetrySchemaVersion,
+		"types":         types,
+		"buffering": map[string]interface{}{
+			"maxItems":  1000,
+			"maxBytes":  256 * 1024,
+			"timeoutMs": 25,
+		},
+		"destination": map[string]interface{}{
+			"protocol": "HTTP",
+			"URI":      listenerURI,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "PUT", url, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set(extensionIdentiferHeader, e.extensionID)
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpRes, err := e.httpClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpRes.Body.Close()
+	if httpRes.StatusCode != 200 {
+		body, _ := io.ReadAll(httpRes.Body)
+		return fmt.Errorf("request failed with status %s: %s", httpRes.Status, body)
+	}
+	return nil
+}
+
+// TelemetryListener is the local HTTP server the Telemetry API pushes events to
+type TelemetryListener struct {
+	addr    string
+	handler func([]TelemetryEvent)
+	server  *http.Server
+}
+
+// NewTelemetryListener returns a listener which will serve on addr
+// handler is called with every batch of events received
+func NewTelemetryListener(addr string, handler func([]TelemetryEvent)) *TelemetryListener {
+	l := &TelemetryListener{addr: addr, handler: handler}
+	l.server = &http.Server{Handler: http.HandlerFunc(l.handle)}
+	return l
+}
+
+// Start starts listening, it returns once the listener is ready to receive events
+func (l *TelemetryListener) Start() error {
+	ln, err := net.Listen("tcp", l.addr)
+	if err != nil {
+		return err
+	}
+	l.addr = ln.Addr().String()
+
+	go func() {
+		_ = l.server.Serve(ln)
+	}()
+	return nil
+}
+
+// URI is the address to subscribe to the Telemetry API with
+func (l *TelemetryListener) URI() string {
+	return "http://" + l.addr
+}
+
+func (l *TelemetryListener) Stop(ctx context.Context) error {
+	return l.server.Shutdown(ctx)
+}
+
+func (l *TelemetryListener) handle(w http.ResponseWriter, r *http.Request) {
+	var events []TelemetryEvent
+	if err := json.NewDecoder(r.Body).Decode(&events); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	l.handler(events)
+	w.WriteHeader(http.StatusOK)
+}
+
+// maxRuntimeDonePending bounds the invocations tracked by a RuntimeDoneWaiter
+// so that events never waited for (eg late or duplicated ones) don't accumulate
+const maxRuntimeDonePending = 16
+
+// RuntimeDoneWaiter allows waiting for the runtime to be done with a given invocation
+type RuntimeDoneWaiter struct {
+	mu   sync.Mutex
+	done map[string]chan struct{}
+	// order holds the tracked invocations, oldest first
+	order []string
+}
+
+func NewRuntimeDoneWaiter() *RuntimeDoneWaiter {
+	return &RuntimeDoneWaiter{done: make(map[string]chan struct{})}
+}
+
+// Done marks the invocation as done, it's safe to be called before Wait
+func (w *RuntimeDoneWaiter) Done(requestID string) {
+	ch := w.get(requestID)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	select {
+	case <-ch:
+		// already done, eg a duplicated event
+	default:
+		close(ch)
+	}
+}
+
+// Wait blocks until Done is called for the invocation, or the context is done
+func (w *RuntimeDoneWaiter) Wait(ctx context.Context, requestID string) error {
+	ch := w.get(requestID)
+	defer func() {
+		w.mu.Lock()
+		delete(w.done, requestID)
+		w.mu.Unlock()
+	}()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Len returns the number of invocations tracked
+func (w *RuntimeDoneWaiter) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.done)
+}
+
+func (w *RuntimeDoneWaiter) get(requestID string) chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	ch, ok := w.done[requestID]
+	if !ok {
+		ch = make(chan struct{})
+		w.done[requestID] = ch
+		w.order = append(w.order, requestID)
+	}
+
+	// evict the oldest invocations, the ones already waited for are gone from done
+	for len(w.order) > maxRuntimeDonePending {
+		if evicted := w.order[0]; evicted != requestID {
+			delete(w.done, evicted)
+		}
+		w.order = w.order[1:]
+	}
+	return ch
+}
@@ -0,0 +1,126 @@
+package extension_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/extension"
+)
+
+func TestSubscribeTelemetry(t *testing.T) {
+	unexpected := make(chan string, 1)
+	runtimeAPI := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/2020-01-01/extension/register":
+				w.Header().Set("Lambda-Extension-Identifier", "ext-id")
+				w.Write([]byte(`{"functionName": "my-function"}`))
+			case "/2022-07-01/telemetry":
+				assert.Equal(t, http.MethodPut, r.Method)
+				assert.Equal(t, "ext-id", r.Header.Get("Lambda-Extension-Identifier"))
+
+				var body struct {
+					Types       []string `json:"types"`
+					Destination struct {
+						Protocol string `json:"protocol"`
+						URI      string `json:"URI"`
+					} `json:"destination"`
+				}
+				require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+				assert.Equal(t, []string{"platform"}, body.Types)
+				assert.Equal(t, "HTTP", body.Destination.Protocol)
+				assert.Equal(t, "http://127.0.0.1:1234", body.Destination.URI)
+			default:
+				select {
+				case unexpected <- r.URL.Path:
+				default:
+				}
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer runtimeAPI.Close()
+
+	client := extension.NewClient(strings.TrimPrefix(runtimeAPI.URL, "http://"))
+	_, err := client.Register(context.Background(), "my-extension")
+	require.NoError(t, err)
+
+	err = client.SubscribeTelemetry(context.Background(), "http://127.0.0.1:1234", []string{"platform"})
+	assert.NoError(t, err)
+
+	select {
+	case path := <-unexpected:
+		t.Fatalf("unexpected request to %s", path)
+	default:
+	}
+}
+
+func TestTelemetryListener(t *testing.T) {
+	received := make(chan []extension.TelemetryEvent, 1)
+	listener := extension.NewTelemetryListener("127.0.0.1:0", func(events []extension.TelemetryEvent) {
+		received <- events
+	})
+	require.NoError(t, listener.Start())
+	defer listener.Stop(context.Background())
+
+	payload := `[
+		{"time": "2022-10-12T00:03:50.000Z", "type": "platform.runtimeDone", "record": {"requestId": "abc", "status": "success", "metrics": {"durationMs": 12.5}}},
+		{"time": "2022-10-12T00:03:50.100Z", "type": "platform.report", "record": {"requestId": "abc", "status": "success", "metrics": {"durationMs": 20.1, "billedDurationMs": 21, "maxMemoryUsedMB": 40}}}
+	]`
+	res, err := http.Post(listener.URI(), "application/json", bytes.NewBufferString(payload))
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	events := <-received
+	require.Len(t, events, 2)
+	assert.Equal(t, extension.PlatformRuntimeDone, events[0].Type)
+	assert.Equal(t, extension.PlatformReport, events[1].Type)
+
+	record, err := events[1].PlatformRecord()
+	require.NoError(t, err)
+	assert.Equal(t, "abc", record.RequestID)
+	assert.Equal(t, 21.0, record.Metrics.BilledDurationMs)
+	assert.Equal(t, 40, record.Metrics.MaxMemoryUsedMB)
+}
+
+func TestRuntimeDoneWaiter(t *testing.T) {
+	waiter := extension.NewRuntimeDoneWaiter()
+
+	// done before waiting
+	waiter.Done("first")
+	waiter.Done("first")
+	assert.NoError(t, waiter.Wait(context.Background(), "first"))
+
+	// done while waiting
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		waiter.Done("second")
+	}()
+	assert.NoError(t, waiter.Wait(context.Background(), "second"))
+
+	// never done
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	assert.ErrorIs(t, waiter.Wait(ctx, "third"), context.DeadlineExceeded)
+	assert.Equal(t, 0, waiter.Len())
+
+	// late or duplicated events for invocations never waited for are evicted
+	for i := 0; i < 100; i++ {
+		waiter.Done(fmt.Sprintf("late-%d", i))
+	}
+	assert.LessOrEqual(t, waiter.Len(), 16)
+
+	// the latest invocation is still tracked
+	assert.NoError(t, waiter.Wait(context.Background(), "late-99"))
+}
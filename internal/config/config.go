@@ -0,0 +1,154 @@
+// Package config reads the optional configuration file of the extension
+// The file is YAML (or JSON, which is a subset of it), with the same settings as the PYROSCOPE_* env vars
+// eg 'remote_address: https://...' or 'PYROSCOPE_REMOTE_ADDRESS: https://...'
+// It also parses the structured settings, eg PYROSCOPE_DESTINATIONS, into the config of the relay
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of the env vars the settings map to
+const EnvPrefix = "PYROSCOPE_"
+
+var ErrInvalidFile = errors.New("invalid config file")
+
+// File is a parsed config file, keyed by env var name
+type File struct {
+	Path string
+
+	values map[string]string
+
+	mu   sync.Mutex
+	used map[string]bool
+}
+
+// Load reads the config file at path
+// A missing file is not an error unless required is set, eg when the path was explicitly configured
+func Load(path string, required bool) (*File, error) {
+	f := &File{
+		Path:   path,
+		values: map[string]string{},
+		used:   map[string]bool{},
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) && !required {
+			return f, nil
+		}
+		return f, fmt.Errorf("%w: %v", ErrInvalidFile, err)
+	}
+
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return f, fmt.Errorf("%w: '%s': %v", ErrInvalidFile, path, err)
+	}
+
+	for k, v := range raw {
+		value, err := toString(v)
+		if err != nil {
+			return f, fmt.Errorf("%w: '%s': key '%s': %v", ErrInvalidFile, path, k, err)
+		}
+		f.values[EnvName(k)] = value
+	}
+	return f, nil
+}
+
+// EnvName maps a config file key to its env var, eg 'remote_address' -> 'PYROSCOPE_REMOTE_ADDRESS'
+func EnvName(key string) string {
+	key = strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+	if strings.HasPrefix(key, EnvPrefix) {
+		return key
+	}
+	return EnvPrefix + key
+}
+
+// Lookup returns the value of a setting, marking it as known
+func (f *File) Lookup(envName string) (string, bool) {
+	if f == nil {
+		return "", false
+	}
+
+	f.mu.Lock()
+	f.used[envName] = true
+	f.mu.Unlock()
+
+	v, ok := f.values[envName]
+	return v, ok
+}
+
+// UnknownKeys returns the settings in the file that were never looked up, which are most likely typos
+func (f *File) UnknownKeys() []string {
+	if f == nil {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var unknown []string
+	for k := range f.values {
+		if !f.used[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// toString converts a value to the format of its env var
+// Lists become comma separated values (eg retry_status_codes) and maps become JSON (eg http_headers)
+// Lists of maps become JSON as well (eg routes)
+func toString(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case []interface{}:
+		if hasMaps(v) {
+			b, err := json.Marshal(v)
+			if err != nil {
+				return "", err
+			}
+			return string(b), nil
+		}
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := toString(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]interface{}:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	default:
+		return "", fmt.Errorf("unsupported value '%v'", v)
+	}
+}
+
+func hasMaps(items []interface{}) bool {
+	for _, item := range items {
+		if _, ok := item.(map[string]interface{}); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/config"
+)
+
+func writeConfigFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	testCases := []struct {
+		name     string
+		file     string
+		content  string
+		expected map[string]string
+	}{
+		{
+			name: "yaml",
+			file: "config.yaml",
+			content: `
+remote_address: https://example.com
+PYROSCOPE_TENANT_ID: my-tenant
+num-workers: 3
+spill: true
+sampling_rate: 0.5
+retry_status_codes: [429, 503]
+http_headers:
+  X-Foo: bar
+routes:
+  - match: '{team="payments"}'
+    destination: payments
+auth_token:
+`,
+			expected: map[string]string{
+				"PYROSCOPE_REMOTE_ADDRESS":     "https://example.com",
+				"PYROSCOPE_TENANT_ID":          "my-tenant",
+				"PYROSCOPE_NUM_WORKERS":        "3",
+				"PYROSCOPE_SPILL":              "true",
+				"PYROSCOPE_SAMPLING_RATE":      "0.5",
+				"PYROSCOPE_RETRY_STATUS_CODES": "429,503",
+				"PYROSCOPE_HTTP_HEADERS":       `{"X-Foo":"bar"}`,
+				"PYROSCOPE_ROUTES":             `[{"destination":"payments","match":"{team=\"payments\"}"}]`,
+				"PYROSCOPE_AUTH_TOKEN":         "",
+			},
+		},
+		{
+			name:    "json",
+			file:    "config.json",
+			content: `{"remote_address": "https://example.com", "num_workers": 3, "http_headers": {"X-Foo": "bar"}}`,
+			expected: map[string]string{
+				"PYROSCOPE_REMOTE_ADDRESS": "https://example.com",
+				"PYROSCOPE_NUM_WORKERS":    "3",
+				"PYROSCOPE_HTTP_HEADERS":   `{"X-Foo":"bar"}`,
+			},
+		},
+		{
+			name:     "empty",
+			file:     "config.yaml",
+			content:  "",
+			expected: map[string]string{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := config.Load(writeConfigFile(t, tc.file, tc.content), true)
+			require.NoError(t, err)
+
+			for k, v := range tc.expected {
+				value, ok := f.Lookup(k)
+				assert.True(t, ok, k)
+				assert.Equal(t, v, value, k)
+			}
+			assert.Empty(t, f.UnknownKeys(), "all the settings were looked up")
+		})
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	testCases := []struct {
+		name    string
+		content string
+	}{
+		{name: "invalid yaml", content: "remote_address: [https://example.com"},
+		{name: "not a map", content: "- remote_address"},
+		{name: "unsupported type", content: "remote_address: 2022-10-12T00:03:50Z"},
+		{name: "unsupported type in list", content: "retry_status_codes: [429, 2022-10-12T00:03:50Z]"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := config.Load(writeConfigFile(t, "config.yaml", tc.content), false)
+			assert.ErrorIs(t, err, config.ErrInvalidFile)
+		})
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	f, err := config.Load(path, false)
+	require.NoError(t, err, "the file is optional")
+	_, ok := f.Lookup("PYROSCOPE_REMOTE_ADDRESS")
+	assert.False(t, ok)
+
+	_, err = config.Load(path, true)
+	assert.ErrorIs(t, err, config.ErrInvalidFile, "the file was explicitly configured")
+}
+
+func TestUnknownKeys(t *testing.T) {
+	f, err := config.Load(writeConfigFile(t, "config.yaml", "remote_address: x\nremote_adress: y\nnum_wokers: 1"), true)
+	require.NoError(t, err)
+
+	f.Lookup("PYROSCOPE_REMOTE_ADDRESS")
+	f.Lookup("PYROSCOPE_NUM_WORKERS")
+	assert.Equal(t, []string{"PYROSCOPE_NUM_WOKERS", "PYROSCOPE_REMOTE_ADRESS"}, f.UnknownKeys())
+
+	var nilFile *config.File
+	assert.Empty(t, nilFile.UnknownKeys())
+}
+
+func TestEnvName(t *testing.T) {
+	testCases := map[string]string{
+		"remote_address":           "PYROSCOPE_REMOTE_ADDRESS",
+		"remote-address":           "PYROSCOPE_REMOTE_ADDRESS",
+		"Remote_Address":           "PYROSCOPE_REMOTE_ADDRESS",
+		"PYROSCOPE_REMOTE_ADDRESS": "PYROSCOPE_REMOTE_ADDRESS",
+		"pyroscope_remote_address": "PYROSCOPE_REMOTE_ADDRESS",
+	}
+	for key, expected := range testCases {
+		assert.Equal(t, expected, config.EnvName(key), key)
+	}
+}
@@ -0,0 +1,41 @@
+package config
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/secrets"
+)
+
+// NewCredentials provides the auth token or basic auth credentials
+// Credentials referencing secrets are fetched again every refreshInterval, or once the remote rejects them
+// resolver can only be nil if none of refs references a secret
+func NewCredentials(logger *logrus.Entry, resolver *secrets.Resolver, refs relay.Credentials, refreshInterval time.Duration) relay.CredentialsProvider {
+	if !secrets.IsReference(refs.Token, refs.BasicAuthUser, refs.BasicAuthPassword) {
+		return relay.NewStaticCredentialsProvider(refs)
+	}
+
+	cfg := &relay.RefreshingCredentialsCfg{RefreshInterval: refreshInterval}
+	return relay.NewRefreshingCredentialsProvider(logger, cfg, func(ctx context.Context) (relay.Credentials, error) {
+		// nothing is cached the first time
+		if err := resolver.Refresh(ctx); err != nil {
+			return relay.Credentials{}, err
+		}
+
+		var credentials relay.Credentials
+		var err error
+		if credentials.Token, err = resolver.Resolve(ctx, refs.Token); err != nil {
+			return relay.Credentials{}, err
+		}
+		if credentials.BasicAuthUser, err = resolver.Resolve(ctx, refs.BasicAuthUser); err != nil {
+			return relay.Credentials{}, err
+		}
+		if credentials.BasicAuthPassword, err = resolver.Resolve(ctx, refs.BasicAuthPassword); err != nil {
+			return relay.Credentials{}, err
+		}
+		return credentials, nil
+	})
+}
@@ -0,0 +1,87 @@
+package config_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/config"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/secrets"
+)
+
+func noopLogger() *logrus.Entry {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	return logger.WithFields(logrus.Fields{})
+}
+
+// fakeSSM is an SSM client serving parameters from memory
+type fakeSSM struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func (f *fakeSSM) set(name string, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.values[name] = value
+}
+
+func (f *fakeSSM) GetParameter(_ context.Context, params *ssm.GetParameterInput, _ ...func(*ssm.Options)) (*ssm.GetParameterOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	value, ok := f.values[aws.ToString(params.Name)]
+	if !ok {
+		return nil, errors.New("ParameterNotFound")
+	}
+	return &ssm.GetParameterOutput{Parameter: &types.Parameter{Value: aws.String(value)}}, nil
+}
+
+func TestNewCredentialsStatic(t *testing.T) {
+	refs := relay.Credentials{BasicAuthUser: "user", BasicAuthPassword: "password"}
+	credentials := config.NewCredentials(noopLogger(), nil, refs, time.Minute)
+
+	c, err := credentials.Credentials(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, refs, c)
+}
+
+func TestNewCredentialsSecrets(t *testing.T) {
+	fake := &fakeSSM{values: map[string]string{"/pyroscope/token": "old"}}
+	resolver := secrets.NewResolver(noopLogger(), fake, nil)
+	credentials := config.NewCredentials(noopLogger(), resolver, relay.Credentials{Token: "ssm:/pyroscope/token"}, time.Hour)
+
+	c, err := credentials.Credentials(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, relay.Credentials{Token: "old"}, c)
+
+	// rotated, it's picked up once the remote rejects the old one
+	fake.set("/pyroscope/token", "new")
+	c, err = credentials.Credentials(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "old", c.Token, "cached until the refresh interval")
+	credentials.Invalidate(c)
+	c, err = credentials.Credentials(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, relay.Credentials{Token: "new"}, c)
+}
+
+func TestNewCredentialsUnresolvedSecret(t *testing.T) {
+	resolver := secrets.NewResolver(noopLogger(), &fakeSSM{values: map[string]string{}}, nil)
+	credentials := config.NewCredentials(noopLogger(), resolver, relay.Credentials{BasicAuthUser: "user", BasicAuthPassword: "ssm:/missing"}, time.Hour)
+
+	_, err := credentials.Credentials(context.Background())
+	assert.ErrorIs(t, err, secrets.ErrFetchingSecret)
+}
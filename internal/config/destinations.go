@@ -0,0 +1,119 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/secrets"
+)
+
+// DestinationSettings are the settings of a destination in PYROSCOPE_DESTINATIONS
+// Auth can reference secrets. TLS and OAuth2 settings only apply to PYROSCOPE_REMOTE_ADDRESS
+type DestinationSettings struct {
+	RemoteAddress     string            `json:"remote_address"`
+	AuthToken         string            `json:"auth_token"`
+	BasicAuthUser     string            `json:"basic_auth_user"`
+	BasicAuthPassword string            `json:"basic_auth_password"`
+	TenantID          string            `json:"tenant_id"`
+	HTTPHeaders       map[string]string `json:"http_headers"`
+	Timeout           string            `json:"timeout"`
+}
+
+// DestinationsSettings are the destinations in PYROSCOPE_DESTINATIONS, by name
+type DestinationsSettings map[string]DestinationSettings
+
+var destinationNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// DestinationCfg is the config of a remote profiles are relayed to
+type DestinationCfg struct {
+	Name   string
+	Client *relay.RemoteClientCfg
+}
+
+// ParseDestinations parses PYROSCOPE_DESTINATIONS
+// mainName is the name of PYROSCOPE_REMOTE_ADDRESS, which no other destination can have
+func ParseDestinations(s string, mainName string) (DestinationsSettings, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var destinations DestinationsSettings
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&destinations); err != nil {
+		return nil, relay.NewConfigError(relay.ConfigErrorInvalidSetting, "invalid value for 'PYROSCOPE_DESTINATIONS': %v", err)
+	}
+	for name := range destinations {
+		// names are used as metric labels and spill directories
+		if !destinationNameRegexp.MatchString(name) || name == mainName {
+			return nil, relay.NewConfigError(relay.ConfigErrorInvalidSetting, "invalid destination name '%s', it must match %s and be different from PYROSCOPE_DESTINATION_NAME", name, destinationNameRegexp)
+		}
+	}
+	return destinations, nil
+}
+
+// ReferenceSecrets returns whether the credentials of any destination reference a secret
+func (d DestinationsSettings) ReferenceSecrets() bool {
+	for _, settings := range d {
+		if secrets.IsReference(settings.AuthToken, settings.BasicAuthUser, settings.BasicAuthPassword) {
+			return true
+		}
+	}
+	return false
+}
+
+// Cfgs configures the destinations, sorted by name
+// Other than their own settings, they share the config of the main remote
+// newCredentials provides the credentials of each destination, which are resolved so that unresolved secrets are reported
+func (d DestinationsSettings) Cfgs(ctx context.Context, base *relay.RemoteClientCfg, newCredentials func(relay.Credentials) relay.CredentialsProvider) ([]DestinationCfg, error) {
+	names := make([]string, 0, len(d))
+	for name := range d {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	cfgs := make([]DestinationCfg, 0, len(names))
+	for _, name := range names {
+		settings := d[name]
+		cfg := *base
+		cfg.Address = settings.RemoteAddress
+		cfg.AuthToken = settings.AuthToken
+		cfg.BasicAuthUser = settings.BasicAuthUser
+		cfg.BasicAuthPassword = settings.BasicAuthPassword
+		cfg.TenantID = settings.TenantID
+		cfg.HTTPHeadersJSON = ""
+		cfg.TLS = nil
+		cfg.OAuth2 = nil
+		if len(settings.HTTPHeaders) > 0 {
+			headers, _ := json.Marshal(settings.HTTPHeaders)
+			cfg.HTTPHeadersJSON = string(headers)
+		}
+		if settings.Timeout != "" {
+			// an invalid timeout falls back to the main one
+			timeout, err := time.ParseDuration(settings.Timeout)
+			if err != nil {
+				errs = append(errs, relay.NewConfigError(relay.ConfigErrorInvalidSetting, "destination '%s': invalid timeout '%s': %v", name, settings.Timeout, err))
+			} else {
+				cfg.Timeout = timeout
+			}
+		}
+
+		cfg.Credentials = newCredentials(relay.Credentials{
+			Token:             settings.AuthToken,
+			BasicAuthUser:     settings.BasicAuthUser,
+			BasicAuthPassword: settings.BasicAuthPassword,
+		})
+		if _, err := cfg.Credentials.Credentials(ctx); err != nil {
+			errs = append(errs, relay.NewConfigError(relay.ConfigErrorUnresolvedSecret, "destination '%s': %v", name, err))
+		}
+		cfgs = append(cfgs, DestinationCfg{Name: name, Client: &cfg})
+	}
+	return cfgs, errors.Join(errs...)
+}
@@ -0,0 +1,134 @@
+package config_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/config"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+)
+
+func TestParseDestinations(t *testing.T) {
+	testCases := []struct {
+		name     string
+		value    string
+		expected config.DestinationsSettings
+		err      bool
+	}{
+		{
+			name:  "empty",
+			value: "",
+		},
+		{
+			name:  "destinations",
+			value: `{"eu": {"remote_address": "https://eu.example.com", "tenant_id": "a", "timeout": "5s", "http_headers": {"X-Foo": "bar"}}, "us_2": {"remote_address": "https://us.example.com", "auth_token": "ssm:/token"}}`,
+			expected: config.DestinationsSettings{
+				"eu":   {RemoteAddress: "https://eu.example.com", TenantID: "a", Timeout: "5s", HTTPHeaders: map[string]string{"X-Foo": "bar"}},
+				"us_2": {RemoteAddress: "https://us.example.com", AuthToken: "ssm:/token"},
+			},
+		},
+		{
+			name:  "invalid json",
+			value: `{"eu": `,
+			err:   true,
+		},
+		{
+			name:  "not an object",
+			value: `[{"remote_address": "https://eu.example.com"}]`,
+			err:   true,
+		},
+		{
+			name:  "unknown field",
+			value: `{"eu": {"remote_address": "https://eu.example.com", "tls_ca": "..."}}`,
+			err:   true,
+		},
+		{
+			name:  "invalid name",
+			value: `{"eu/west": {"remote_address": "https://eu.example.com"}}`,
+			err:   true,
+		},
+		{
+			name:  "name of the main remote",
+			value: `{"main": {"remote_address": "https://eu.example.com"}}`,
+			err:   true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			destinations, err := config.ParseDestinations(tc.value, "main")
+			if tc.err {
+				assert.Equal(t, relay.ConfigErrorInvalidSetting, relay.ConfigErrorCategoryOf(err))
+				assert.ErrorIs(t, err, relay.ErrInvalidConfig)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, destinations)
+		})
+	}
+}
+
+func TestDestinationsReferenceSecrets(t *testing.T) {
+	assert.False(t, config.DestinationsSettings{"eu": {AuthToken: "token"}}.ReferenceSecrets())
+	assert.True(t, config.DestinationsSettings{"eu": {AuthToken: "token"}, "us": {BasicAuthPassword: "ssm:/password"}}.ReferenceSecrets())
+}
+
+func TestDestinationsCfgs(t *testing.T) {
+	destinations := config.DestinationsSettings{
+		"us": {RemoteAddress: "https://us.example.com", AuthToken: "unresolved", Timeout: "1h"},
+		"eu": {RemoteAddress: "https://eu.example.com", TenantID: "a", Timeout: "invalid", HTTPHeaders: map[string]string{"X-Foo": "bar"}},
+	}
+	base := &relay.RemoteClientCfg{
+		Address:         "https://main.example.com",
+		AuthToken:       "main-token",
+		TenantID:        "main",
+		HTTPHeadersJSON: `{"X-Main": "main"}`,
+		Timeout:         time.Second * 10,
+		SessionID:       "session",
+		TLS:             &relay.TLSCfg{CAFile: "/ca.pem"},
+		OAuth2:          &relay.OAuth2Cfg{TokenURL: "https://token.example.com"},
+	}
+
+	cfgs, err := destinations.Cfgs(context.Background(), base, func(refs relay.Credentials) relay.CredentialsProvider {
+		if refs.Token == "unresolved" {
+			return failingCredentialsProvider{}
+		}
+		return relay.NewStaticCredentialsProvider(refs)
+	})
+
+	assert.Equal(t, relay.ConfigErrorInvalidSetting, relay.ConfigErrorCategoryOf(err), "invalid timeout")
+	assert.True(t, relay.HasConfigErrorCategory(err, relay.ConfigErrorUnresolvedSecret))
+	require.Len(t, cfgs, 2)
+
+	eu, us := cfgs[0], cfgs[1]
+	assert.Equal(t, "eu", eu.Name, "sorted by name")
+	assert.Equal(t, "https://eu.example.com", eu.Client.Address)
+	assert.Equal(t, "", eu.Client.AuthToken)
+	assert.Equal(t, "a", eu.Client.TenantID)
+	assert.Equal(t, `{"X-Foo":"bar"}`, eu.Client.HTTPHeadersJSON)
+	assert.Equal(t, time.Second*10, eu.Client.Timeout, "invalid timeout falls back to the main one")
+	assert.Equal(t, "session", eu.Client.SessionID)
+	assert.Nil(t, eu.Client.TLS)
+	assert.Nil(t, eu.Client.OAuth2)
+
+	assert.Equal(t, "us", us.Name)
+	assert.Equal(t, "unresolved", us.Client.AuthToken)
+	assert.Equal(t, "", us.Client.TenantID)
+	assert.Equal(t, "", us.Client.HTTPHeadersJSON)
+	assert.Equal(t, time.Hour, us.Client.Timeout)
+
+	assert.Equal(t, "https://main.example.com", base.Address, "the main config is left untouched")
+}
+
+type failingCredentialsProvider struct{}
+
+func (failingCredentialsProvider) Credentials(context.Context) (relay.Credentials, error) {
+	return relay.Credentials{}, errors.New("unresolved secret")
+}
+
+func (failingCredentialsProvider) Invalidate(relay.Credentials) {}
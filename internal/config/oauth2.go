@@ -0,0 +1,50 @@
+package config
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/secrets"
+)
+
+// OAuth2Settings are the PYROSCOPE_OAUTH2_* settings
+type OAuth2Settings struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	// Scopes are either comma or space separated
+	Scopes     string
+	Audience   string
+	AuthInBody bool
+	Timeout    time.Duration
+}
+
+// NewOAuth2Cfg configures the client credentials grant, resolving the client secret if it references a secret
+// The client secret is resolved once: unlike credentials it isn't refreshed
+// It's nil if there is no token URL
+func NewOAuth2Cfg(ctx context.Context, settings OAuth2Settings, resolver *secrets.Resolver) (*relay.OAuth2Cfg, error) {
+	if settings.TokenURL == "" {
+		return nil, nil
+	}
+
+	cfg := &relay.OAuth2Cfg{
+		TokenURL:     settings.TokenURL,
+		ClientID:     settings.ClientID,
+		ClientSecret: settings.ClientSecret,
+		Audience:     settings.Audience,
+		AuthInBody:   settings.AuthInBody,
+		Timeout:      settings.Timeout,
+		Scopes:       strings.FieldsFunc(settings.Scopes, func(r rune) bool { return r == ',' || r == ' ' }),
+	}
+
+	if resolver != nil {
+		clientSecret, err := resolver.Resolve(ctx, settings.ClientSecret)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.ClientSecret = clientSecret
+	}
+	return cfg, nil
+}
@@ -0,0 +1,75 @@
+package config_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/config"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/secrets"
+)
+
+func TestNewOAuth2Cfg(t *testing.T) {
+	resolver := secrets.NewResolver(noopLogger(), &fakeSSM{values: map[string]string{"/oauth2/secret": "resolved"}}, nil)
+
+	testCases := []struct {
+		name     string
+		settings config.OAuth2Settings
+		resolver *secrets.Resolver
+		expected *relay.OAuth2Cfg
+		err      bool
+	}{
+		{
+			name: "no token url",
+		},
+		{
+			name: "settings",
+			settings: config.OAuth2Settings{
+				TokenURL:     "https://auth.example.com/token",
+				ClientID:     "id",
+				ClientSecret: "secret",
+				Scopes:       "profiles:write, profiles:read  admin",
+				Audience:     "pyroscope",
+				AuthInBody:   true,
+				Timeout:      time.Second,
+			},
+			expected: &relay.OAuth2Cfg{
+				TokenURL:     "https://auth.example.com/token",
+				ClientID:     "id",
+				ClientSecret: "secret",
+				Scopes:       []string{"profiles:write", "profiles:read", "admin"},
+				Audience:     "pyroscope",
+				AuthInBody:   true,
+				Timeout:      time.Second,
+			},
+		},
+		{
+			name:     "client secret reference",
+			settings: config.OAuth2Settings{TokenURL: "https://auth.example.com/token", ClientSecret: "ssm:/oauth2/secret"},
+			resolver: resolver,
+			expected: &relay.OAuth2Cfg{TokenURL: "https://auth.example.com/token", ClientSecret: "resolved", Scopes: []string{}},
+		},
+		{
+			name:     "unresolved client secret",
+			settings: config.OAuth2Settings{TokenURL: "https://auth.example.com/token", ClientSecret: "ssm:/missing"},
+			resolver: resolver,
+			err:      true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := config.NewOAuth2Cfg(context.Background(), tc.settings, tc.resolver)
+			if tc.err {
+				assert.ErrorIs(t, err, secrets.ErrFetchingSecret)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, cfg)
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package config
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+)
+
+// RelabelRuleSettings are the settings of a rule in PYROSCOPE_RELABEL_RULES, see relay.RelabelRule
+type RelabelRuleSettings struct {
+	Action       string   `json:"action"`
+	Match        string   `json:"match"`
+	SourceLabels []string `json:"source_labels"`
+	Separator    string   `json:"separator"`
+	Regex        string   `json:"regex"`
+	TargetLabel  string   `json:"target_label"`
+	Replacement  string   `json:"replacement"`
+	Modulus      uint64   `json:"modulus"`
+}
+
+// NewRelabelCfg configures the relabel rules of PYROSCOPE_RELABEL_RULES, it's nil if there are none
+func NewRelabelCfg(rulesJSON string, metrics *relay.Metrics) (*relay.RelabelCfg, error) {
+	if rulesJSON == "" {
+		return nil, nil
+	}
+
+	var rules []RelabelRuleSettings
+	dec := json.NewDecoder(strings.NewReader(rulesJSON))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rules); err != nil {
+		return nil, relay.NewConfigError(relay.ConfigErrorInvalidSetting, "invalid value for 'PYROSCOPE_RELABEL_RULES': %v", err)
+	}
+
+	cfg := &relay.RelabelCfg{Metrics: metrics}
+	for _, r := range rules {
+		cfg.Rules = append(cfg.Rules, relay.RelabelRule{
+			Action:       relay.RelabelAction(r.Action),
+			Match:        r.Match,
+			SourceLabels: r.SourceLabels,
+			Separator:    r.Separator,
+			Regex:        r.Regex,
+			TargetLabel:  r.TargetLabel,
+			Replacement:  r.Replacement,
+			Modulus:      r.Modulus,
+		})
+	}
+	return cfg, cfg.Validate()
+}
@@ -0,0 +1,70 @@
+package config_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/config"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+)
+
+func TestNewRelabelCfg(t *testing.T) {
+	metrics := relay.NewMetrics()
+
+	testCases := []struct {
+		name     string
+		rules    string
+		expected *relay.RelabelCfg
+		err      bool
+	}{
+		{
+			name: "no rules",
+		},
+		{
+			name: "rules",
+			rules: `[
+				{"action": "drop", "match": "{env=\"dev\"}"},
+				{"action": "replace", "source_labels": ["team", "env"], "separator": "-", "regex": "(.+)", "target_label": "owner", "replacement": "$1"},
+				{"action": "hashmod", "source_labels": ["pod"], "target_label": "shard", "modulus": 4}
+			]`,
+			expected: &relay.RelabelCfg{
+				Rules: []relay.RelabelRule{
+					{Action: relay.RelabelDrop, Match: `{env="dev"}`},
+					{Action: relay.RelabelReplace, SourceLabels: []string{"team", "env"}, Separator: "-", Regex: "(.+)", TargetLabel: "owner", Replacement: "$1"},
+					{Action: relay.RelabelHashMod, SourceLabels: []string{"pod"}, TargetLabel: "shard", Modulus: 4},
+				},
+				Metrics: metrics,
+			},
+		},
+		{
+			name:  "invalid json",
+			rules: `[{"action": `,
+			err:   true,
+		},
+		{
+			name:  "unknown field",
+			rules: `[{"action": "drop", "labels": ["env"]}]`,
+			err:   true,
+		},
+		{
+			name:  "unknown action",
+			rules: `[{"action": "rename"}]`,
+			err:   true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := config.NewRelabelCfg(tc.rules, metrics)
+			if tc.err {
+				assert.Equal(t, relay.ConfigErrorInvalidSetting, relay.ConfigErrorCategoryOf(err))
+				assert.ErrorIs(t, err, relay.ErrInvalidConfig)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, cfg)
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+)
+
+// RouteSettings are the settings of a route in PYROSCOPE_ROUTES
+type RouteSettings struct {
+	Match       string `json:"match"`
+	Destination string `json:"destination"`
+	TenantID    string `json:"tenant_id"`
+}
+
+// NewRouterCfg configures the routing of profiles from PYROSCOPE_ROUTES and the default route, it's nil if there are no routes
+// Routes can only relay to one of destinations
+func NewRouterCfg(routesJSON string, defaultRoute relay.RouteCfg, destinations []DestinationCfg) (*relay.RouterCfg, error) {
+	if routesJSON == "" && defaultRoute.Destination == "" && defaultRoute.TenantID == "" {
+		return nil, nil
+	}
+
+	var routes []RouteSettings
+	if routesJSON != "" {
+		dec := json.NewDecoder(strings.NewReader(routesJSON))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&routes); err != nil {
+			return nil, relay.NewConfigError(relay.ConfigErrorInvalidSetting, "invalid value for 'PYROSCOPE_ROUTES': %v", err)
+		}
+	}
+
+	cfg := &relay.RouterCfg{Default: defaultRoute}
+	for _, r := range routes {
+		cfg.Routes = append(cfg.Routes, relay.RouteCfg{Match: r.Match, Destination: r.Destination, TenantID: r.TenantID})
+	}
+
+	errs := []error{cfg.Validate()}
+	names := map[string]bool{}
+	for _, d := range destinations {
+		names[d.Name] = true
+	}
+	for _, r := range cfg.Routes {
+		if r.Destination != "" && !names[r.Destination] {
+			errs = append(errs, relay.NewConfigError(relay.ConfigErrorInvalidSetting, "route '%s': unknown destination '%s'", r.Match, r.Destination))
+		}
+	}
+	if cfg.Default.Destination != "" && !names[cfg.Default.Destination] {
+		errs = append(errs, relay.NewConfigError(relay.ConfigErrorInvalidSetting, "default route: unknown destination '%s'", cfg.Default.Destination))
+	}
+	return cfg, errors.Join(errs...)
+}
@@ -0,0 +1,82 @@
+package config_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/config"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+)
+
+func TestNewRouterCfg(t *testing.T) {
+	destinations := []config.DestinationCfg{{Name: "main"}, {Name: "eu"}}
+
+	testCases := []struct {
+		name         string
+		routes       string
+		defaultRoute relay.RouteCfg
+		expected     *relay.RouterCfg
+		err          bool
+	}{
+		{
+			name: "no routes",
+		},
+		{
+			name:         "default route only",
+			defaultRoute: relay.RouteCfg{TenantID: "shared"},
+			expected:     &relay.RouterCfg{Default: relay.RouteCfg{TenantID: "shared"}},
+		},
+		{
+			name:         "routes",
+			routes:       `[{"match": "{team=\"payments\"}", "tenant_id": "payments"}, {"match": "checkout", "destination": "eu"}]`,
+			defaultRoute: relay.RouteCfg{Destination: "main"},
+			expected: &relay.RouterCfg{
+				Routes: []relay.RouteCfg{
+					{Match: `{team="payments"}`, TenantID: "payments"},
+					{Match: "checkout", Destination: "eu"},
+				},
+				Default: relay.RouteCfg{Destination: "main"},
+			},
+		},
+		{
+			name:   "invalid json",
+			routes: `[{"match": `,
+			err:    true,
+		},
+		{
+			name:   "unknown field",
+			routes: `[{"match": "checkout", "tenant": "payments"}]`,
+			err:    true,
+		},
+		{
+			name:   "invalid match",
+			routes: `[{"match": "{team=payments}"}]`,
+			err:    true,
+		},
+		{
+			name:   "unknown destination",
+			routes: `[{"match": "checkout", "destination": "us"}]`,
+			err:    true,
+		},
+		{
+			name:         "unknown default destination",
+			defaultRoute: relay.RouteCfg{Destination: "us"},
+			err:          true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := config.NewRouterCfg(tc.routes, tc.defaultRoute, destinations)
+			if tc.err {
+				assert.Equal(t, relay.ConfigErrorInvalidSetting, relay.ConfigErrorCategoryOf(err))
+				assert.ErrorIs(t, err, relay.ErrInvalidConfig)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, cfg)
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+)
+
+// SamplingOverrideSettings are the settings of an override in PYROSCOPE_SAMPLING_OVERRIDES
+// Unset values are the global ones, see relay.SamplingOverride
+type SamplingOverrideSettings struct {
+	Match             string   `json:"match"`
+	Rate              *float64 `json:"rate"`
+	BytesPerSecond    *int64   `json:"bytes_per_second"`
+	ProfilesPerMinute *int64   `json:"profiles_per_minute"`
+}
+
+// NewSamplerCfg configures sampling and rate limiting from the global settings and PYROSCOPE_SAMPLING_OVERRIDES
+// It's nil if all profiles are relayed
+func NewSamplerCfg(global relay.SamplingCfg, overridesJSON string, sessionID string, metrics *relay.Metrics) (*relay.SamplerCfg, error) {
+	if global.Rate == 1 && global.BytesPerSecond == 0 && global.ProfilesPerMinute == 0 && overridesJSON == "" {
+		return nil, nil
+	}
+
+	if global.Rate == 0 {
+		// it would mean the default in relay.SamplingCfg
+		return nil, relay.NewConfigError(relay.ConfigErrorInvalidSetting, "invalid value for 'PYROSCOPE_SAMPLING_RATE': it must be greater than 0, use a relabel rule to drop all profiles")
+	}
+	var overrides []SamplingOverrideSettings
+	if overridesJSON != "" {
+		dec := json.NewDecoder(strings.NewReader(overridesJSON))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&overrides); err != nil {
+			return nil, relay.NewConfigError(relay.ConfigErrorInvalidSetting, "invalid value for 'PYROSCOPE_SAMPLING_OVERRIDES': %v", err)
+		}
+	}
+
+	cfg := &relay.SamplerCfg{
+		SamplingCfg: global,
+		SessionID:   sessionID,
+		Metrics:     metrics,
+	}
+	for _, o := range overrides {
+		cfg.Overrides = append(cfg.Overrides, relay.SamplingOverride{
+			Match:             o.Match,
+			Rate:              o.Rate,
+			BytesPerSecond:    o.BytesPerSecond,
+			ProfilesPerMinute: o.ProfilesPerMinute,
+		})
+	}
+	return cfg, cfg.Validate()
+}
@@ -0,0 +1,92 @@
+package config_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/config"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestNewSamplerCfg(t *testing.T) {
+	metrics := relay.NewMetrics()
+
+	testCases := []struct {
+		name      string
+		global    relay.SamplingCfg
+		overrides string
+		expected  *relay.SamplerCfg
+		err       bool
+	}{
+		{
+			name:   "all profiles are relayed",
+			global: relay.SamplingCfg{Rate: 1},
+		},
+		{
+			name:     "global settings",
+			global:   relay.SamplingCfg{Rate: 0.1, BytesPerSecond: 1000},
+			expected: &relay.SamplerCfg{SamplingCfg: relay.SamplingCfg{Rate: 0.1, BytesPerSecond: 1000}, SessionID: "session", Metrics: metrics},
+		},
+		{
+			name:      "overrides",
+			global:    relay.SamplingCfg{Rate: 0.1, ProfilesPerMinute: 60},
+			overrides: `[{"match": "checkout{env=\"prod\"}", "rate": 1}, {"match": "{team=\"search\"}", "bytes_per_second": 100000, "profiles_per_minute": 0}]`,
+			expected: &relay.SamplerCfg{
+				SamplingCfg: relay.SamplingCfg{Rate: 0.1, ProfilesPerMinute: 60},
+				SessionID:   "session",
+				Overrides: []relay.SamplingOverride{
+					{Match: `checkout{env="prod"}`, Rate: ptr(1.0)},
+					{Match: `{team="search"}`, BytesPerSecond: ptr[int64](100000), ProfilesPerMinute: ptr[int64](0)},
+				},
+				Metrics: metrics,
+			},
+		},
+		{
+			name:   "rate of 0",
+			global: relay.SamplingCfg{Rate: 0},
+			err:    true,
+		},
+		{
+			name:   "invalid rate",
+			global: relay.SamplingCfg{Rate: 1.5},
+			err:    true,
+		},
+		{
+			name:      "invalid json",
+			global:    relay.SamplingCfg{Rate: 1},
+			overrides: `[{"match": `,
+			err:       true,
+		},
+		{
+			name:      "unknown field",
+			global:    relay.SamplingCfg{Rate: 1},
+			overrides: `[{"match": "my.app", "sampling_rate": 0.5}]`,
+			err:       true,
+		},
+		{
+			name:      "override rate of 0",
+			global:    relay.SamplingCfg{Rate: 1},
+			overrides: `[{"match": "my.app", "rate": 0}]`,
+			err:       true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := config.NewSamplerCfg(tc.global, tc.overrides, "session", metrics)
+			if tc.err {
+				assert.Equal(t, relay.ConfigErrorInvalidSetting, relay.ConfigErrorCategoryOf(err))
+				assert.ErrorIs(t, err, relay.ErrInvalidConfig)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, cfg)
+		})
+	}
+}
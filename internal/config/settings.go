@@ -0,0 +1,141 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidSetting = errors.New("invalid value")
+
+// Settings reads typed settings from the env vars, or else from the config file
+// Invalid values fall back to the default, and are reported by Errors
+type Settings struct {
+	file      *File
+	lookupEnv func(string) (string, bool)
+
+	mu   sync.Mutex
+	errs []error
+}
+
+// NewSettings creates settings backed by lookupEnv (usually os.LookupEnv) and an optional config file
+func NewSettings(file *File, lookupEnv func(string) (string, bool)) *Settings {
+	return &Settings{
+		file:      file,
+		lookupEnv: lookupEnv,
+	}
+}
+
+// Lookup returns the value of a setting from its env var, or else from the config file
+// Empty values are ignored, so that a setting can be unset by an empty env var
+func (s *Settings) Lookup(key string) (string, bool) {
+	fileValue, inFile := s.file.Lookup(key)
+
+	// has an explicit value
+	if k, ok := s.lookupEnv(key); ok && k != "" {
+		return k, true
+	}
+	if inFile && fileValue != "" {
+		return fileValue, true
+	}
+	return "", false
+}
+
+// Errors returns the invalid values found so far
+func (s *Settings) Errors() []error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]error{}, s.errs...)
+}
+
+func (s *Settings) invalid(key string, value string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errs = append(s.errs, fmt.Errorf("%w for '%s': '%s': %v", ErrInvalidSetting, key, value, err))
+}
+
+func (s *Settings) StrOr(key string, fallback string) string {
+	if k, ok := s.Lookup(key); ok {
+		return k
+	}
+
+	return fallback
+}
+
+func (s *Settings) Bool(key string) bool {
+	return s.BoolOr(key, false)
+}
+
+func (s *Settings) BoolOr(key string, fallback bool) bool {
+	if k, ok := s.Lookup(key); ok {
+		v, err := strconv.ParseBool(k)
+		if err != nil {
+			s.invalid(key, k, err)
+			return fallback
+		}
+		return v
+	}
+
+	return fallback
+}
+
+func (s *Settings) DurationOr(key string, fallback time.Duration) time.Duration {
+	if k, ok := s.Lookup(key); ok {
+		dur, err := time.ParseDuration(k)
+		if err != nil {
+			s.invalid(key, k, err)
+			return fallback
+		}
+
+		return dur
+	}
+
+	return fallback
+}
+
+func (s *Settings) IntOr(key string, fallback int) int {
+	if k, ok := s.Lookup(key); ok {
+		val, err := strconv.Atoi(k)
+		if err != nil {
+			s.invalid(key, k, err)
+			return fallback
+		}
+		return val
+	}
+
+	return fallback
+}
+
+func (s *Settings) FloatOr(key string, fallback float64) float64 {
+	if k, ok := s.Lookup(key); ok {
+		val, err := strconv.ParseFloat(k, 64)
+		if err != nil {
+			s.invalid(key, k, err)
+			return fallback
+		}
+		return val
+	}
+
+	return fallback
+}
+
+// IntListOr parses a comma separated list of ints, eg '429,502,503'
+func (s *Settings) IntListOr(key string, fallback []int) []int {
+	if k, ok := s.Lookup(key); ok {
+		var vals []int
+		for _, v := range strings.Split(k, ",") {
+			val, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				s.invalid(key, k, err)
+				return fallback
+			}
+			vals = append(vals, val)
+		}
+		return vals
+	}
+
+	return fallback
+}
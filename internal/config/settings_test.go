@@ -0,0 +1,90 @@
+package config_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/config"
+)
+
+func lookupEnvFrom(env map[string]string) func(string) (string, bool) {
+	return func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	}
+}
+
+func TestSettingsPrecedence(t *testing.T) {
+	f, err := config.Load(writeConfigFile(t, "config.yaml", `
+remote_address: https://file.example.com
+tenant_id: file-tenant
+num_workers: 3
+`), true)
+	require.NoError(t, err)
+
+	settings := config.NewSettings(f, lookupEnvFrom(map[string]string{
+		"PYROSCOPE_REMOTE_ADDRESS": "https://env.example.com",
+		"PYROSCOPE_TENANT_ID":      "",
+	}))
+
+	assert.Equal(t, "https://env.example.com", settings.StrOr("PYROSCOPE_REMOTE_ADDRESS", "default"), "env over file")
+	assert.Equal(t, "file-tenant", settings.StrOr("PYROSCOPE_TENANT_ID", "default"), "empty env var falls back to the file")
+	assert.Equal(t, 3, settings.IntOr("PYROSCOPE_NUM_WORKERS", 5), "file over default")
+	assert.Equal(t, "default", settings.StrOr("PYROSCOPE_AUTH_TOKEN", "default"), "neither env nor file")
+	assert.Empty(t, settings.Errors())
+}
+
+func TestSettingsWithoutFile(t *testing.T) {
+	settings := config.NewSettings(nil, lookupEnvFrom(map[string]string{"PYROSCOPE_TENANT_ID": "env-tenant"}))
+
+	assert.Equal(t, "env-tenant", settings.StrOr("PYROSCOPE_TENANT_ID", ""))
+	assert.Equal(t, "default", settings.StrOr("PYROSCOPE_REMOTE_ADDRESS", "default"))
+}
+
+func TestSettingsTypes(t *testing.T) {
+	settings := config.NewSettings(nil, lookupEnvFrom(map[string]string{
+		"BOOL":     "true",
+		"DURATION": "1m30s",
+		"INT":      "42",
+		"FLOAT":    "0.25",
+		"INT_LIST": "429, 502,503",
+	}))
+
+	assert.True(t, settings.Bool("BOOL"))
+	assert.False(t, settings.Bool("MISSING"))
+	assert.True(t, settings.BoolOr("MISSING", true))
+	assert.Equal(t, time.Second*90, settings.DurationOr("DURATION", time.Second))
+	assert.Equal(t, 42, settings.IntOr("INT", 1))
+	assert.Equal(t, 0.25, settings.FloatOr("FLOAT", 1))
+	assert.Equal(t, []int{429, 502, 503}, settings.IntListOr("INT_LIST", nil))
+	assert.Empty(t, settings.Errors())
+}
+
+func TestSettingsInvalidTypes(t *testing.T) {
+	f, err := config.Load(writeConfigFile(t, "config.yaml", "int: [1, 2]"), true)
+	require.NoError(t, err)
+
+	settings := config.NewSettings(f, lookupEnvFrom(map[string]string{
+		"BOOL":     "yes please",
+		"DURATION": "10",
+		"FLOAT":    "a quarter",
+		"INT_LIST": "429,oops",
+	}))
+
+	// invalid values fall back to the default
+	assert.True(t, settings.BoolOr("BOOL", true))
+	assert.Equal(t, time.Second, settings.DurationOr("DURATION", time.Second))
+	assert.Equal(t, 5, settings.IntOr("PYROSCOPE_INT", 5), "lists from the file are comma separated")
+	assert.Equal(t, 1.0, settings.FloatOr("FLOAT", 1))
+	assert.Equal(t, []int{429}, settings.IntListOr("INT_LIST", []int{429}))
+
+	errs := settings.Errors()
+	require.Len(t, errs, 5)
+	for _, err := range errs {
+		assert.ErrorIs(t, err, config.ErrInvalidSetting)
+	}
+	assert.EqualError(t, errs[0], `invalid value for 'BOOL': 'yes please': strconv.ParseBool: parsing "yes please": invalid syntax`)
+}
@@ -0,0 +1,25 @@
+package config
+
+import (
+	"context"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/secrets"
+)
+
+// NewTLSCfg configures the TLS connections to the remote from the PYROSCOPE_TLS_* settings
+// The inline CA, certificate and key are resolved if they reference a secret, once: unlike credentials they aren't refreshed
+func NewTLSCfg(ctx context.Context, settings relay.TLSCfg, resolver *secrets.Resolver) (*relay.TLSCfg, error) {
+	cfg := &settings
+	if resolver == nil {
+		return cfg, nil
+	}
+
+	var err error
+	for _, v := range []*string{&cfg.CA, &cfg.Cert, &cfg.Key} {
+		if *v, err = resolver.Resolve(ctx, *v); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
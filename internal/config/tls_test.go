@@ -0,0 +1,70 @@
+package config_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/config"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/secrets"
+)
+
+func TestNewTLSCfg(t *testing.T) {
+	resolver := secrets.NewResolver(noopLogger(), &fakeSSM{values: map[string]string{
+		"/tls/ca":   "ca-pem",
+		"/tls/cert": "cert-pem",
+		"/tls/key":  "key-pem",
+	}}, nil)
+
+	testCases := []struct {
+		name     string
+		settings relay.TLSCfg
+		resolver *secrets.Resolver
+		expected *relay.TLSCfg
+		err      bool
+	}{
+		{
+			name:     "files",
+			settings: relay.TLSCfg{CAFile: "/ca.pem", CertFile: "/cert.pem", KeyFile: "/key.pem", ServerName: "example.com", MinVersion: "1.3"},
+			expected: &relay.TLSCfg{CAFile: "/ca.pem", CertFile: "/cert.pem", KeyFile: "/key.pem", ServerName: "example.com", MinVersion: "1.3"},
+		},
+		{
+			name:     "inline values without resolver",
+			settings: relay.TLSCfg{CA: "ca-pem", Cert: "cert-pem", Key: "key-pem"},
+			expected: &relay.TLSCfg{CA: "ca-pem", Cert: "cert-pem", Key: "key-pem"},
+		},
+		{
+			name:     "secret references",
+			settings: relay.TLSCfg{CA: "ssm:/tls/ca", Cert: "ssm:/tls/cert", Key: "ssm:/tls/key"},
+			resolver: resolver,
+			expected: &relay.TLSCfg{CA: "ca-pem", Cert: "cert-pem", Key: "key-pem"},
+		},
+		{
+			name:     "inline values with resolver",
+			settings: relay.TLSCfg{CA: "ssm:/tls/ca", Cert: "cert-pem", Key: "key-pem"},
+			resolver: resolver,
+			expected: &relay.TLSCfg{CA: "ca-pem", Cert: "cert-pem", Key: "key-pem"},
+		},
+		{
+			name:     "unresolved secret",
+			settings: relay.TLSCfg{Key: "ssm:/missing"},
+			resolver: resolver,
+			err:      true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := config.NewTLSCfg(context.Background(), tc.settings, tc.resolver)
+			if tc.err {
+				assert.ErrorIs(t, err, secrets.ErrFetchingSecret)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, cfg)
+		})
+	}
+}
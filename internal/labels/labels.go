@@ -0,0 +1,36 @@
+package labels
+
+import (
+	"net/http"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/flameql"
+)
+
+// InjectToRequest adds labels to the key in the 'name' query param of the request
+// Labels already present in the request are kept untouched, and empty values are ignored
+func InjectToRequest(labels map[string]string, r *http.Request) {
+	if len(labels) == 0 {
+		return
+	}
+
+	parsed, err := flameql.ParseKey(r.URL.Query().Get("name"))
+	if err != nil {
+		// This is an invalid request, but we defer to the backend.
+		return
+	}
+
+	changed := false
+	for k, v := range labels {
+		if _, ok := parsed.Labels()[k]; ok || v == "" {
+			continue
+		}
+		parsed.Add(k, v)
+		changed = true
+	}
+
+	if changed {
+		q := r.URL.Query()
+		q.Set("name", parsed.Normalized())
+		r.URL.RawQuery = q.Encode()
+	}
+}
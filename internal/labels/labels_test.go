@@ -0,0 +1,46 @@
+package labels_test
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/labels"
+)
+
+func TestInjectToRequest(t *testing.T) {
+	testCases := []struct {
+		name     string
+		key      string
+		labels   map[string]string
+		expected string
+	}{
+		{"no labels", "app.cpu{foo=bar}", nil, "app.cpu{foo=bar}"},
+		{"no labels in key", "app.cpu", map[string]string{"region": "us-east-1"}, "app.cpu{region=us-east-1}"},
+		{"merged and sorted", "app.cpu{foo=bar}", map[string]string{"region": "us-east-1"}, "app.cpu{foo=bar,region=us-east-1}"},
+		{"existing label kept", "app.cpu{region=eu-west-1}", map[string]string{"region": "us-east-1"}, "app.cpu{region=eu-west-1}"},
+		{"empty value ignored", "app.cpu", map[string]string{"region": ""}, "app.cpu"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodPost, "/ingest?"+url.Values{"name": {tc.key}}.Encode(), nil)
+			require.NoError(t, err)
+
+			labels.InjectToRequest(tc.labels, r)
+			assert.Equal(t, tc.expected, r.URL.Query().Get("name"))
+		})
+	}
+}
+
+func TestInjectToRequestKeepsOtherParams(t *testing.T) {
+	r, err := http.NewRequest(http.MethodPost, "/ingest?name=app.cpu&from=1&until=2", nil)
+	require.NoError(t, err)
+
+	labels.InjectToRequest(map[string]string{"region": "us-east-1"}, r)
+	assert.Equal(t, "1", r.URL.Query().Get("from"))
+	assert.Equal(t, "2", r.URL.Query().Get("until"))
+}
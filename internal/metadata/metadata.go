@@ -0,0 +1,92 @@
+package metadata
+
+import (
+	"runtime"
+	"strings"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/extension"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/flameql"
+)
+
+// Names of the labels describing the lambda function, before the prefix is applied
+const (
+	FunctionName    = "function_name"
+	FunctionVersion = "function_version"
+	Region          = "region"
+	MemorySize      = "memory_size"
+	Architecture    = "architecture"
+	Runtime         = "runtime"
+	LogStream       = "log_stream"
+)
+
+type Config struct {
+	// Prefix is prepended to every label name
+	Prefix string
+	// Exclude lists the labels (without prefix) that should not be added
+	Exclude []string
+}
+
+// FromEnv returns the labels describing the lambda function, based on the environment
+// See https://docs.aws.amazon.com/lambda/latest/dg/configuration-envvars.html#configuration-envvars-runtime
+func FromEnv(config Config, getenv func(string) string) (map[string]string, error) {
+	return build(config, map[string]string{
+		FunctionName:    getenv("AWS_LAMBDA_FUNCTION_NAME"),
+		FunctionVersion: getenv("AWS_LAMBDA_FUNCTION_VERSION"),
+		Region:          getenv("AWS_REGION"),
+		MemorySize:      getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE"),
+		Architecture:    architecture(runtime.GOARCH),
+		Runtime:         strings.TrimPrefix(getenv("AWS_EXECUTION_ENV"), "AWS_Lambda_"),
+		LogStream:       getenv("AWS_LAMBDA_LOG_STREAM_NAME"),
+	})
+}
+
+// FromRegisterResponse returns the labels describing the lambda function, based on the /register response
+func FromRegisterResponse(config Config, res *extension.RegisterResponse) (map[string]string, error) {
+	return build(config, map[string]string{
+		FunctionName:    res.FunctionName,
+		FunctionVersion: res.FunctionVersion,
+	})
+}
+
+func build(config Config, values map[string]string) (map[string]string, error) {
+	for _, name := range config.Exclude {
+		delete(values, strings.TrimSpace(name))
+	}
+
+	labels := make(map[string]string, len(values))
+	for name, value := range values {
+		if value == "" {
+			continue
+		}
+
+		key := config.Prefix + name
+		if err := flameql.ValidateTagKey(key); err != nil {
+			return nil, err
+		}
+		labels[key] = sanitizeValue(value)
+	}
+	return labels, nil
+}
+
+// sanitizeValue replaces characters which would break the key syntax
+func sanitizeValue(v string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ',', '{', '}':
+			return '_'
+		default:
+			return r
+		}
+	}, v)
+}
+
+// architecture maps GOARCH to the names used by lambda
+// The extension is built for the same architecture as the function
+func architecture(goarch string) string {
+	switch goarch {
+	case "amd64":
+		return "x86_64"
+	default:
+		return goarch
+	}
+}
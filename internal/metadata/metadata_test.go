@@ -0,0 +1,149 @@
+package metadata_test
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/extension"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/metadata"
+)
+
+func getenvFrom(env map[string]string) func(string) string {
+	return func(k string) string { return env[k] }
+}
+
+func expectedArchitecture() string {
+	if runtime.GOARCH == "amd64" {
+		return "x86_64"
+	}
+	return runtime.GOARCH
+}
+
+func TestFromEnv(t *testing.T) {
+	lambdaEnv := map[string]string{
+		"AWS_LAMBDA_FUNCTION_NAME":        "my-function",
+		"AWS_LAMBDA_FUNCTION_VERSION":     "$LATEST",
+		"AWS_REGION":                      "us-east-1",
+		"AWS_LAMBDA_FUNCTION_MEMORY_SIZE": "128",
+		"AWS_EXECUTION_ENV":               "AWS_Lambda_python3.9",
+		"AWS_LAMBDA_LOG_STREAM_NAME":      "2022/10/12/[$LATEST]abc",
+	}
+
+	testCases := []struct {
+		name     string
+		config   metadata.Config
+		env      map[string]string
+		expected map[string]string
+	}{
+		{
+			name: "all variables",
+			env:  lambdaEnv,
+			expected: map[string]string{
+				"function_name":    "my-function",
+				"function_version": "$LATEST",
+				"region":           "us-east-1",
+				"memory_size":      "128",
+				"architecture":     expectedArchitecture(),
+				"runtime":          "python3.9",
+				"log_stream":       "2022/10/12/[$LATEST]abc",
+			},
+		},
+		{
+			name: "missing variables",
+			env: map[string]string{
+				"AWS_LAMBDA_FUNCTION_NAME": "my-function",
+			},
+			expected: map[string]string{
+				"function_name": "my-function",
+				"architecture":  expectedArchitecture(),
+			},
+		},
+		{
+			name:     "no variables",
+			env:      map[string]string{},
+			expected: map[string]string{"architecture": expectedArchitecture()},
+		},
+		{
+			name:   "prefix",
+			config: metadata.Config{Prefix: "lambda_"},
+			env: map[string]string{
+				"AWS_LAMBDA_FUNCTION_NAME": "my-function",
+				"AWS_REGION":               "us-east-1",
+			},
+			expected: map[string]string{
+				"lambda_function_name": "my-function",
+				"lambda_region":        "us-east-1",
+				"lambda_architecture":  expectedArchitecture(),
+			},
+		},
+		{
+			name:   "excluded",
+			config: metadata.Config{Exclude: []string{"log_stream", " architecture ", "memory_size", "function_version", "runtime"}},
+			env:    lambdaEnv,
+			expected: map[string]string{
+				"function_name": "my-function",
+				"region":        "us-east-1",
+			},
+		},
+		{
+			name: "sanitized values",
+			env: map[string]string{
+				"AWS_LAMBDA_FUNCTION_NAME": "my,function{1}",
+			},
+			expected: map[string]string{
+				"function_name": "my_function_1_",
+				"architecture":  expectedArchitecture(),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			labels, err := metadata.FromEnv(tc.config, getenvFrom(tc.env))
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, labels)
+		})
+	}
+}
+
+func TestFromEnvInvalidPrefix(t *testing.T) {
+	_, err := metadata.FromEnv(metadata.Config{Prefix: "lambda-{"}, getenvFrom(map[string]string{}))
+	assert.Error(t, err)
+}
+
+func TestFromRegisterResponse(t *testing.T) {
+	testCases := []struct {
+		name     string
+		res      extension.RegisterResponse
+		expected map[string]string
+	}{
+		{
+			name: "name and version",
+			res:  extension.RegisterResponse{FunctionName: "my-function", FunctionVersion: "3"},
+			expected: map[string]string{
+				"function_name":    "my-function",
+				"function_version": "3",
+			},
+		},
+		{
+			name:     "missing version",
+			res:      extension.RegisterResponse{FunctionName: "my-function"},
+			expected: map[string]string{"function_name": "my-function"},
+		},
+		{
+			name:     "empty",
+			expected: map[string]string{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			labels, err := metadata.FromRegisterResponse(metadata.Config{}, &tc.res)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, labels)
+		})
+	}
+}
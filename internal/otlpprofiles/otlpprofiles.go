@@ -0,0 +1,252 @@
+// Package otlpprofiles manipulates OTLP ExportProfilesServiceRequest messages
+// without depending on the generated protobuf types.
+// See https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/collector/profiles/v1development/profiles_service.proto
+package otlpprofiles
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/pushv1"
+)
+
+// Content types supported by OTLP/HTTP
+const (
+	ContentTypeProto = "application/x-protobuf"
+	ContentTypeJSON  = "application/json"
+)
+
+var ErrUnsupportedContentType = errors.New("unsupported content type")
+
+// Field numbers, as defined in profiles_service.proto, profiles.proto, resource.proto and common.proto
+const (
+	exportRequestResourceProfilesField protowire.Number = 1
+	resourceProfilesResourceField      protowire.Number = 1
+	resourceAttributesField            protowire.Number = 1
+	keyValueKeyField                   protowire.Number = 1
+	keyValueValueField                 protowire.Number = 2
+	anyValueStringValueField           protowire.Number = 1
+)
+
+// InjectAttributes adds labels as string attributes to the resource of every ResourceProfiles
+// Attributes already present in a resource are kept untouched, and empty values are ignored
+func InjectAttributes(contentType string, body []byte, labels map[string]string) ([]byte, error) {
+	switch pushv1.MediaType(contentType) {
+	case ContentTypeProto:
+		return injectAttributesProto(body, labels)
+	case ContentTypeJSON:
+		return injectAttributesJSON(body, labels)
+	default:
+		return nil, fmt.Errorf("%w: '%s'", ErrUnsupportedContentType, contentType)
+	}
+}
+
+func injectAttributesProto(body []byte, labels map[string]string) ([]byte, error) {
+	out := make([]byte, 0, len(body)+len(labels)*64)
+
+	for len(body) > 0 {
+		num, typ, n := protowire.ConsumeTag(body)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		fieldLen := protowire.ConsumeFieldValue(num, typ, body[n:])
+		if fieldLen < 0 {
+			return nil, protowire.ParseError(fieldLen)
+		}
+
+		if num != exportRequestResourceProfilesField || typ != protowire.BytesType {
+			out = append(out, body[:n+fieldLen]...)
+			body = body[n+fieldLen:]
+			continue
+		}
+
+		resourceProfiles, _ := protowire.ConsumeBytes(body[n:])
+		resourceProfiles, err := injectAttributesResourceProfiles(resourceProfiles, labels)
+		if err != nil {
+			return nil, err
+		}
+		out = protowire.AppendTag(out, exportRequestResourceProfilesField, protowire.BytesType)
+		out = protowire.AppendBytes(out, resourceProfiles)
+		body = body[n+fieldLen:]
+	}
+
+	return out, nil
+}
+
+// injectAttributesResourceProfiles appends the missing attributes to the resource of a ResourceProfiles message
+// The resource is created if there is none
+func injectAttributesResourceProfiles(resourceProfiles []byte, labels map[string]string) ([]byte, error) {
+	// a message field may be split over several occurrences, which are merged
+	existing := make(map[string]bool)
+	err := forEachField(resourceProfiles, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if num != resourceProfilesResourceField || typ != protowire.BytesType {
+			return nil
+		}
+		return forEachField(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+			if num != resourceAttributesField || typ != protowire.BytesType {
+				return nil
+			}
+			key, err := keyValueKey(value)
+			existing[key] = true
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var attributes []byte
+	for _, name := range sortedKeys(labels) {
+		value := labels[name]
+		if existing[name] || value == "" {
+			continue
+		}
+
+		var anyValue []byte
+		anyValue = protowire.AppendTag(anyValue, anyValueStringValueField, protowire.BytesType)
+		anyValue = protowire.AppendString(anyValue, value)
+
+		var keyValue []byte
+		keyValue = protowire.AppendTag(keyValue, keyValueKeyField, protowire.BytesType)
+		keyValue = protowire.AppendString(keyValue, name)
+		keyValue = protowire.AppendTag(keyValue, keyValueValueField, protowire.BytesType)
+		keyValue = protowire.AppendBytes(keyValue, anyValue)
+
+		attributes = protowire.AppendTag(attributes, resourceAttributesField, protowire.BytesType)
+		attributes = protowire.AppendBytes(attributes, keyValue)
+	}
+	if len(attributes) == 0 {
+		return resourceProfiles, nil
+	}
+
+	// an extra occurrence of the resource is merged with the existing one by decoders
+	out := append([]byte{}, resourceProfiles...)
+	out = protowire.AppendTag(out, resourceProfilesResourceField, protowire.BytesType)
+	out = protowire.AppendBytes(out, attributes)
+	return out, nil
+}
+
+func keyValueKey(keyValue []byte) (string, error) {
+	var key string
+	err := forEachField(keyValue, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if num == keyValueKeyField && typ == protowire.BytesType {
+			key = string(value)
+		}
+		return nil
+	})
+	return key, err
+}
+
+// forEachField calls fn with every field of a message, value being the content of length delimited fields
+func forEachField(msg []byte, fn func(num protowire.Number, typ protowire.Type, value []byte) error) error {
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		fieldLen := protowire.ConsumeFieldValue(num, typ, msg[n:])
+		if fieldLen < 0 {
+			return protowire.ParseError(fieldLen)
+		}
+
+		var value []byte
+		if typ == protowire.BytesType {
+			value, _ = protowire.ConsumeBytes(msg[n:])
+		}
+		if err := fn(num, typ, value); err != nil {
+			return err
+		}
+		msg = msg[n+fieldLen:]
+	}
+	return nil
+}
+
+type keyValueJSON struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+// injectAttributesJSON does the same as injectAttributesProto, for the JSON mapping of ExportProfilesServiceRequest
+// Unknown fields are kept as is
+func injectAttributesJSON(body []byte, labels map[string]string) ([]byte, error) {
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+
+	rawResourceProfiles, ok := req["resourceProfiles"]
+	if !ok {
+		return body, nil
+	}
+	var resourceProfiles []map[string]json.RawMessage
+	if err := json.Unmarshal(rawResourceProfiles, &resourceProfiles); err != nil {
+		return nil, err
+	}
+
+	for _, rp := range resourceProfiles {
+		resource := map[string]json.RawMessage{}
+		if raw, ok := rp["resource"]; ok {
+			if err := json.Unmarshal(raw, &resource); err != nil {
+				return nil, err
+			}
+		}
+		var attributes []json.RawMessage
+		if raw, ok := resource["attributes"]; ok {
+			if err := json.Unmarshal(raw, &attributes); err != nil {
+				return nil, err
+			}
+		}
+
+		existing := make(map[string]bool, len(attributes))
+		for _, raw := range attributes {
+			var kv keyValueJSON
+			if err := json.Unmarshal(raw, &kv); err != nil {
+				return nil, err
+			}
+			existing[kv.Key] = true
+		}
+		for _, name := range sortedKeys(labels) {
+			if existing[name] || labels[name] == "" {
+				continue
+			}
+			kv := keyValueJSON{Key: name}
+			kv.Value.StringValue = labels[name]
+			raw, err := json.Marshal(kv)
+			if err != nil {
+				return nil, err
+			}
+			attributes = append(attributes, raw)
+		}
+
+		raw, err := json.Marshal(attributes)
+		if err != nil {
+			return nil, err
+		}
+		resource["attributes"] = raw
+		if rp["resource"], err = json.Marshal(resource); err != nil {
+			return nil, err
+		}
+	}
+
+	raw, err := json.Marshal(resourceProfiles)
+	if err != nil {
+		return nil, err
+	}
+	req["resourceProfiles"] = raw
+	return json.Marshal(req)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
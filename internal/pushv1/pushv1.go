@@ -0,0 +1,229 @@
+// Package pushv1 manipulates requests to the push.v1.PusherService/Push connect endpoint
+// without depending on the generated protobuf types.
+// See https://github.com/grafana/pyroscope/blob/main/api/push/v1/push.proto
+package pushv1
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Path is the path of the Push procedure
+const Path = "/push.v1.PusherService/Push"
+
+// Content types supported by the connect protocol for unary requests
+const (
+	ContentTypeProto = "application/proto"
+	ContentTypeJSON  = "application/json"
+)
+
+var ErrUnsupportedContentType = errors.New("unsupported content type")
+
+// Field numbers, as defined in push.proto and types.proto
+const (
+	pushRequestSeriesField      protowire.Number = 1
+	rawProfileSeriesLabelsField protowire.Number = 1
+	labelPairNameField          protowire.Number = 1
+	labelPairValueField         protowire.Number = 2
+)
+
+// InjectLabels adds labels to every series of a PushRequest
+// Labels already present in a series are kept untouched, and empty values are ignored
+func InjectLabels(contentType string, body []byte, labels map[string]string) ([]byte, error) {
+	switch MediaType(contentType) {
+	case ContentTypeProto:
+		return injectLabelsProto(body, labels)
+	case ContentTypeJSON:
+		return injectLabelsJSON(body, labels)
+	default:
+		return nil, fmt.Errorf("%w: '%s'", ErrUnsupportedContentType, contentType)
+	}
+}
+
+// EmptyResponse returns an empty PushResponse in the given content type
+func EmptyResponse(contentType string) []byte {
+	if MediaType(contentType) == ContentTypeJSON {
+		return []byte("{}")
+	}
+	return nil
+}
+
+// MediaType returns the content type without parameters, eg 'application/json; charset=utf-8' -> 'application/json'
+func MediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	return mediaType
+}
+
+func injectLabelsProto(body []byte, labels map[string]string) ([]byte, error) {
+	out := make([]byte, 0, len(body)+len(labels)*64)
+
+	for len(body) > 0 {
+		num, typ, n := protowire.ConsumeTag(body)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		fieldLen := protowire.ConsumeFieldValue(num, typ, body[n:])
+		if fieldLen < 0 {
+			return nil, protowire.ParseError(fieldLen)
+		}
+
+		if num != pushRequestSeriesField || typ != protowire.BytesType {
+			out = append(out, body[:n+fieldLen]...)
+			body = body[n+fieldLen:]
+			continue
+		}
+
+		series, m := protowire.ConsumeBytes(body[n:])
+		if m < 0 {
+			return nil, protowire.ParseError(m)
+		}
+		series, err := injectLabelsSeries(series, labels)
+		if err != nil {
+			return nil, err
+		}
+		out = protowire.AppendTag(out, pushRequestSeriesField, protowire.BytesType)
+		out = protowire.AppendBytes(out, series)
+		body = body[n+fieldLen:]
+	}
+
+	return out, nil
+}
+
+// injectLabelsSeries appends the missing labels to a RawProfileSeries message
+func injectLabelsSeries(series []byte, labels map[string]string) ([]byte, error) {
+	existing := make(map[string]bool)
+
+	b := series
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		fieldLen := protowire.ConsumeFieldValue(num, typ, b[n:])
+		if fieldLen < 0 {
+			return nil, protowire.ParseError(fieldLen)
+		}
+
+		if num == rawProfileSeriesLabelsField && typ == protowire.BytesType {
+			pair, _ := protowire.ConsumeBytes(b[n:])
+			name, err := labelPairName(pair)
+			if err != nil {
+				return nil, err
+			}
+			existing[name] = true
+		}
+		b = b[n+fieldLen:]
+	}
+
+	out := append([]byte{}, series...)
+	for _, name := range sortedKeys(labels) {
+		value := labels[name]
+		if existing[name] || value == "" {
+			continue
+		}
+
+		var pair []byte
+		pair = protowire.AppendTag(pair, labelPairNameField, protowire.BytesType)
+		pair = protowire.AppendString(pair, name)
+		pair = protowire.AppendTag(pair, labelPairValueField, protowire.BytesType)
+		pair = protowire.AppendString(pair, value)
+
+		out = protowire.AppendTag(out, rawProfileSeriesLabelsField, protowire.BytesType)
+		out = protowire.AppendBytes(out, pair)
+	}
+	return out, nil
+}
+
+func labelPairName(pair []byte) (string, error) {
+	for len(pair) > 0 {
+		num, typ, n := protowire.ConsumeTag(pair)
+		if n < 0 {
+			return "", protowire.ParseError(n)
+		}
+		if num == labelPairNameField && typ == protowire.BytesType {
+			name, m := protowire.ConsumeString(pair[n:])
+			if m < 0 {
+				return "", protowire.ParseError(m)
+			}
+			return name, nil
+		}
+		fieldLen := protowire.ConsumeFieldValue(num, typ, pair[n:])
+		if fieldLen < 0 {
+			return "", protowire.ParseError(fieldLen)
+		}
+		pair = pair[n+fieldLen:]
+	}
+	return "", nil
+}
+
+type labelPairJSON struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// injectLabelsJSON does the same as injectLabelsProto, for the JSON mapping of PushRequest
+// Unknown fields are kept as is
+func injectLabelsJSON(body []byte, labels map[string]string) ([]byte, error) {
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+
+	rawSeries, ok := req["series"]
+	if !ok {
+		return body, nil
+	}
+	var series []map[string]json.RawMessage
+	if err := json.Unmarshal(rawSeries, &series); err != nil {
+		return nil, err
+	}
+
+	for _, s := range series {
+		var pairs []labelPairJSON
+		if raw, ok := s["labels"]; ok {
+			if err := json.Unmarshal(raw, &pairs); err != nil {
+				return nil, err
+			}
+		}
+
+		existing := make(map[string]bool, len(pairs))
+		for _, p := range pairs {
+			existing[p.Name] = true
+		}
+		for _, name := range sortedKeys(labels) {
+			if !existing[name] && labels[name] != "" {
+				pairs = append(pairs, labelPairJSON{Name: name, Value: labels[name]})
+			}
+		}
+
+		raw, err := json.Marshal(pairs)
+		if err != nil {
+			return nil, err
+		}
+		s["labels"] = raw
+	}
+
+	raw, err := json.Marshal(series)
+	if err != nil {
+		return nil, err
+	}
+	req["series"] = raw
+	return json.Marshal(req)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
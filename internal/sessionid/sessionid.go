@@ -6,29 +6,12 @@ import (
 	"encoding/hex"
 	"hash/fnv"
 	"math/rand"
-	"net/http"
 	"os"
 	"sync"
-
-	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/flameql"
 )
 
 const LabelName = "__session_id__"
 
-func InjectToRequest(sessionID string, r *http.Request) {
-	parsed, err := flameql.ParseKey(r.URL.Query().Get("name"))
-	if err != nil {
-		// This is an invalid request, but we defer to the backend.
-		return
-	}
-	if _, ok := parsed.Labels()[LabelName]; !ok {
-		parsed.Add(LabelName, sessionID)
-		q := r.URL.Query()
-		q.Set("name", parsed.Normalized())
-		r.URL.RawQuery = q.Encode()
-	}
-}
-
 type ID uint64
 
 func (s ID) String() string {
@@ -5,63 +5,203 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/sirupsen/logrus"
 
 	"github.com/pyroscope-io/pyroscope-lambda-extension/extension"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/config"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/metadata"
 	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/sessionid"
 	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/secrets"
 	"github.com/pyroscope-io/pyroscope-lambda-extension/selfprofiler"
 )
 
+// defaultConfigFile is where the config file is looked up when PYROSCOPE_CONFIG_FILE is not set
+// /opt is where layers are extracted to
+const defaultConfigFile = "/opt/pyroscope/config.yaml"
+
 var (
 	extensionName   = filepath.Base(os.Args[0]) // extension name has to match the filename
 	extensionClient = extension.NewClient(os.Getenv("AWS_LAMBDA_RUNTIME_API"))
 
+	// optional config file with the same settings as the env vars, which take precedence over it
+	configFile, configFileErr = loadConfigFile()
+	settings                  = config.NewSettings(configFile, os.LookupEnv)
+	// invalid settings, reported once the extension has registered
+	configErrors []error
+	// fail to initialize on invalid settings, rather than warning and continuing with the defaults
+	strictConfig = settings.Bool("PYROSCOPE_STRICT_CONFIG")
+
 	// in dev mode there's no extension registration. useful for testing locally
-	devMode = getEnvBool("PYROSCOPE_DEV_MODE")
+	devMode = settings.Bool("PYROSCOPE_DEV_MODE")
 
 	// 'trace' | 'debug' | 'info' | 'error'
-	logLevel = getEnvStrOr("PYROSCOPE_LOG_LEVEL", "info")
+	logLevel = settings.StrOr("PYROSCOPE_LOG_LEVEL", "info")
 
 	// log format options 'json' | 'text'
-	logFormat = getEnvStrOr("PYROSCOPE_LOG_FORMAT", "text")
+	logFormat = settings.StrOr("PYROSCOPE_LOG_FORMAT", "text")
 
 	// log timestamp format (default: time.RFC3339), see https://golang.org/pkg/time/#pkg-constants
-	logTsFormat = getEnvStrOr("PYROSCOPE_LOG_TIMESTAMP_FORMAT", time.RFC3339)
+	logTsFormat = settings.StrOr("PYROSCOPE_LOG_TIMESTAMP_FORMAT", time.RFC3339)
 
-	logDisableTs = getEnvBool("PYROSCOPE_LOG_TIMESTAMP_DISABLE")
+	logDisableTs = settings.Bool("PYROSCOPE_LOG_TIMESTAMP_DISABLE")
 
 	// log field names
-	logTsFieldName    = getEnvStrOr("PYROSCOPE_LOG_TIMESTAMP_FIELD_NAME", logrus.FieldKeyTime)
-	logLevelFieldName = getEnvStrOr("PYROSCOPE_LOG_LEVEL_FIELD_NAME", logrus.FieldKeyLevel)
-	logMsgFieldName   = getEnvStrOr("PYROSCOPE_LOG_MSG_FIELD_NAME", logrus.FieldKeyMsg)
-	logErrorFieldName = getEnvStrOr("PYROSCOPE_LOG_LOGRUS_ERROR_FIELD_NAME", logrus.FieldKeyLogrusError)
-	logFuncFieldName  = getEnvStrOr("PYROSCOPE_LOG_FUNC_FIELD_NAME", logrus.FieldKeyFunc)
-	logFileFieldName  = getEnvStrOr("PYROSCOPE_LOG_FILE_FIELD_NAME", logrus.FieldKeyFile)
+	logTsFieldName    = settings.StrOr("PYROSCOPE_LOG_TIMESTAMP_FIELD_NAME", logrus.FieldKeyTime)
+	logLevelFieldName = settings.StrOr("PYROSCOPE_LOG_LEVEL_FIELD_NAME", logrus.FieldKeyLevel)
+	logMsgFieldName   = settings.StrOr("PYROSCOPE_LOG_MSG_FIELD_NAME", logrus.FieldKeyMsg)
+	logErrorFieldName = settings.StrOr("PYROSCOPE_LOG_LOGRUS_ERROR_FIELD_NAME", logrus.FieldKeyLogrusError)
+	logFuncFieldName  = settings.StrOr("PYROSCOPE_LOG_FUNC_FIELD_NAME", logrus.FieldKeyFunc)
+	logFileFieldName  = settings.StrOr("PYROSCOPE_LOG_FILE_FIELD_NAME", logrus.FieldKeyFile)
 
 	// to where relay data to
-	remoteAddress = getEnvStrOr("PYROSCOPE_REMOTE_ADDRESS", "https://profiles-prod-001.grafana.net")
-
-	authToken         = getEnvStrOr("PYROSCOPE_AUTH_TOKEN", "")
-	basicAuthUser     = getEnvStrOr("PYROSCOPE_BASIC_AUTH_USER", "")
-	basicAuthPassword = getEnvStrOr("PYROSCOPE_BASIC_AUTH_PASSWORD", "")
-	tenantID          = getEnvStrOr("PYROSCOPE_TENANT_ID", "")
-	timeout           = getEnvDurationOr("PYROSCOPE_TIMEOUT", time.Second*10)
-	numWorkers        = getEnvIntOr("PYROSCOPE_NUM_WORKERS", 5)
+	remoteAddress = settings.StrOr("PYROSCOPE_REMOTE_ADDRESS", "https://profiles-prod-001.grafana.net")
+
+	authToken         = settings.StrOr("PYROSCOPE_AUTH_TOKEN", "")
+	basicAuthUser     = settings.StrOr("PYROSCOPE_BASIC_AUTH_USER", "")
+	basicAuthPassword = settings.StrOr("PYROSCOPE_BASIC_AUTH_PASSWORD", "")
+	tenantID          = settings.StrOr("PYROSCOPE_TENANT_ID", "")
+	timeout           = settings.DurationOr("PYROSCOPE_TIMEOUT", time.Second*10)
+	numWorkers        = settings.IntOr("PYROSCOPE_NUM_WORKERS", 5)
+	// encoding of the bodies sent to the remote: 'gzip', 'zstd', 'identity' or empty to send them as received
+	compression = settings.StrOr("PYROSCOPE_COMPRESSION", "")
+
+	// other remotes every profile is also relayed to, eg while migrating between backends
+	// a JSON object of destinations by name, see destinationSettings
+	destinationsJSON = settings.StrOr("PYROSCOPE_DESTINATIONS", "")
+	// name of the remote above in metrics and logs, once there are other destinations
+	destinationName = settings.StrOr("PYROSCOPE_DESTINATION_NAME", "default")
+	// how long flushing waits for each destination, so that a slow one doesn't hold back the invocation
+	destinationFlushTimeout = settings.DurationOr("PYROSCOPE_DESTINATION_FLUSH_TIMEOUT", time.Second*10)
+
+	// relay profiles to destinations and tenants depending on their labels
+	// a JSON array of routes, see routeSettings
+	routesJSON = settings.StrOr("PYROSCOPE_ROUTES", "")
+	// rewrite the labels of the profiles, or drop them, a JSON array of rules, see relabelRuleSettings
+	relabelRulesJSON = settings.StrOr("PYROSCOPE_RELABEL_RULES", "")
+
+	// share of the execution environments whose profiles are relayed, decided once per environment
+	samplingRate = settings.FloatOr("PYROSCOPE_SAMPLING_RATE", 1)
+	// caps on the relayed profiles, 0 means no limit
+	rateLimitBytesPerSecond    = settings.IntOr("PYROSCOPE_RATE_LIMIT_BYTES_PER_SECOND", 0)
+	rateLimitProfilesPerMinute = settings.IntOr("PYROSCOPE_RATE_LIMIT_PROFILES_PER_MINUTE", 0)
+	// per app sampling rates and limits, a JSON array of overrides, see samplingOverrideSettings
+	samplingOverridesJSON = settings.StrOr("PYROSCOPE_SAMPLING_OVERRIDES", "")
+
+	// destination and tenant of the profiles matching none of the routes, by default all destinations with their own tenant
+	defaultRouteDestination = settings.StrOr("PYROSCOPE_DEFAULT_ROUTE_DESTINATION", "")
+	defaultRouteTenantID    = settings.StrOr("PYROSCOPE_DEFAULT_ROUTE_TENANT_ID", "")
+
+	// obtain tokens with the OAuth2 client credentials grant, instead of using an auth token or basic auth
+	oauth2TokenURL     = settings.StrOr("PYROSCOPE_OAUTH2_TOKEN_URL", "")
+	oauth2ClientID     = settings.StrOr("PYROSCOPE_OAUTH2_CLIENT_ID", "")
+	oauth2ClientSecret = settings.StrOr("PYROSCOPE_OAUTH2_CLIENT_SECRET", "")
+	oauth2Scopes       = settings.StrOr("PYROSCOPE_OAUTH2_SCOPES", "")
+	oauth2Audience     = settings.StrOr("PYROSCOPE_OAUTH2_AUDIENCE", "")
+	oauth2AuthInBody   = settings.Bool("PYROSCOPE_OAUTH2_AUTH_IN_BODY")
+
+	// TLS connections to the remote. Certificates and keys are PEM encoded, either in a file (eg in a layer) or inline
+	tlsCAFile     = settings.StrOr("PYROSCOPE_TLS_CA_FILE", "")
+	tlsCA         = settings.StrOr("PYROSCOPE_TLS_CA", "")
+	tlsCertFile   = settings.StrOr("PYROSCOPE_TLS_CERT_FILE", "")
+	tlsKeyFile    = settings.StrOr("PYROSCOPE_TLS_KEY_FILE", "")
+	tlsCert       = settings.StrOr("PYROSCOPE_TLS_CERT", "")
+	tlsKey        = settings.StrOr("PYROSCOPE_TLS_KEY", "")
+	tlsServerName = settings.StrOr("PYROSCOPE_TLS_SERVER_NAME", "")
+	tlsMinVersion = settings.StrOr("PYROSCOPE_TLS_MIN_VERSION", "")
+
+	// connections to the remote. By default the HTTPS_PROXY, HTTP_PROXY and NO_PROXY env vars are used
+	proxyURL            = settings.StrOr("PYROSCOPE_PROXY_URL", "")
+	noProxy             = settings.StrOr("PYROSCOPE_NO_PROXY", "")
+	dialTimeout         = settings.DurationOr("PYROSCOPE_DIAL_TIMEOUT", time.Second*30)
+	keepAlive           = settings.DurationOr("PYROSCOPE_KEEP_ALIVE", time.Second*30)
+	tlsHandshakeTimeout = settings.DurationOr("PYROSCOPE_TLS_HANDSHAKE_TIMEOUT", time.Second*10)
+	idleConnTimeout     = settings.DurationOr("PYROSCOPE_IDLE_CONN_TIMEOUT", time.Second*90)
+	http2Disabled       = settings.Bool("PYROSCOPE_HTTP2_DISABLED")
+	// connections opened during INIT, so that the first invoke doesn't pay for setting them up
+	prewarmConnections = settings.IntOr("PYROSCOPE_PREWARM_CONNECTIONS", 0)
+
+	// how often secrets referenced by the credentials (eg 'ssm:/pyroscope/token') are fetched again, to pick up rotations
+	secretsRefreshInterval = settings.DurationOr("PYROSCOPE_SECRETS_REFRESH_INTERVAL", time.Minute*5)
+
+	// relay queue limits and what to do once they are reached
+	queueSize           = settings.IntOr("PYROSCOPE_QUEUE_SIZE", 20)
+	queueMaxBytes       = settings.IntOr("PYROSCOPE_QUEUE_MAX_BYTES", 0)
+	queueOverflowPolicy = settings.StrOr("PYROSCOPE_QUEUE_OVERFLOW_POLICY", "")
+	queueBlockTimeout   = settings.DurationOr("PYROSCOPE_QUEUE_BLOCK_TIMEOUT", time.Second)
+
+	// how pending profiles are relayed on shutdown, before the deadline of the SHUTDOWN event minus the safety margin
+	shutdownSafetyMargin = settings.DurationOr("PYROSCOPE_SHUTDOWN_SAFETY_MARGIN", time.Millisecond*200)
+	// how long clients that take part in the drain handshake have to flush their last profiles on shutdown
+	shutdownGracePeriod = settings.DurationOr("PYROSCOPE_SHUTDOWN_GRACE_PERIOD", time.Second)
+	// used instead of the deadline when shutting down for other reasons, eg failing to register
+	shutdownTimeout    = settings.DurationOr("PYROSCOPE_SHUTDOWN_TIMEOUT", time.Second*2)
+	shutdownDrainOrder = settings.StrOr("PYROSCOPE_SHUTDOWN_DRAIN_ORDER", "")
+	shutdownSpill      = settings.Bool("PYROSCOPE_SHUTDOWN_SPILL")
+
+	// retry policy for requests that failed with a transient error
+	retryMaxAttempts       = settings.IntOr("PYROSCOPE_RETRY_MAX_ATTEMPTS", 3)
+	retryBaseBackoff       = settings.DurationOr("PYROSCOPE_RETRY_BASE_BACKOFF", time.Millisecond*100)
+	retryMaxBackoff        = settings.DurationOr("PYROSCOPE_RETRY_MAX_BACKOFF", time.Second*2)
+	retryJitter            = settings.FloatOr("PYROSCOPE_RETRY_JITTER", 0.2)
+	retryStatusCodes       = settings.IntListOr("PYROSCOPE_RETRY_STATUS_CODES", relay.DefaultRetryableStatusCodes)
+	retryRespectRetryAfter = settings.BoolOr("PYROSCOPE_RETRY_RESPECT_RETRY_AFTER", true)
+
+	// addresses to receive OTLP profiles on, eg '0.0.0.0:4318' and '0.0.0.0:4317', empty means disabled
+	otlpHTTPAddress = settings.StrOr("PYROSCOPE_OTLP_HTTP_ADDRESS", "")
+	otlpGRPCAddress = settings.StrOr("PYROSCOPE_OTLP_GRPC_ADDRESS", "")
 
 	// profile the extension?
-	selfProfiling = getEnvBool("PYROSCOPE_SELF_PROFILING")
+	selfProfiling = settings.Bool("PYROSCOPE_SELF_PROFILING")
+
+	flushOnInvoke = settings.Bool("PYROSCOPE_FLUSH_ON_INVOKE")
+
+	// how often to log the relay stats, 0 means only on shutdown
+	statsLogInterval = settings.DurationOr("PYROSCOPE_STATS_LOG_INTERVAL", 0)
+
+	// emit the relay stats as CloudWatch Embedded Metric Format logs
+	emfEnabled   = settings.Bool("PYROSCOPE_EMF_ENABLED")
+	emfInterval  = settings.DurationOr("PYROSCOPE_EMF_INTERVAL", 0)
+	emfNamespace = settings.StrOr("PYROSCOPE_EMF_NAMESPACE", "PyroscopeLambdaExtension")
+
+	// subscribe to the Telemetry API, to know when the function is done with an invocation
+	telemetryEnabled         = settings.Bool("PYROSCOPE_TELEMETRY_ENABLED")
+	telemetryListenerAddress = settings.StrOr("PYROSCOPE_TELEMETRY_LISTENER_ADDRESS", "sandbox.localdomain:4243")
+	flushOnRuntimeDone       = settings.Bool("PYROSCOPE_FLUSH_ON_RUNTIME_DONE")
+
+	httpHeaders = settings.StrOr("PYROSCOPE_HTTP_HEADERS", "")
+
+	// labels describing the lambda function, added to every profile
+	lambdaLabelsDisabled = settings.Bool("PYROSCOPE_LAMBDA_LABELS_DISABLED")
+	lambdaLabelsPrefix   = settings.StrOr("PYROSCOPE_LAMBDA_LABELS_PREFIX", "")
+	lambdaLabelsExclude  = settings.StrOr("PYROSCOPE_LAMBDA_LABELS_EXCLUDE", "")
+
+	// label profiles with the invocation (request id, cold start, trace id) they were collected in
+	invocationLabels = settings.Bool("PYROSCOPE_INVOCATION_LABELS")
 
-	flushOnInvoke = getEnvBool("PYROSCOPE_FLUSH_ON_INVOKE")
+	// persist profiles that can't be delivered to disk, so that they are retried in a later invocation
+	spillEnabled  = settings.Bool("PYROSCOPE_SPILL_ENABLED")
+	spillDir      = settings.StrOr("PYROSCOPE_SPILL_DIR", "/tmp/pyroscope-spill")
+	spillMaxBytes = settings.IntOr("PYROSCOPE_SPILL_MAX_BYTES", 50*1024*1024)
+	spillMaxAge   = settings.DurationOr("PYROSCOPE_SPILL_MAX_AGE", time.Hour)
 
-	httpHeaders = getEnvStrOr("PYROSCOPE_HTTP_HEADERS", "")
+	// merge uploads of the same profile before relaying them, to save round trips
+	batchEnabled  = settings.Bool("PYROSCOPE_BATCH_ENABLED")
+	batchMaxBytes = settings.IntOr("PYROSCOPE_BATCH_MAX_BYTES", 1024*1024)
+	batchMaxDelay = settings.DurationOr("PYROSCOPE_BATCH_MAX_DELAY", time.Second*15)
 )
 
 func main() {
@@ -69,7 +209,82 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	// Init components
-	remoteClient := relay.NewRemoteClient(logger, &relay.RemoteClientCfg{
+	var lambdaLabels map[string]string
+	if !lambdaLabelsDisabled {
+		var err error
+		lambdaLabels, err = metadata.FromEnv(lambdaLabelsConfig(), os.Getenv)
+		if err != nil {
+			logger.Error("Failed to build lambda labels, continuing without them: ", err)
+		}
+	}
+	remoteCompression, err := relay.ParseCompression(compression)
+	if err != nil {
+		configErrors = append(configErrors, err)
+	}
+	destinations, err := config.ParseDestinations(destinationsJSON, destinationName)
+	if err != nil {
+		configErrors = append(configErrors, err)
+	}
+	// credentials can reference secrets, eg 'ssm:/pyroscope/token'
+	var secretsResolver *secrets.Resolver
+	if secrets.IsReference(authToken, basicAuthUser, basicAuthPassword, oauth2ClientSecret, tlsCA, tlsCert, tlsKey) || destinations.ReferenceSecrets() {
+		secretsResolver, err = newSecretsResolver(ctx, logger)
+		if err != nil {
+			configErrors = append(configErrors, relay.NewConfigError(relay.ConfigErrorUnresolvedSecret, "%v", err))
+		}
+	}
+	tlsCfg, err := config.NewTLSCfg(ctx, relay.TLSCfg{
+		CAFile:     tlsCAFile,
+		CA:         tlsCA,
+		CertFile:   tlsCertFile,
+		KeyFile:    tlsKeyFile,
+		Cert:       tlsCert,
+		Key:        tlsKey,
+		ServerName: tlsServerName,
+		MinVersion: tlsMinVersion,
+	}, secretsResolver)
+	if err != nil {
+		configErrors = append(configErrors, relay.NewConfigError(relay.ConfigErrorUnresolvedSecret, "%v", err))
+	}
+	oauth2Cfg, err := config.NewOAuth2Cfg(ctx, config.OAuth2Settings{
+		TokenURL:     oauth2TokenURL,
+		ClientID:     oauth2ClientID,
+		ClientSecret: oauth2ClientSecret,
+		Scopes:       oauth2Scopes,
+		Audience:     oauth2Audience,
+		AuthInBody:   oauth2AuthInBody,
+		Timeout:      timeout,
+	}, secretsResolver)
+	if err != nil {
+		configErrors = append(configErrors, relay.NewConfigError(relay.ConfigErrorUnresolvedSecret, "%v", err))
+	}
+	var credentials relay.CredentialsProvider
+	if oauth2Cfg == nil {
+		// otherwise tokens are fetched by the remote client, when needed
+		credentials = config.NewCredentials(logger, secretsResolver, relay.Credentials{
+			Token:             authToken,
+			BasicAuthUser:     basicAuthUser,
+			BasicAuthPassword: basicAuthPassword,
+		}, secretsRefreshInterval)
+	}
+	if credentials != nil {
+		// resolved at init, so that unresolved secrets are reported
+		if _, err := credentials.Credentials(ctx); err != nil {
+			configErrors = append(configErrors, relay.NewConfigError(relay.ConfigErrorUnresolvedSecret, "%v", err))
+		}
+	}
+	transportCfg := &relay.TransportCfg{
+		ProxyURL:            proxyURL,
+		NoProxy:             noProxy,
+		DialTimeout:         dialTimeout,
+		KeepAlive:           keepAlive,
+		TLSHandshakeTimeout: tlsHandshakeTimeout,
+		IdleConnTimeout:     idleConnTimeout,
+		DisableHTTP2:        http2Disabled,
+		PrewarmConnections:  prewarmConnections,
+	}
+	sessionID := sessionid.New().String()
+	remoteClientCfg := &relay.RemoteClientCfg{
 		Address:             remoteAddress,
 		AuthToken:           authToken,
 		BasicAuthUser:       basicAuthUser,
@@ -78,15 +293,160 @@ func main() {
 		HTTPHeadersJSON:     httpHeaders,
 		Timeout:             timeout,
 		MaxIdleConnsPerHost: numWorkers,
-		SessionID:           sessionid.New().String(),
-	})
+		SessionID:           sessionID,
+		Labels:              lambdaLabels,
+		Compression:         remoteCompression,
+		TLS:                 tlsCfg,
+		Transport:           transportCfg,
+		OAuth2:              oauth2Cfg,
+		Credentials:         credentials,
+	}
+	metrics := relay.NewMetrics()
+	retryCfg := &relay.RetryCfg{
+		MaxAttempts:          retryMaxAttempts,
+		BaseBackoff:          retryBaseBackoff,
+		MaxBackoff:           retryMaxBackoff,
+		Jitter:               retryJitter,
+		RetryableStatusCodes: retryStatusCodes,
+		RespectRetryAfter:    retryRespectRetryAfter,
+		Metrics:              metrics,
+	}
+	var spill *relay.SpillStore
+	if spillEnabled {
+		spill = newSpillStore(logger, spillDir)
+	}
+	overflowPolicy, err := relay.ParseOverflowPolicy(queueOverflowPolicy)
+	if err != nil {
+		configErrors = append(configErrors, err)
+	}
+	drainOrder, err := relay.ParseDrainOrder(shutdownDrainOrder)
+	if err != nil {
+		configErrors = append(configErrors, err)
+	}
 	// TODO(eh-am): a find a better default for num of workers
-	queue := relay.NewRemoteQueue(logger, &relay.RemoteQueueCfg{NumWorkers: numWorkers}, remoteClient)
-	ctrl := relay.NewController(logger, queue)
-	server := relay.NewServer(logger, &relay.ServerCfg{ServerAddress: "0.0.0.0:4040"}, ctrl.RelayRequest)
+	queueCfg := &relay.RemoteQueueCfg{
+		NumWorkers:     numWorkers,
+		QueueSize:      queueSize,
+		MaxQueueBytes:  int64(queueMaxBytes),
+		OverflowPolicy: overflowPolicy,
+		BlockTimeout:   queueBlockTimeout,
+		Spill:          spill,
+		DrainOrder:     drainOrder,
+		SpillOnStop:    shutdownSpill,
+		Metrics:        metrics,
+	}
+
+	otherDestinationCfgs, err := destinations.Cfgs(ctx, remoteClientCfg, func(refs relay.Credentials) relay.CredentialsProvider {
+		return config.NewCredentials(logger, secretsResolver, refs, secretsRefreshInterval)
+	})
+	if err != nil {
+		configErrors = append(configErrors, err)
+	}
+	destinationCfgs := append([]config.DestinationCfg{{Name: destinationName, Client: remoteClientCfg}}, otherDestinationCfgs...)
+
+	routerCfg, err := config.NewRouterCfg(routesJSON, relay.RouteCfg{Destination: defaultRouteDestination, TenantID: defaultRouteTenantID}, destinationCfgs)
+	if err != nil {
+		configErrors = append(configErrors, err)
+	}
+	relabelCfg, err := config.NewRelabelCfg(relabelRulesJSON, metrics)
+	if err != nil {
+		configErrors = append(configErrors, err)
+	}
+	samplerCfg, err := config.NewSamplerCfg(relay.SamplingCfg{
+		Rate:              samplingRate,
+		BytesPerSecond:    int64(rateLimitBytesPerSecond),
+		ProfilesPerMinute: int64(rateLimitProfilesPerMinute),
+	}, samplingOverridesJSON, sessionID, metrics)
+	if err != nil {
+		configErrors = append(configErrors, err)
+	}
+
+	// validate before defaults are applied
+	configErrors = append(configErrors, remoteClientCfg.Validate(), retryCfg.Validate(), queueCfg.Validate())
+	for _, d := range destinationCfgs[1:] {
+		if err := d.Client.Validate(); err != nil {
+			configErrors = append(configErrors, fmt.Errorf("destination '%s': %w", d.Name, err))
+		}
+	}
+	if err := configError(); err != nil {
+		// a config file that was explicitly set but can't be read is always an error
+		// as is a remote address, which has no default to continue with
+		fatal := strictConfig || configFileErr != nil || relay.HasConfigErrorCategory(err, relay.ConfigErrorInvalidRemoteAddress)
+		if !fatal {
+			logger.Warn("Invalid configuration, continuing with the defaults. Error: ", err)
+		} else {
+			exitWithInitError(ctx, logger, err)
+		}
+	}
 
-	selfProfiler := selfprofiler.New(logger, selfProfiling, remoteAddress, authToken)
-	orch := relay.NewOrchestrator(logger, queue, server, selfProfiler)
+	queues, remoteClients := newDestinations(logger, destinationCfgs, retryCfg, queueCfg, metrics)
+	var queue relay.Queue
+	switch {
+	case routerCfg != nil:
+		routerCfg.FanOut.FlushTimeout = destinationFlushTimeout
+		queue = relay.NewRouter(logger, routerCfg, queues)
+	case len(queues) == 1:
+		queue = queues[0].Queue
+	default:
+		queue = relay.NewFanOut(logger, &relay.FanOutCfg{FlushTimeout: destinationFlushTimeout}, queues)
+	}
+	var prewarmed chan struct{}
+	if prewarmConnections > 0 {
+		// in the background, while the extension registers
+		prewarmed = make(chan struct{})
+		go func() {
+			defer close(prewarmed)
+			prewarm(ctx, logger, remoteClients)
+		}()
+	}
+	var invocations *relay.InvocationTracker
+	if invocationLabels {
+		invocations = relay.NewInvocationTracker()
+	}
+	var relayer relay.Relayer = queue
+	var batcher *relay.Batcher
+	if batchEnabled {
+		batcher = relay.NewBatcher(logger, &relay.BatcherCfg{
+			MaxBytes: int64(batchMaxBytes),
+			MaxDelay: batchMaxDelay,
+		}, relayer)
+		relayer = batcher
+	}
+	if samplerCfg != nil {
+		// before batching, so that overrides match and limits count the profiles the function uploaded
+		relayer = relay.NewSampler(logger, samplerCfg, relayer)
+	}
+	if relabelCfg != nil {
+		// before batching, since batches are made of profiles with the same labels
+		relayer = relay.NewRelabeler(logger, relabelCfg, relayer)
+	}
+	ctrl := relay.NewController(logger, relayer, invocations)
+	server := relay.NewServer(logger, &relay.ServerCfg{ServerAddress: "0.0.0.0:4040"}, ctrl.RelayRequest)
+	server.Handle(relay.MetricsPath, metrics)
+	drainer := relay.NewDrainer(logger)
+	server.Handle(relay.DrainPath, drainer)
+
+	// the default destination is the one at remoteAddress
+	selfProfiler := selfprofiler.New(logger, selfProfiling, remoteAddress, remoteClients[0].CredentialsProvider())
+	var otlpServers []*relay.Server
+	if otlpHTTPAddress != "" {
+		otlpServers = append(otlpServers, relay.NewServer(logger, &relay.ServerCfg{ServerAddress: otlpHTTPAddress}, ctrl.RelayOTLPHTTP))
+	}
+	if otlpGRPCAddress != "" {
+		otlpServers = append(otlpServers, relay.NewServer(logger, &relay.ServerCfg{
+			ServerAddress:    otlpGRPCAddress,
+			UnencryptedHTTP2: true,
+		}, ctrl.RelayOTLPGRPC))
+	}
+	orch := relay.NewOrchestrator(logger, &relay.OrchestratorCfg{
+		Queue:        queue,
+		Server:       server,
+		ExtraServers: otlpServers,
+		SelfProfiler: selfProfiler,
+		Drainer:      drainer,
+		GracePeriod:  shutdownGracePeriod,
+		Batcher:      batcher,
+	})
 
 	// Register signals
 	sigs := make(chan os.Signal, 1)
@@ -106,13 +466,32 @@ func main() {
 		}
 	}()
 
+	c := &components{
+		orch:          orch,
+		queue:         queue,
+		remoteClients: remoteClients,
+		metrics:       metrics,
+		prewarmed:     prewarmed,
+		batcher:       batcher,
+		invocations:   invocations,
+	}
+	if statsLogInterval > 0 {
+		go logStats(ctx, logger, metrics)
+	}
+	if emfEnabled {
+		c.emf = initEMFEmitter(metrics)
+		if emfInterval > 0 {
+			go emitEMF(ctx, c.emf)
+		}
+	}
+
 	// Register extension
 	if devMode {
 		// In dev mode we don't do anything
-		runDevMode(ctx, logger, orch)
+		runDevMode(ctx, logger, c)
 	} else {
 		// Register extension and start listening for events
-		runProdMode(ctx, logger, orch, queue)
+		runProdMode(ctx, logger, c)
 	}
 }
 
@@ -160,44 +539,251 @@ func initLogger() *logrus.Entry {
 	return logger
 }
 
-func runDevMode(ctx context.Context, logger *logrus.Entry, orch *relay.Orchestrator) {
+func initEMFEmitter(metrics *relay.Metrics) *relay.EMFEmitter {
+	dimensions := map[string]string{}
+	if name := os.Getenv("AWS_LAMBDA_FUNCTION_NAME"); name != "" {
+		dimensions["FunctionName"] = name
+	}
+
+	return relay.NewEMFEmitter(&relay.EMFCfg{
+		Namespace:  emfNamespace,
+		Dimensions: dimensions,
+		Output:     os.Stdout,
+	}, metrics)
+}
+
+func runDevMode(ctx context.Context, logger *logrus.Entry, c *components) {
 	//lint:ignore S1000 we want to keep the same look and feel of runProdMode
 	select {
 	case <-ctx.Done():
-		err := orch.Shutdown()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err := c.orch.Shutdown(shutdownCtx)
 		if err != nil {
 			logger.Error(err)
 		}
+		c.reportStats(logger)
 		return
 	}
 }
 
-func runProdMode(ctx context.Context, logger *logrus.Entry, orch *relay.Orchestrator, queue *relay.RemoteQueue) {
+// components are the ones the lambda events are dispatched to
+type components struct {
+	orch          *relay.Orchestrator
+	queue         relay.Queue
+	remoteClients []*relay.RemoteClient
+	metrics       *relay.Metrics
+	// optional ones
+	emf         *relay.EMFEmitter
+	batcher     *relay.Batcher
+	invocations *relay.InvocationTracker
+	waiter      *extension.RuntimeDoneWaiter
+	// closed once the connections to the remote are prewarmed
+	prewarmed chan struct{}
+}
+
+// newSecretsResolver creates a resolver using the credentials of the function
+func newSecretsResolver(ctx context.Context, logger *logrus.Entry) (*secrets.Resolver, error) {
+	cfg, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		// without clients secrets fail to resolve, rather than being used as credentials
+		return secrets.NewResolver(logger, nil, nil), fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	return secrets.NewResolver(logger, ssm.NewFromConfig(cfg), secretsmanager.NewFromConfig(cfg)), nil
+}
+
+// newDestinations creates the pipeline relaying profiles to each destination: client, retries and queue
+// With multiple destinations, each has its own metrics and spill store
+func newDestinations(logger *logrus.Entry, destinations []config.DestinationCfg, retryCfg *relay.RetryCfg, queueCfg *relay.RemoteQueueCfg, metrics *relay.Metrics) ([]relay.Destination, []*relay.RemoteClient) {
+	var queues []relay.Destination
+	var remoteClients []*relay.RemoteClient
+	for i, d := range destinations {
+		// constructors set defaults in place
+		dRetryCfg, dQueueCfg := *retryCfg, *queueCfg
+		log := logger
+		if len(destinations) > 1 {
+			log = logger.WithField("destination", d.Name)
+			dRetryCfg.Metrics = metrics.Destination(d.Name)
+			dQueueCfg.Metrics = dRetryCfg.Metrics
+			if i > 0 && queueCfg.Spill != nil {
+				dQueueCfg.Spill = newSpillStore(logger, filepath.Join(spillDir, d.Name))
+			}
+		}
+
+		remoteClient := relay.NewRemoteClient(log, d.Client)
+		retryRelayer := relay.NewRetryRelayer(log, &dRetryCfg, remoteClient)
+		queues = append(queues, relay.Destination{Name: d.Name, Queue: relay.NewRemoteQueue(log, &dQueueCfg, retryRelayer)})
+		remoteClients = append(remoteClients, remoteClient)
+	}
+	return queues, remoteClients
+}
+
+func newSpillStore(logger *logrus.Entry, dir string) *relay.SpillStore {
+	spill, err := relay.NewSpillStore(logger, &relay.SpillCfg{
+		Dir:      dir,
+		MaxBytes: int64(spillMaxBytes),
+		MaxAge:   spillMaxAge,
+	})
+	if err != nil {
+		logger.Error("Failed to setup spill store, continuing without it: ", err)
+		return nil
+	}
+	return spill
+}
+
+// prewarm opens connections to the remotes
+func prewarm(ctx context.Context, logger *logrus.Entry, remoteClients []*relay.RemoteClient) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, remoteClient := range remoteClients {
+		wg.Add(1)
+		go func(remoteClient *relay.RemoteClient) {
+			defer wg.Done()
+			if err := remoteClient.Prewarm(ctx); err != nil {
+				logger.Warn("Failed to prewarm connections: ", err)
+			}
+		}(remoteClient)
+	}
+	wg.Wait()
+}
+
+// reportStats logs the relay stats, and emits them as EMF if enabled
+func (c *components) reportStats(log *logrus.Entry) {
+	log.WithFields(c.metrics.Summary()).Info("Relay stats")
+	if c.emf != nil {
+		c.emf.Emit()
+	}
+}
+
+// flush relays the pending batches, if any, and waits for the queue to be empty
+func (c *components) flush(ctx context.Context) {
+	if c.batcher != nil {
+		c.batcher.Flush()
+	}
+	c.queue.Flush(ctx)
+}
+
+func runProdMode(ctx context.Context, logger *logrus.Entry, c *components) {
 	res, err := extensionClient.Register(ctx, extensionName)
 	if err != nil {
-		panic(err)
+		// errors can't be reported to the platform before registering
+		logger.Error("Failed to register extension: ", err)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		if err := c.orch.Shutdown(shutdownCtx); err != nil {
+			logger.Error(err)
+		}
+		cancel()
+		os.Exit(1)
 	}
 	logger.Trace("Register response", res)
 
+	if !lambdaLabelsDisabled {
+		// env vars take precedence, since they are already set
+		lambdaLabels, err := metadata.FromRegisterResponse(lambdaLabelsConfig(), res)
+		if err != nil {
+			logger.Error("Failed to build lambda labels: ", err)
+		}
+		for _, remoteClient := range c.remoteClients {
+			remoteClient.AddLabels(lambdaLabels)
+		}
+	}
+
+	if telemetryEnabled {
+		if flushOnRuntimeDone {
+			c.waiter = extension.NewRuntimeDoneWaiter()
+		}
+		listener, err := subscribeTelemetry(ctx, logger, c)
+		if err != nil {
+			logger.Error("Failed to subscribe to the Telemetry API, continuing without it: ", err)
+			c.waiter = nil
+		} else {
+			defer listener.Stop(context.Background())
+		}
+	}
+
+	if c.prewarmed != nil {
+		// the environment is frozen once the next event is requested
+		<-c.prewarmed
+	}
+
 	// Will block until shutdown event is received or cancelled via the context.
-	processEvents(ctx, logger, orch, queue)
+	processEvents(ctx, logger, c)
 }
 
-func processEvents(ctx context.Context, log *logrus.Entry, orch *relay.Orchestrator, queue *relay.RemoteQueue) {
+func subscribeTelemetry(ctx context.Context, logger *logrus.Entry, c *components) (*extension.TelemetryListener, error) {
+	log := logger.WithField("comp", "telemetry")
+
+	listener := extension.NewTelemetryListener(telemetryListenerAddress, func(events []extension.TelemetryEvent) {
+		for _, e := range events {
+			if e.Type != extension.PlatformRuntimeDone && e.Type != extension.PlatformReport {
+				continue
+			}
+			record, err := e.PlatformRecord()
+			if err != nil {
+				log.Error("Failed to decode telemetry event: ", err)
+				continue
+			}
+
+			switch e.Type {
+			case extension.PlatformRuntimeDone:
+				log.WithField("requestId", record.RequestID).Debugf("Runtime done with status '%s'", record.Status)
+				if c.invocations != nil {
+					c.invocations.End(record.RequestID, e.Time)
+				}
+				if c.waiter != nil {
+					c.waiter.Done(record.RequestID)
+				}
+			case extension.PlatformReport:
+				log.WithFields(logrus.Fields{
+					"requestId":        record.RequestID,
+					"durationMs":       record.Metrics.DurationMs,
+					"billedDurationMs": record.Metrics.BilledDurationMs,
+					"initDurationMs":   record.Metrics.InitDurationMs,
+					"maxMemoryUsedMB":  record.Metrics.MaxMemoryUsedMB,
+				}).Debug("Invocation report")
+			}
+		}
+	})
+	if err := listener.Start(); err != nil {
+		return nil, err
+	}
+
+	if err := extensionClient.SubscribeTelemetry(ctx, listener.URI(), []string{"platform"}); err != nil {
+		_ = listener.Stop(ctx)
+		return nil, err
+	}
+
+	log.Debugf("Subscribed to the Telemetry API, listening on %s", listener.URI())
+	return listener, nil
+}
+
+func processEvents(ctx context.Context, log *logrus.Entry, c *components) {
 	log.Debug("Starting processing events")
 
-	shutdown := func() {
-		err := orch.Shutdown()
+	// shutdown relays the pending profiles until deadline, if set, or shutdownTimeout
+	shutdown := func(deadline time.Time) {
+		if deadline.IsZero() {
+			deadline = time.Now().Add(shutdownTimeout)
+		}
+		// ctx may already be cancelled, pending profiles are relayed regardless
+		shutdownCtx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+
+		err := c.orch.Shutdown(shutdownCtx)
 		if err != nil {
 			log.Error("Error while stopping server", err)
 		}
+		c.reportStats(log)
 		log.Debug("Exiting")
 	}
 
 	for {
 		select {
 		case <-ctx.Done():
-			shutdown()
+			shutdown(time.Time{})
 			return
 		default:
 			log.Debug("Waiting for event...")
@@ -205,74 +791,128 @@ func processEvents(ctx context.Context, log *logrus.Entry, orch *relay.Orchestra
 			if err != nil {
 				log.Error("Failed to register extension", err)
 
-				shutdown()
+				shutdown(time.Time{})
+				if ctx.Err() == nil {
+					if _, err := extensionClient.ExitError(ctx, "Extension.NextEventFailed", err); err != nil {
+						log.Error("Failed to report exit error: ", err)
+					}
+				}
 				return
 			}
 
 			log.Trace("Received event:", res)
 			// Exit if we receive a SHUTDOWN event
 			if res.EventType == extension.Shutdown {
-				log.Debug("Received SHUTDOWN event")
-				shutdown()
+				log.Debugf("Received SHUTDOWN event, reason: '%s'", res.ShutdownReason)
+				// leave time to report the stats and exit before the platform kills the extension
+				shutdown(time.UnixMilli(res.DeadlineMs).Add(-shutdownSafetyMargin))
 				return
 			}
-			if res.EventType == extension.Invoke && flushOnInvoke {
-				queue.Flush()
+			if res.EventType == extension.Invoke {
+				if c.invocations != nil {
+					c.invocations.Start(res.RequestID, res.InvokedFunctionArn, res.Tracing.Value, time.Now())
+				}
+				if flushOnInvoke {
+					c.flush(ctx)
+				}
+				if flushOnRuntimeDone && c.waiter != nil {
+					// The execution environment is not frozen until we ask for the next event
+					// so flushing here doesn't delay the function response
+					waitForRuntimeDone(ctx, log, c.waiter, res)
+					c.flush(ctx)
+				}
+				c.queue.DrainSpill()
 			}
 		}
 	}
 }
 
-func getEnvStrOr(key string, fallback string) string {
-	k, ok := os.LookupEnv(key)
+// logStats periodically logs the relay stats
+// Note the execution environment is frozen between invocations, so are the logs
+func logStats(ctx context.Context, logger *logrus.Entry, metrics *relay.Metrics) {
+	ticker := time.NewTicker(statsLogInterval)
+	defer ticker.Stop()
 
-	// has an explicit value
-	if ok && k != "" {
-		return k
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			logger.WithFields(metrics.Summary()).Info("Relay stats")
+		}
 	}
-
-	return fallback
 }
 
-func getEnvBool(key string) bool {
-	k := os.Getenv(key)
-	v, err := strconv.ParseBool(k)
-	if err != nil {
-		return false
-	}
+// emitEMF periodically emits the relay stats as EMF
+func emitEMF(ctx context.Context, emf *relay.EMFEmitter) {
+	ticker := time.NewTicker(emfInterval)
+	defer ticker.Stop()
 
-	return v
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			emf.Emit()
+		}
+	}
 }
 
-func getEnvDurationOr(key string, fallback time.Duration) time.Duration {
-	k, ok := os.LookupEnv(key)
+func waitForRuntimeDone(ctx context.Context, log *logrus.Entry, waiter *extension.RuntimeDoneWaiter, res *extension.NextEventResponse) {
+	ctx, cancel := context.WithDeadline(ctx, time.UnixMilli(res.DeadlineMs))
+	defer cancel()
 
-	// has an explicit value
-	if ok && k != "" {
-		dur, err := time.ParseDuration(k)
-		if err != nil {
-			logrus.Warnf("invalid value for env var '%s': '%s' defaulting to '%s'", key, k, fallback)
-			return fallback
-		}
+	if err := waiter.Wait(ctx, res.RequestID); err != nil {
+		log.Warnf("Stopped waiting for the runtime to be done with request '%s': %v", res.RequestID, err)
+	}
+}
 
-		return dur
+func lambdaLabelsConfig() metadata.Config {
+	var exclude []string
+	if lambdaLabelsExclude != "" {
+		exclude = strings.Split(lambdaLabelsExclude, ",")
 	}
+	return metadata.Config{Prefix: lambdaLabelsPrefix, Exclude: exclude}
+}
 
-	return fallback
+// loadConfigFile loads the file set via PYROSCOPE_CONFIG_FILE
+// The default one is optional, so that it can be shipped in a layer
+func loadConfigFile() (*config.File, error) {
+	path, explicit := os.LookupEnv("PYROSCOPE_CONFIG_FILE")
+	if !explicit || path == "" {
+		return config.Load(defaultConfigFile, false)
+	}
+	return config.Load(path, true)
 }
 
-func getEnvIntOr(key string, fallback int) int {
-	k, ok := os.LookupEnv(key)
+// configError returns all the problems found while reading the settings, if any
+func configError() error {
+	var errs []error
+	if configFileErr != nil {
+		errs = append(errs, &relay.ConfigError{Category: relay.ConfigErrorInvalidConfigFile, Err: configFileErr})
+	}
+	for _, err := range settings.Errors() {
+		errs = append(errs, &relay.ConfigError{Category: relay.ConfigErrorInvalidSetting, Err: err})
+	}
+	errs = append(errs, configErrors...)
+	for _, k := range configFile.UnknownKeys() {
+		errs = append(errs, relay.NewConfigError(relay.ConfigErrorInvalidConfigFile, "unknown setting '%s' in '%s'", k, configFile.Path))
+	}
+	return errors.Join(errs...)
+}
 
-	// has an explicit value
-	if ok && k != "" {
-		val, err := strconv.Atoi(k)
-		if err != nil {
-			logrus.Warnf("invalid value for env var '%s': '%s' defaulting to '%d'", key, k, fallback)
-			return fallback
+// exitWithInitError reports an initialization error to the platform and exits
+// The extension has to be registered to report errors, the error type is the category of the (first) error
+func exitWithInitError(ctx context.Context, logger *logrus.Entry, err error) {
+	logger.Error("Failed to initialize: ", err)
+
+	if !devMode {
+		errorType := string(relay.ConfigErrorCategoryOf(err))
+		if _, regErr := extensionClient.Register(ctx, extensionName); regErr != nil {
+			logger.Error("Failed to register extension: ", regErr)
+		} else if _, initErr := extensionClient.InitError(ctx, errorType, err); initErr != nil {
+			logger.Error("Failed to report init error: ", initErr)
 		}
-		return val
 	}
-
-	return fallback
+	os.Exit(1)
 }
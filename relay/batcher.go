@@ -0,0 +1,366 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	profileFormField          = "profile"
+	sampleTypeConfigFormField = "sample_type_config"
+)
+
+var errUnsupportedFormField = errors.New("unsupported form field")
+
+// batchKeyParams are the query params that must match for profiles to be merged
+var batchKeyParams = []string{"name", "spyName", "units", "aggregationType", "sampleRate", "format"}
+
+type BatcherCfg struct {
+	// MaxBytes is the size of the uploads in a batch after which the batch is relayed
+	MaxBytes int64
+	// MaxDelay is how long an upload can wait in a batch before being relayed
+	MaxDelay time.Duration
+}
+
+// Batcher merges pprof uploads of the same profile into a single upload
+// Uploads that can't be merged (eg. not pprof, or with a prev_profile) are relayed as is
+type Batcher struct {
+	config  *BatcherCfg
+	log     *logrus.Entry
+	relayer Relayer
+
+	mu      sync.Mutex
+	batches map[string]*batch
+}
+
+type batch struct {
+	key       string
+	requests  []*http.Request
+	profiles  []*profile.Profile
+	size      int64
+	from      int64
+	until     int64
+	multipart bool
+	// sampleTypeConfig is the sample_type_config form field, shared by the whole batch
+	sampleTypeConfig []byte
+	timer            *time.Timer
+}
+
+// batchItem is a parsed upload
+type batchItem struct {
+	req              *http.Request
+	profile          *profile.Profile
+	size             int64
+	from             int64
+	until            int64
+	multipart        bool
+	sampleTypeConfig []byte
+}
+
+func NewBatcher(log *logrus.Entry, config *BatcherCfg, relayer Relayer) *Batcher {
+	// Setup defaults
+	if config.MaxBytes == 0 {
+		config.MaxBytes = 1024 * 1024
+	}
+	if config.MaxDelay == 0 {
+		config.MaxDelay = time.Second * 15
+	}
+
+	return &Batcher{
+		config:  config,
+		log:     log.WithField("comp", "batcher"),
+		relayer: relayer,
+		batches: make(map[string]*batch),
+	}
+}
+
+// Send adds an upload to its batch, or relays it right away if it can't be batched
+func (b *Batcher) Send(req *http.Request) error {
+	item, ok := parseBatchItem(req)
+	if !ok {
+		return b.relayer.Send(req)
+	}
+
+	key := batchKey(item)
+
+	b.mu.Lock()
+	bt, ok := b.batches[key]
+	if !ok {
+		bt = &batch{
+			key:              key,
+			from:             item.from,
+			until:            item.until,
+			multipart:        item.multipart,
+			sampleTypeConfig: item.sampleTypeConfig,
+		}
+		bt.timer = time.AfterFunc(b.config.MaxDelay, func() { b.flushBatch(bt) })
+		b.batches[key] = bt
+	}
+	bt.add(item)
+
+	full := bt.size >= b.config.MaxBytes
+	if full {
+		b.take(bt)
+	}
+	b.mu.Unlock()
+
+	if full {
+		return b.relay(bt)
+	}
+	return nil
+}
+
+// Flush relays all pending batches
+func (b *Batcher) Flush() {
+	b.mu.Lock()
+	batches := make([]*batch, 0, len(b.batches))
+	for _, bt := range b.batches {
+		b.take(bt)
+		batches = append(batches, bt)
+	}
+	b.mu.Unlock()
+
+	for _, bt := range batches {
+		_ = b.relay(bt)
+	}
+}
+
+func (b *Batcher) flushBatch(bt *batch) {
+	b.mu.Lock()
+	if b.batches[bt.key] != bt {
+		// already taken
+		b.mu.Unlock()
+		return
+	}
+	b.take(bt)
+	b.mu.Unlock()
+
+	_ = b.relay(bt)
+}
+
+// take removes a batch, so that it's relayed exactly once
+// It must be called with mu held
+func (b *Batcher) take(bt *batch) {
+	bt.timer.Stop()
+	delete(b.batches, bt.key)
+}
+
+func (b *Batcher) relay(bt *batch) error {
+	if len(bt.requests) == 1 {
+		return b.relayer.Send(bt.requests[0])
+	}
+
+	req, err := bt.merge()
+	if err != nil {
+		b.log.Warnf("Failed to merge %d profiles, relaying them individually. Error: %+v", len(bt.requests), err)
+		var lastErr error
+		for _, r := range bt.requests {
+			if err := b.relayer.Send(r); err != nil {
+				lastErr = err
+			}
+		}
+		return lastErr
+	}
+
+	b.log.Debugf("Relaying %d merged profiles", len(bt.requests))
+	return b.relayer.Send(req)
+}
+
+func (bt *batch) add(item *batchItem) {
+	bt.requests = append(bt.requests, item.req)
+	bt.profiles = append(bt.profiles, item.profile)
+	bt.size += item.size
+	if item.from < bt.from {
+		bt.from = item.from
+	}
+	if item.until > bt.until {
+		bt.until = item.until
+	}
+}
+
+// merge creates a single upload out of the batch, based on its first request
+func (bt *batch) merge() (*http.Request, error) {
+	merged, err := profile.Merge(bt.profiles)
+	if err != nil {
+		return nil, err
+	}
+
+	var pprof bytes.Buffer
+	if err := merged.Write(&pprof); err != nil {
+		return nil, err
+	}
+
+	body := pprof.Bytes()
+	req := bt.requests[0].Clone(bt.requests[0].Context())
+	if bt.multipart {
+		var contentType string
+		body, contentType, err = newMultipartBody(body, bt.sampleTypeConfig)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	q := req.URL.Query()
+	q.Set("from", strconv.FormatInt(bt.from, 10))
+	q.Set("until", strconv.FormatInt(bt.until, 10))
+	req.URL.RawQuery = q.Encode()
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return req, nil
+}
+
+// parseBatchItem parses an /ingest upload with a single pprof profile
+func parseBatchItem(req *http.Request) (*batchItem, bool) {
+	if req.URL.Path != "/ingest" || req.GetBody == nil {
+		return nil, false
+	}
+
+	q := req.URL.Query()
+	if f := q.Get("format"); f != "" && f != "pprof" {
+		return nil, false
+	}
+	from, err := strconv.ParseInt(q.Get("from"), 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	until, err := strconv.ParseInt(q.Get("until"), 10, 64)
+	if err != nil {
+		return nil, false
+	}
+
+	rc, err := req.GetBody()
+	if err != nil {
+		return nil, false
+	}
+	body, err := io.ReadAll(rc)
+	_ = rc.Close()
+	if err != nil {
+		return nil, false
+	}
+
+	item := &batchItem{req: req, size: int64(len(body)), from: from, until: until}
+	pprof := body
+
+	mediaType, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		item.multipart = true
+		pprof, item.sampleTypeConfig, err = readMultipartBody(body, params["boundary"])
+		if err != nil {
+			return nil, false
+		}
+	}
+
+	item.profile, err = profile.ParseData(pprof)
+	if err != nil {
+		return nil, false
+	}
+	return item, true
+}
+
+// readMultipartBody reads the form sent by pyroscope clients
+// Bodies with other fields (eg. prev_profile) are not supported, since they can't be merged
+func readMultipartBody(body []byte, boundary string) (pprof []byte, sampleTypeConfig []byte, err error) {
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch part.FormName() {
+		case profileFormField:
+			pprof = data
+		case sampleTypeConfigFormField:
+			sampleTypeConfig = data
+		default:
+			return nil, nil, errUnsupportedFormField
+		}
+	}
+	if pprof == nil {
+		return nil, nil, errUnsupportedFormField
+	}
+	return pprof, sampleTypeConfig, nil
+}
+
+func newMultipartBody(pprof []byte, sampleTypeConfig []byte) ([]byte, string, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	fields := []struct {
+		name string
+		data []byte
+	}{
+		{profileFormField, pprof},
+		{sampleTypeConfigFormField, sampleTypeConfig},
+	}
+	for _, f := range fields {
+		if f.data == nil {
+			continue
+		}
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", `form-data; name="`+f.name+`"; filename="`+f.name+`"`)
+		h.Set("Content-Type", "application/octet-stream")
+		w, err := mw.CreatePart(h)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := w.Write(f.data); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), mw.FormDataContentType(), nil
+}
+
+// batchKey identifies the uploads that can be merged together
+func batchKey(item *batchItem) string {
+	var sb strings.Builder
+
+	q := item.req.URL.Query()
+	for _, p := range batchKeyParams {
+		sb.WriteString(p + "=" + q.Get(p) + "&")
+	}
+	if item.multipart {
+		sb.WriteString("multipart&")
+	}
+	sb.Write(item.sampleTypeConfig)
+	sb.WriteString("&")
+
+	// profiles of different types (eg. cpu and heap) are sent with the same name
+	sampleTypes := make([]string, 0, len(item.profile.SampleType))
+	for _, st := range item.profile.SampleType {
+		sampleTypes = append(sampleTypes, st.Type+"/"+st.Unit)
+	}
+	if pt := item.profile.PeriodType; pt != nil {
+		sampleTypes = append(sampleTypes, "period:"+pt.Type+"/"+pt.Unit)
+	}
+	sb.WriteString(strings.Join(sampleTypes, ","))
+
+	return sb.String()
+}
@@ -0,0 +1,150 @@
+package relay_test
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+)
+
+type recordingRelayer struct {
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func (r *recordingRelayer) Send(req *http.Request) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req)
+	return nil
+}
+
+func (r *recordingRelayer) Requests() []*http.Request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*http.Request{}, r.requests...)
+}
+
+func newIngestRequest(t *testing.T, query string, fields map[string][]byte) *http.Request {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for name, data := range fields {
+		w, err := mw.CreateFormFile(name, name)
+		require.NoError(t, err)
+		_, err = w.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, mw.Close())
+	body := buf.Bytes()
+
+	req := httptest.NewRequest(http.MethodPost, "/ingest?"+query, bytes.NewReader(body))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return req
+}
+
+func readProfileField(t *testing.T, req *http.Request) *profile.Profile {
+	require.NoError(t, req.ParseMultipartForm(32<<20))
+	f, _, err := req.FormFile("profile")
+	require.NoError(t, err)
+	defer f.Close()
+
+	p, err := profile.Parse(f)
+	require.NoError(t, err)
+	return p
+}
+
+func sumSamples(p *profile.Profile) int64 {
+	var sum int64
+	for _, s := range p.Sample {
+		sum += s.Value[0]
+	}
+	return sum
+}
+
+func TestBatcherMergesProfiles(t *testing.T) {
+	data := readTestdataFile(t, "testdata/profile.pprof")
+	original, err := profile.ParseData(data)
+	require.NoError(t, err)
+
+	next := &recordingRelayer{}
+	batcher := relay.NewBatcher(noopLogger(), &relay.BatcherCfg{MaxDelay: time.Hour}, next)
+
+	const query = "name=my.app%7B%7D&spyName=gospy&units=samples&aggregationType=sum&sampleRate=100"
+	require.NoError(t, batcher.Send(newIngestRequest(t, query+"&from=20&until=30", map[string][]byte{"profile": data})))
+	require.NoError(t, batcher.Send(newIngestRequest(t, query+"&from=10&until=20", map[string][]byte{"profile": data})))
+	require.NoError(t, batcher.Send(newIngestRequest(t, query+"&from=30&until=40", map[string][]byte{"profile": data})))
+	assert.Empty(t, next.Requests(), "waits for the batch to fill")
+
+	batcher.Flush()
+	requests := next.Requests()
+	require.Len(t, requests, 1)
+
+	r := requests[0]
+	assert.Equal(t, "10", r.URL.Query().Get("from"))
+	assert.Equal(t, "40", r.URL.Query().Get("until"))
+	assert.Equal(t, "gospy", r.URL.Query().Get("spyName"))
+
+	merged := readProfileField(t, r)
+	assert.Equal(t, 3*sumSamples(original), sumSamples(merged))
+}
+
+func TestBatcherMaxBytes(t *testing.T) {
+	data := readTestdataFile(t, "testdata/profile.pprof")
+
+	next := &recordingRelayer{}
+	batcher := relay.NewBatcher(noopLogger(), &relay.BatcherCfg{
+		MaxBytes: int64(len(data)) * 2,
+		MaxDelay: time.Hour,
+	}, next)
+
+	const query = "name=my.app%7B%7D&from=10&until=20"
+	require.NoError(t, batcher.Send(newIngestRequest(t, query, map[string][]byte{"profile": data})))
+	assert.Empty(t, next.Requests())
+	require.NoError(t, batcher.Send(newIngestRequest(t, query, map[string][]byte{"profile": data})))
+	assert.Len(t, next.Requests(), 1, "relayed once full")
+}
+
+func TestBatcherMaxDelay(t *testing.T) {
+	data := readTestdataFile(t, "testdata/profile.pprof")
+
+	next := &recordingRelayer{}
+	batcher := relay.NewBatcher(noopLogger(), &relay.BatcherCfg{MaxDelay: time.Millisecond * 10}, next)
+
+	require.NoError(t, batcher.Send(newIngestRequest(t, "name=my.app%7B%7D&from=10&until=20", map[string][]byte{"profile": data})))
+	assert.Eventually(t, func() bool {
+		return len(next.Requests()) == 1
+	}, time.Second, time.Millisecond*5)
+}
+
+func TestBatcherKeepsDifferentProfilesApart(t *testing.T) {
+	data := readTestdataFile(t, "testdata/profile.pprof")
+
+	next := &recordingRelayer{}
+	batcher := relay.NewBatcher(noopLogger(), &relay.BatcherCfg{MaxDelay: time.Hour}, next)
+
+	require.NoError(t, batcher.Send(newIngestRequest(t, "name=my.app%7B%7D&from=10&until=20", map[string][]byte{"profile": data})))
+	require.NoError(t, batcher.Send(newIngestRequest(t, "name=other.app%7B%7D&from=10&until=20", map[string][]byte{"profile": data})))
+
+	// prev_profile can't be merged, so it's relayed right away
+	require.NoError(t, batcher.Send(newIngestRequest(t, "name=my.app%7B%7D&from=10&until=20", map[string][]byte{
+		"profile":      data,
+		"prev_profile": data,
+	})))
+	assert.Len(t, next.Requests(), 1)
+
+	batcher.Flush()
+	assert.Len(t, next.Requests(), 3)
+}
@@ -1,6 +1,8 @@
 package relay
 
 import (
+	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,18 +10,41 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/labels"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/otlpprofiles"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/pushv1"
 	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/sessionid"
 )
 
 var (
-	ErrMakingRequest = errors.New("failed to make request")
-	ErrNotOkResponse = errors.New("response not ok")
+	ErrMakingRequest  = errors.New("failed to make request")
+	ErrNotOkResponse  = errors.New("response not ok")
+	ErrInvalidRequest = errors.New("invalid request")
 )
 
+// ResponseError is returned by RemoteClient.Send when the remote answers with a non 2xx status code
+// It wraps ErrNotOkResponse, so it can be checked with errors.Is
+type ResponseError struct {
+	StatusCode int
+	Body       string
+	// RetryAfter is the delay requested by the remote via the Retry-After header, if any
+	RetryAfter time.Duration
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("%v: status code: '%d'. body: '%s'", ErrNotOkResponse, e.StatusCode, e.Body)
+}
+
+func (*ResponseError) Unwrap() error {
+	return ErrNotOkResponse
+}
+
 type RemoteClientCfg struct {
 	// Address refers to the remote address the request will be made to
 	Address             string
@@ -31,22 +56,38 @@ type RemoteClientCfg struct {
 	Timeout             time.Duration
 	MaxIdleConnsPerHost int
 	SessionID           string
+	// Labels are added to every relayed profile, unless the profile already has them
+	Labels map[string]string
+	// Compression is the encoding bodies are sent in, by default they are sent as received
+	Compression Compression
+	// TLS configures private CAs, client certificates (mTLS) and such
+	TLS *TLSCfg
+	// Transport configures proxies, timeouts and such
+	Transport *TransportCfg
+	// OAuth2, if set, obtains tokens with the client credentials grant instead of using AuthToken and basic auth
+	OAuth2 *OAuth2Cfg
+	// Credentials, if set, are used instead of any of the above
+	Credentials CredentialsProvider
 }
 
 type RemoteClient struct {
-	config    *RemoteClientCfg
-	client    *http.Client
-	headers   map[string]string
-	log       *logrus.Entry
-	sessionID string
+	config      *RemoteClientCfg
+	client      *http.Client
+	headers     map[string]string
+	log         *logrus.Entry
+	sessionID   string
+	credentials CredentialsProvider
+
+	labelsMu sync.RWMutex
+	labels   map[string]string
 }
 
 func NewRemoteClient(log *logrus.Entry, config *RemoteClientCfg) *RemoteClient {
 	timeout := config.Timeout
-	if timeout == 0 {
+	if timeout <= 0 {
 		timeout = time.Second * 10
 	}
-	if config.MaxIdleConnsPerHost == 0 {
+	if config.MaxIdleConnsPerHost <= 0 {
 		config.MaxIdleConnsPerHost = 5
 	}
 	headers := make(map[string]string)
@@ -56,31 +97,63 @@ func NewRemoteClient(log *logrus.Entry, config *RemoteClientCfg) *RemoteClient {
 			log.Error(fmt.Errorf("failed to parse headers json %w", err))
 		}
 	}
+	lbls := map[string]string{}
+	for k, v := range config.Labels {
+		lbls[k] = v
+	}
+	var tlsConfig *tls.Config
+	if !config.TLS.IsZero() {
+		var err error
+		if tlsConfig, err = config.TLS.build(); err != nil {
+			log.Error(fmt.Errorf("failed to setup tls, continuing with the defaults %w", err))
+		}
+	}
+	transport, err := newTransport(config.Transport, config.MaxIdleConnsPerHost, tlsConfig)
+	if err != nil {
+		log.Error(fmt.Errorf("failed to setup transport, continuing with the defaults %w", err))
+		transport, _ = newTransport(nil, config.MaxIdleConnsPerHost, tlsConfig)
+	}
+	credentials := config.Credentials
+	switch {
+	case credentials != nil:
+	case config.OAuth2 != nil:
+		// tokens are fetched through the same proxy, but the TLS settings of the remote don't apply to the token endpoint
+		tokenTransport, err := newTransport(config.Transport, config.MaxIdleConnsPerHost, nil)
+		if err != nil {
+			tokenTransport, _ = newTransport(nil, config.MaxIdleConnsPerHost, nil)
+		}
+		credentials = newOAuth2CredentialsProvider(log, config.OAuth2, tokenTransport)
+	default:
+		credentials = NewStaticCredentialsProvider(Credentials{
+			Token:             config.AuthToken,
+			BasicAuthUser:     config.BasicAuthUser,
+			BasicAuthPassword: config.BasicAuthPassword,
+		})
+	}
 	return &RemoteClient{
-		log:       log,
-		config:    config,
-		sessionID: config.SessionID,
+		log:         log,
+		config:      config,
+		sessionID:   config.SessionID,
+		headers:     headers,
+		labels:      lbls,
+		credentials: credentials,
 		client: &http.Client{
-			Timeout: timeout,
-			Transport: &http.Transport{
-				MaxIdleConnsPerHost: config.MaxIdleConnsPerHost,
-			},
+			Timeout:   timeout,
+			Transport: transport,
 		},
 	}
 }
 
 // Send relays the request to the remote server
+// If the remote rejects the credentials (401/403), they are refreshed and the request is sent once more
+// The original request is left untouched (other than its body being consumed)
 func (r *RemoteClient) Send(req *http.Request) error {
 	if req.Body != nil {
 		defer req.Body.Close()
 	}
-	r.enhanceWithAuthToken(req)
-	if r.config.TenantID != "" {
-		req.Header.Set("X-Scope-OrgID", r.config.TenantID)
-	}
-	for k, v := range r.headers {
-		req.Header.Set(k, v)
-	}
+	req = req.Clone(req.Context())
+	isPush := req.URL.Path == pushv1.Path
+	isOTLP := req.URL.Path == OTLPHTTPPath
 
 	host := r.config.Address
 
@@ -93,7 +166,60 @@ func (r *RemoteClient) Send(req *http.Request) error {
 	req.URL.Path = path.Join(u.Path, req.URL.Path)
 	req.Header.Set("X-Forwarded-Host", req.Header.Get("Host"))
 	req.Host = u.Host
-	sessionid.InjectToRequest(r.sessionID, req)
+	// the tenant of the route, if any, takes precedence
+	tenantID := r.config.TenantID
+	if v := tenantIDFrom(req.Context()); v != "" {
+		tenantID = v
+	}
+	if tenantID != "" {
+		req.Header.Set("X-Scope-OrgID", tenantID)
+	}
+	// labels of push and OTLP requests live in the body, rather than in the 'name' query param
+	if isPush {
+		if err := injectBodyLabels(req, r.requestLabels(), pushv1.InjectLabels); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+		}
+	} else if isOTLP {
+		if err := injectBodyLabels(req, r.requestLabels(), otlpprofiles.InjectAttributes); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+		}
+	} else {
+		labels.InjectToRequest(r.requestLabels(), req)
+	}
+	if err := encodeBody(req, r.config.Compression); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+
+	credentials, err := r.credentials.Credentials(req.Context())
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCredentials, err)
+	}
+	err = r.do(req, credentials)
+	if !isAuthError(err) || !isReplayable(req) {
+		return err
+	}
+
+	// the credentials may have been rotated or expired
+	r.credentials.Invalidate(credentials)
+	refreshed, credErr := r.credentials.Credentials(req.Context())
+	if credErr != nil || refreshed == credentials {
+		return err
+	}
+	r.log.Info("Credentials were rejected, retrying with refreshed ones")
+	req, credErr = cloneForAttempt(req)
+	if credErr != nil {
+		return err
+	}
+	return r.do(req, refreshed)
+}
+
+// do sends a fully built request, authenticated with credentials
+func (r *RemoteClient) do(req *http.Request, credentials Credentials) error {
+	credentials.Apply(req)
+	// headers are set last, so they can override the credentials
+	for k, v := range r.headers {
+		req.Header.Set(k, v)
+	}
 	// TODO(eh-am): check it's a request to /ingest?
 	r.log.Debugf("Making request to %s", req.URL.String())
 	res, err := r.client.Do(req)
@@ -104,21 +230,105 @@ func (r *RemoteClient) Send(req *http.Request) error {
 
 	if !(res.StatusCode >= 200 && res.StatusCode < 300) {
 		respBody, _ := io.ReadAll(res.Body)
-		return fmt.Errorf("%w: %v", ErrNotOkResponse, fmt.Errorf("status code: '%d'. body: '%s'", res.StatusCode, respBody))
+		return &ResponseError{
+			StatusCode: res.StatusCode,
+			Body:       string(respBody),
+			RetryAfter: parseRetryAfter(res.Header.Get("Retry-After"), time.Now()),
+		}
 	}
 
 	return nil
 }
 
-// enhanceWithAuthToken adds an Authorization header if an AuthToken is supplied
-// note that if no authToken is set, it's possible that the Authorization header
-// from the original request is kept
-func (r *RemoteClient) enhanceWithAuthToken(req *http.Request) {
-	token := r.config.AuthToken
+// isAuthError reports whether the remote rejected the credentials
+func isAuthError(err error) bool {
+	var respErr *ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.StatusCode == http.StatusUnauthorized || respErr.StatusCode == http.StatusForbidden
+	}
+	return false
+}
+
+// parseRetryAfter parses a Retry-After header value, which can be either
+// a number of seconds or an HTTP date. It returns 0 if the value is missing or invalid
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// CredentialsProvider returns the provider of the credentials requests are authenticated with
+func (r *RemoteClient) CredentialsProvider() CredentialsProvider {
+	return r.credentials
+}
+
+// AddLabels adds labels to every relayed profile
+// Labels that were already set are kept untouched
+func (r *RemoteClient) AddLabels(lbls map[string]string) {
+	r.labelsMu.Lock()
+	defer r.labelsMu.Unlock()
+
+	for k, v := range lbls {
+		if _, ok := r.labels[k]; !ok {
+			r.labels[k] = v
+		}
+	}
+}
+
+// requestLabels returns the labels to be injected into a request
+func (r *RemoteClient) requestLabels() map[string]string {
+	r.labelsMu.RLock()
+	defer r.labelsMu.RUnlock()
 
-	if token != "" {
-		req.Header.Set("Authorization", "Bearer "+token)
-	} else if r.config.BasicAuthUser != "" && r.config.BasicAuthPassword != "" {
-		req.SetBasicAuth(r.config.BasicAuthUser, r.config.BasicAuthPassword)
+	lbls := make(map[string]string, len(r.labels)+1)
+	for k, v := range r.labels {
+		lbls[k] = v
+	}
+	lbls[sessionid.LabelName] = r.sessionID
+	return lbls
+}
+
+// bodyLabelsInjector adds labels to a body of the given content type
+type bodyLabelsInjector func(contentType string, body []byte, lbls map[string]string) ([]byte, error)
+
+// injectBodyLabels adds labels to the body of a request, using inject for its content type
+// eg to every series of a push.v1.PusherService/Push request
+// A compressed body is sent uncompressed, unless RemoteClientCfg.Compression says otherwise
+func injectBodyLabels(req *http.Request, lbls map[string]string, inject bodyLabelsInjector) error {
+	if req.Body == nil {
+		return nil
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return err
 	}
+
+	if body, err = decompress(req.Header.Get("Content-Encoding"), body); err != nil {
+		return err
+	}
+	req.Header.Del("Content-Encoding")
+
+	body, err = inject(req.Header.Get("Content-Type"), body, lbls)
+	if err != nil {
+		return err
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return nil
 }
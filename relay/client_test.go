@@ -121,3 +121,44 @@ func TestRemoteClientTimeout(t *testing.T) {
 	err = remoteClient.Send(req)
 	assert.ErrorIs(t, err, relay.ErrMakingRequest)
 }
+
+func TestRemoteClientInjectsLabels(t *testing.T) {
+	logger := noopLogger()
+
+	endpoint := "/ingest?name=my.app%7Bregion%3Dmine%7D&spyName=gospy"
+
+	remoteServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			parsed, err := flameql.ParseKey(r.URL.Query().Get("name"))
+			require.NoError(t, err)
+
+			assert.Equal(t, map[string]string{
+				"__name__":             "my.app",
+				sessionid.LabelName:    "abc",
+				"lambda_function_name": "my-function",
+				"lambda_memory_size":   "128",
+				"region":               "mine",
+			}, parsed.Labels(), "labels are added, without overriding existing ones")
+		}),
+	)
+	defer remoteServer.Close()
+
+	remoteClient := relay.NewRemoteClient(logger, &relay.RemoteClientCfg{
+		Address:   remoteServer.URL,
+		SessionID: "abc",
+		Labels: map[string]string{
+			"lambda_function_name": "my-function",
+			"region":               "us-east-1",
+		},
+	})
+	remoteClient.AddLabels(map[string]string{
+		"lambda_function_name": "other-function",
+		"lambda_memory_size":   "128",
+	})
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, nil)
+	require.NoError(t, err)
+
+	err = remoteClient.Send(req)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,124 @@
+package relay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// Compression is the encoding of the bodies sent to the remote
+type Compression string
+
+const (
+	// CompressionPassthrough sends bodies as they were received
+	CompressionPassthrough Compression = ""
+	// CompressionIdentity sends uncompressed bodies, for remotes that don't support compression
+	CompressionIdentity Compression = "identity"
+	CompressionGzip     Compression = "gzip"
+	CompressionZstd     Compression = "zstd"
+)
+
+// ParseCompression parses a compression, an empty string means CompressionPassthrough
+func ParseCompression(s string) (Compression, error) {
+	switch c := Compression(s); c {
+	case CompressionPassthrough, CompressionIdentity, CompressionGzip, CompressionZstd:
+		return c, nil
+	case "none":
+		return CompressionIdentity, nil
+	default:
+		return "", fmt.Errorf("unknown compression '%s'", s)
+	}
+}
+
+// zstd encoders and decoders are expensive to create, and safe to share when using EncodeAll/DecodeAll
+var (
+	zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) { return zstd.NewWriter(nil) })
+	zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) { return zstd.NewReader(nil) })
+)
+
+// encodeBody re-encodes the request body with the given compression, setting Content-Encoding accordingly
+// Bodies that are already compressed are decompressed first
+func encodeBody(req *http.Request, compression Compression) error {
+	current := req.Header.Get("Content-Encoding")
+	if compression == CompressionPassthrough || req.Body == nil || current == string(compression) {
+		return nil
+	}
+	if compression == CompressionIdentity && current == "" {
+		return nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	if body, err = decompress(current, body); err != nil {
+		return err
+	}
+	if body, err = compress(compression, body); err != nil {
+		return err
+	}
+
+	if compression == CompressionIdentity {
+		req.Header.Del("Content-Encoding")
+	} else {
+		req.Header.Set("Content-Encoding", string(compression))
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return nil
+}
+
+func decompress(encoding string, body []byte) ([]byte, error) {
+	switch encoding {
+	case "", string(CompressionIdentity):
+		return body, nil
+	case string(CompressionGzip):
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(zr)
+	case string(CompressionZstd):
+		dec, err := zstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+		return dec.DecodeAll(body, nil)
+	default:
+		return nil, fmt.Errorf("%w: '%s'", ErrUnsupportedEncoding, encoding)
+	}
+}
+
+func compress(compression Compression, body []byte) ([]byte, error) {
+	switch compression {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionZstd:
+		enc, err := zstdEncoder()
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(body, nil), nil
+	default:
+		return body, nil
+	}
+}
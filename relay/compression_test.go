@@ -0,0 +1,106 @@
+package relay_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+)
+
+func gzipBytes(t *testing.T, b []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(b)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func decodeBody(t *testing.T, encoding string, b []byte) []byte {
+	switch encoding {
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		require.NoError(t, err)
+		b, err = io.ReadAll(zr)
+		require.NoError(t, err)
+	case "zstd":
+		zr, err := zstd.NewReader(nil)
+		require.NoError(t, err)
+		defer zr.Close()
+		b, err = zr.DecodeAll(b, nil)
+		require.NoError(t, err)
+	}
+	return b
+}
+
+func TestRemoteClientCompression(t *testing.T) {
+	profile := readTestdataFile(t, "testdata/profile.pprof")
+
+	testCases := []struct {
+		name             string
+		compression      relay.Compression
+		incomingEncoding string
+		expectedEncoding string
+	}{
+		{"passthrough", relay.CompressionPassthrough, "", ""},
+		{"passthrough compressed", relay.CompressionPassthrough, "gzip", "gzip"},
+		{"gzip", relay.CompressionGzip, "", "gzip"},
+		{"zstd", relay.CompressionZstd, "", "zstd"},
+		{"already compressed", relay.CompressionGzip, "gzip", "gzip"},
+		{"recompressed", relay.CompressionZstd, "gzip", "zstd"},
+		{"decompressed", relay.CompressionIdentity, "gzip", ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			remoteServer := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					assert.Equal(t, tc.expectedEncoding, r.Header.Get("Content-Encoding"))
+
+					body, err := io.ReadAll(r.Body)
+					require.NoError(t, err)
+					assert.Equal(t, profile, decodeBody(t, tc.expectedEncoding, body))
+				}),
+			)
+			defer remoteServer.Close()
+
+			remoteClient := relay.NewRemoteClient(noopLogger(), &relay.RemoteClientCfg{
+				Address:     remoteServer.URL,
+				Compression: tc.compression,
+			})
+
+			body := profile
+			if tc.incomingEncoding == "gzip" {
+				body = gzipBytes(t, profile)
+			}
+			req, err := http.NewRequest(http.MethodPost, "/ingest?name=my.app%7B%7D", bytes.NewReader(body))
+			require.NoError(t, err)
+			if tc.incomingEncoding != "" {
+				req.Header.Set("Content-Encoding", tc.incomingEncoding)
+			}
+
+			assert.NoError(t, remoteClient.Send(req))
+		})
+	}
+}
+
+func TestRemoteClientUnsupportedEncoding(t *testing.T) {
+	remoteClient := relay.NewRemoteClient(noopLogger(), &relay.RemoteClientCfg{
+		Address:     "http://localhost",
+		Compression: relay.CompressionGzip,
+	})
+
+	req, err := http.NewRequest(http.MethodPost, "/ingest?name=my.app%7B%7D", bytes.NewReader([]byte("data")))
+	require.NoError(t, err)
+	req.Header.Set("Content-Encoding", "br")
+
+	assert.ErrorIs(t, remoteClient.Send(req), relay.ErrInvalidRequest)
+}
@@ -5,21 +5,31 @@ import (
 	"context"
 	"io"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/sirupsen/logrus"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/labels"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/pushv1"
 )
 
 type Controller struct {
-	log   *logrus.Entry
-	queue *RemoteQueue
+	log         *logrus.Entry
+	queue       Relayer
+	invocations *InvocationTracker
 }
 
-func NewController(log *logrus.Entry, queue *RemoteQueue) *Controller {
+// NewController creates a controller
+// queue is usually a RemoteQueue, or a Batcher in front of it
+// invocations is optional, when set profiles are labeled with the invocation they belong to
+func NewController(log *logrus.Entry, queue Relayer, invocations *InvocationTracker) *Controller {
 	log = log.WithField("comp", "controller")
 
 	return &Controller{
-		log:   log,
-		queue: queue,
+		log:         log,
+		queue:       queue,
+		invocations: invocations,
 	}
 }
 
@@ -34,7 +44,65 @@ func (c *Controller) RelayRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	r2.Body = io.NopCloser(bytes.NewReader(body))
+	r2.ContentLength = int64(len(body))
+	// allows the request to be replayed, eg when retrying
+	r2.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+
+	if r.URL.Path == pushv1.Path {
+		c.queue.Send(r2)
+		// connect clients expect a PushResponse in the same content type as the request
+		contentType := pushv1.MediaType(r.Header.Get("Content-Type"))
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(200)
+		_, _ = w.Write(pushv1.EmptyResponse(contentType))
+		return
+	}
+
+	c.injectInvocationLabels(r2)
 
 	c.queue.Send(r2)
 	w.WriteHeader(200)
 }
+
+// injectInvocationLabels labels the profile with the invocation it was collected in, if any
+func (c *Controller) injectInvocationLabels(r *http.Request) {
+	if c.invocations == nil {
+		return
+	}
+
+	q := r.URL.Query()
+	from, err := parseIngestTime(q.Get("from"))
+	if err != nil {
+		return
+	}
+	until, err := parseIngestTime(q.Get("until"))
+	if err != nil {
+		return
+	}
+
+	if inv := c.invocations.Lookup(from, until); inv != nil {
+		labels.InjectToRequest(inv.Labels(), r)
+	}
+}
+
+// parseIngestTime parses the from/until params of /ingest
+// Clients send them in seconds or nanoseconds (and possibly milli/microseconds), told apart by their magnitude
+func parseIngestTime(s string) (time.Time, error) {
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	switch {
+	case v > 1e17:
+		return time.Unix(0, v), nil
+	case v > 1e14:
+		return time.UnixMicro(v), nil
+	case v > 1e11:
+		return time.UnixMilli(v), nil
+	default:
+		return time.Unix(v, 0), nil
+	}
+}
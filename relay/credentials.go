@@ -0,0 +1,117 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var ErrCredentials = errors.New("failed to get credentials")
+
+// Credentials authenticate the requests to the remote
+// Token takes precedence over basic auth
+type Credentials struct {
+	Token             string
+	BasicAuthUser     string
+	BasicAuthPassword string
+}
+
+// Apply adds an Authorization header if credentials are set
+// note that if no credentials are set, it's possible that the Authorization header
+// from the original request is kept
+func (c Credentials) Apply(req *http.Request) {
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	} else if c.BasicAuthUser != "" && c.BasicAuthPassword != "" {
+		req.SetBasicAuth(c.BasicAuthUser, c.BasicAuthPassword)
+	}
+}
+
+// CredentialsProvider provides the credentials used by RemoteClient
+type CredentialsProvider interface {
+	// Credentials returns the current credentials
+	Credentials(ctx context.Context) (Credentials, error)
+	// Invalidate is called when the remote rejected the credentials (401/403)
+	// so that the next call to Credentials refreshes them, if possible
+	Invalidate(rejected Credentials)
+}
+
+// StaticCredentialsProvider always provides the same credentials
+type StaticCredentialsProvider struct {
+	credentials Credentials
+}
+
+func NewStaticCredentialsProvider(credentials Credentials) *StaticCredentialsProvider {
+	return &StaticCredentialsProvider{credentials: credentials}
+}
+
+func (p *StaticCredentialsProvider) Credentials(context.Context) (Credentials, error) {
+	return p.credentials, nil
+}
+
+func (*StaticCredentialsProvider) Invalidate(Credentials) {}
+
+type RefreshingCredentialsCfg struct {
+	// RefreshInterval is how long credentials are cached for, 0 means until they are invalidated
+	RefreshInterval time.Duration
+}
+
+// RefreshingCredentialsProvider caches the credentials returned by a fetch function
+// They are fetched again every RefreshInterval, or once the remote rejects them
+type RefreshingCredentialsProvider struct {
+	config *RefreshingCredentialsCfg
+	log    *logrus.Entry
+	fetch  func(ctx context.Context) (Credentials, error)
+
+	mu          sync.Mutex
+	credentials Credentials
+	fetchedAt   time.Time
+	valid       bool
+}
+
+func NewRefreshingCredentialsProvider(log *logrus.Entry, config *RefreshingCredentialsCfg, fetch func(ctx context.Context) (Credentials, error)) *RefreshingCredentialsProvider {
+	return &RefreshingCredentialsProvider{
+		config: config,
+		log:    log.WithField("comp", "credentials"),
+		fetch:  fetch,
+	}
+}
+
+// Credentials returns the cached credentials, fetching them if needed
+// If fetching fails and there are previous credentials, those are returned
+func (p *RefreshingCredentialsProvider) Credentials(ctx context.Context) (Credentials, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.valid && (p.config.RefreshInterval <= 0 || time.Since(p.fetchedAt) < p.config.RefreshInterval) {
+		return p.credentials, nil
+	}
+
+	credentials, err := p.fetch(ctx)
+	if err != nil {
+		if p.fetchedAt.IsZero() {
+			return Credentials{}, err
+		}
+		p.log.Error("Failed to refresh credentials, using the previous ones: ", err)
+		return p.credentials, nil
+	}
+
+	p.credentials = credentials
+	p.fetchedAt = time.Now()
+	p.valid = true
+	return credentials, nil
+}
+
+// Invalidate marks the credentials as stale, unless they were already refreshed
+// (eg by another request that was rejected concurrently)
+func (p *RefreshingCredentialsProvider) Invalidate(rejected Credentials) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.credentials == rejected {
+		p.valid = false
+	}
+}
@@ -0,0 +1,142 @@
+package relay_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+)
+
+func TestRefreshingCredentialsProvider(t *testing.T) {
+	ctx := context.Background()
+	var fetches int
+	var fetchErr error
+	provider := relay.NewRefreshingCredentialsProvider(noopLogger(), &relay.RefreshingCredentialsCfg{
+		RefreshInterval: time.Millisecond * 20,
+	}, func(context.Context) (relay.Credentials, error) {
+		if fetchErr != nil {
+			return relay.Credentials{}, fetchErr
+		}
+		fetches++
+		return relay.Credentials{Token: string(rune('a' + fetches - 1))}, nil
+	})
+
+	creds, err := provider.Credentials(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "a", creds.Token)
+
+	creds, err = provider.Credentials(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "a", creds.Token, "credentials are cached")
+
+	// stale credentials don't invalidate the refreshed ones
+	provider.Invalidate(relay.Credentials{Token: "stale"})
+	creds, _ = provider.Credentials(ctx)
+	assert.Equal(t, "a", creds.Token)
+
+	provider.Invalidate(creds)
+	creds, _ = provider.Credentials(ctx)
+	assert.Equal(t, "b", creds.Token, "invalidated credentials are refreshed")
+
+	time.Sleep(time.Millisecond * 30)
+	creds, _ = provider.Credentials(ctx)
+	assert.Equal(t, "c", creds.Token, "credentials are refreshed every RefreshInterval")
+
+	fetchErr = errors.New("unavailable")
+	provider.Invalidate(creds)
+	creds, err = provider.Credentials(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "c", creds.Token, "previous credentials are kept if refreshing fails")
+}
+
+func TestRefreshingCredentialsProviderInitialError(t *testing.T) {
+	provider := relay.NewRefreshingCredentialsProvider(noopLogger(), &relay.RefreshingCredentialsCfg{},
+		func(context.Context) (relay.Credentials, error) {
+			return relay.Credentials{}, errors.New("unavailable")
+		})
+
+	_, err := provider.Credentials(context.Background())
+	assert.Error(t, err)
+
+	remoteClient := relay.NewRemoteClient(noopLogger(), &relay.RemoteClientCfg{
+		Address:     "http://localhost",
+		Credentials: provider,
+	})
+	req, err := http.NewRequest(http.MethodPost, "/ingest", nil)
+	require.NoError(t, err)
+	assert.ErrorIs(t, remoteClient.Send(req), relay.ErrCredentials)
+}
+
+func TestRemoteClientRefreshesRejectedCredentials(t *testing.T) {
+	profile := readTestdataFile(t, "testdata/profile.pprof")
+	var current atomic.Value
+	current.Store("old")
+
+	var calls int32
+	remoteServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			if r.Header.Get("Authorization") != "Bearer new" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			assert.Equal(t, profile, body, "body is replayed")
+		}),
+	)
+	t.Cleanup(remoteServer.Close)
+
+	provider := relay.NewRefreshingCredentialsProvider(noopLogger(), &relay.RefreshingCredentialsCfg{},
+		func(context.Context) (relay.Credentials, error) {
+			return relay.Credentials{Token: current.Load().(string)}, nil
+		})
+	remoteClient := relay.NewRemoteClient(noopLogger(), &relay.RemoteClientCfg{
+		Address:     remoteServer.URL,
+		Credentials: provider,
+	})
+
+	req, err := http.NewRequest(http.MethodPost, "/ingest", bytes.NewReader(profile))
+	require.NoError(t, err)
+	err = remoteClient.Send(req)
+	assert.ErrorIs(t, err, relay.ErrNotOkResponse, "the refreshed credentials are still rejected")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "not retried with the same credentials")
+
+	current.Store("new")
+	req, err = http.NewRequest(http.MethodPost, "/ingest", bytes.NewReader(profile))
+	require.NoError(t, err)
+	require.NoError(t, remoteClient.Send(req))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls), "retried once with the refreshed credentials")
+}
+
+func TestRemoteClientStaticCredentialsNotRetried(t *testing.T) {
+	var calls int32
+	remoteServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.WriteHeader(http.StatusForbidden)
+		}),
+	)
+	t.Cleanup(remoteServer.Close)
+
+	remoteClient := relay.NewRemoteClient(noopLogger(), &relay.RemoteClientCfg{
+		Address:   remoteServer.URL,
+		AuthToken: "123",
+	})
+	req, err := http.NewRequest(http.MethodPost, "/ingest", nil)
+	require.NoError(t, err)
+
+	var respErr *relay.ResponseError
+	require.ErrorAs(t, remoteClient.Send(req), &respErr)
+	assert.Equal(t, http.StatusForbidden, respErr.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
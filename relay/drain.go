@@ -0,0 +1,124 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DrainPath is where clients learn that the extension is shutting down, and tell it they flushed their last profiles
+const DrainPath = "/drain"
+
+// drainStatus is the body of the responses of DrainPath
+type drainStatus struct {
+	Draining bool `json:"draining"`
+	// DeadlineMs is when the extension stops accepting profiles, in unix milliseconds, if draining
+	DeadlineMs int64 `json:"deadlineMs,omitempty"`
+}
+
+// drainClientParam identifies a client of the handshake, so that several of them (eg in different processes) can take part
+// Clients that don't set it are the same one
+const drainClientParam = "client"
+
+// Drainer is the handshake that lets clients flush their last profiles before the queue is stopped
+// Clients poll DrainPath with GET, once it reports draining they upload what they hold and POST to DrainPath
+// Only clients that polled at least once take part in it, so that others don't hold the shutdown
+type Drainer struct {
+	log *logrus.Entry
+
+	mu       sync.Mutex
+	draining bool
+	deadline time.Time
+	// participants are the clients that polled, by id, true once they acknowledged the drain
+	participants map[string]bool
+	// acked is closed once every participant acknowledged the drain
+	acked       chan struct{}
+	ackedClosed bool
+}
+
+func NewDrainer(log *logrus.Entry) *Drainer {
+	return &Drainer{
+		log:          log.WithField("comp", "drainer"),
+		participants: map[string]bool{},
+		acked:        make(chan struct{}),
+	}
+}
+
+// Drain reports draining to the clients, then waits until all of them acknowledge, gracePeriod elapses or ctx is done
+// It returns right away if no client ever polled DrainPath
+func (d *Drainer) Drain(ctx context.Context, gracePeriod time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, gracePeriod)
+	defer cancel()
+
+	d.mu.Lock()
+	d.draining = true
+	d.deadline, _ = ctx.Deadline()
+	participants := len(d.participants)
+	d.mu.Unlock()
+
+	if participants == 0 || gracePeriod <= 0 {
+		return
+	}
+
+	d.log.Debugf("Waiting up to %s for %d clients to flush their profiles", time.Until(d.deadline).Round(time.Millisecond), participants)
+	select {
+	case <-d.acked:
+		d.log.Debug("Clients flushed their profiles")
+	case <-ctx.Done():
+		d.log.Warn("Stopped waiting for the clients to flush their profiles: ", ctx.Err())
+	}
+}
+
+func (d *Drainer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	client := r.URL.Query().Get(drainClientParam)
+
+	d.mu.Lock()
+	code := http.StatusOK
+	switch {
+	case r.Method != http.MethodPost:
+		// a client that already acknowledged stays done
+		if _, ok := d.participants[client]; !ok {
+			d.participants[client] = false
+		}
+	case !d.draining:
+		// there is nothing to acknowledge yet, the client would miss the actual drain
+		code = http.StatusConflict
+	default:
+		d.participants[client] = true
+		d.closeAckedIfDone()
+	}
+	status := drainStatus{Draining: d.draining}
+	if d.draining {
+		status.DeadlineMs = d.deadline.UnixMilli()
+	}
+	d.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+// closeAckedIfDone closes acked if every participant acknowledged, d.mu must be held
+func (d *Drainer) closeAckedIfDone() {
+	if d.ackedClosed {
+		return
+	}
+	for _, acked := range d.participants {
+		if !acked {
+			return
+		}
+	}
+	d.ackedClosed = true
+	close(d.acked)
+}
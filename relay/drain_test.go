@@ -0,0 +1,135 @@
+package relay_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+)
+
+type drainStatus struct {
+	Draining   bool  `json:"draining"`
+	DeadlineMs int64 `json:"deadlineMs"`
+}
+
+func pollDrain(t *testing.T, drainer *relay.Drainer, method string) drainStatus {
+	return pollDrainAs(t, drainer, method, "", http.StatusOK)
+}
+
+// pollDrainAs polls as the given client, expecting code
+func pollDrainAs(t *testing.T, drainer *relay.Drainer, method string, client string, code int) drainStatus {
+	w := httptest.NewRecorder()
+	drainer.ServeHTTP(w, httptest.NewRequest(method, relay.DrainPath+"?client="+client, nil))
+	require.Equal(t, code, w.Code)
+
+	var status drainStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	return status
+}
+
+func TestDrainerHandshake(t *testing.T) {
+	drainer := relay.NewDrainer(noopLogger())
+	assert.False(t, pollDrain(t, drainer, http.MethodGet).Draining)
+
+	drained := make(chan struct{})
+	start := time.Now()
+	go func() {
+		defer close(drained)
+		drainer.Drain(context.Background(), time.Second*5)
+	}()
+
+	// the client polls until the extension is draining, then flushes its profiles
+	var status drainStatus
+	require.Eventually(t, func() bool {
+		status = pollDrain(t, drainer, http.MethodGet)
+		return status.Draining
+	}, time.Second, time.Millisecond*10)
+	assert.InDelta(t, start.Add(time.Second*5).UnixMilli(), status.DeadlineMs, 1000)
+
+	pollDrain(t, drainer, http.MethodPost)
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("drain wasn't acknowledged")
+	}
+}
+
+func TestDrainerEarlyAck(t *testing.T) {
+	drainer := relay.NewDrainer(noopLogger())
+	pollDrain(t, drainer, http.MethodGet)
+
+	// acknowledging before the drain is rejected, rather than skipping it
+	assert.False(t, pollDrainAs(t, drainer, http.MethodPost, "", http.StatusConflict).Draining)
+
+	start := time.Now()
+	drainer.Drain(context.Background(), time.Millisecond*50)
+	assert.GreaterOrEqual(t, time.Since(start), time.Millisecond*50, "waits for the client")
+}
+
+func TestDrainerParticipants(t *testing.T) {
+	drainer := relay.NewDrainer(noopLogger())
+	pollDrainAs(t, drainer, http.MethodGet, "a", http.StatusOK)
+	pollDrainAs(t, drainer, http.MethodGet, "b", http.StatusOK)
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		drainer.Drain(context.Background(), time.Second*5)
+	}()
+	require.Eventually(t, func() bool {
+		return pollDrainAs(t, drainer, http.MethodGet, "a", http.StatusOK).Draining
+	}, time.Second, time.Millisecond*10)
+
+	pollDrainAs(t, drainer, http.MethodPost, "a", http.StatusOK)
+	pollDrainAs(t, drainer, http.MethodGet, "a", http.StatusOK)
+	select {
+	case <-drained:
+		t.Fatal("drain was acknowledged before all the clients did")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	pollDrainAs(t, drainer, http.MethodPost, "b", http.StatusOK)
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("drain wasn't acknowledged")
+	}
+}
+
+func TestDrainerGracePeriod(t *testing.T) {
+	drainer := relay.NewDrainer(noopLogger())
+	pollDrain(t, drainer, http.MethodGet)
+
+	start := time.Now()
+	drainer.Drain(context.Background(), time.Millisecond*50)
+	assert.GreaterOrEqual(t, time.Since(start), time.Millisecond*50, "waits for the client")
+
+	// bounded by the shutdown deadline
+	drainer = relay.NewDrainer(noopLogger())
+	pollDrain(t, drainer, http.MethodGet)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	start = time.Now()
+	drainer.Drain(ctx, time.Second*5)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestDrainerWithoutClients(t *testing.T) {
+	drainer := relay.NewDrainer(noopLogger())
+
+	start := time.Now()
+	drainer.Drain(context.Background(), time.Second*5)
+	assert.Less(t, time.Since(start), time.Second, "no client takes part in the handshake")
+	assert.True(t, pollDrain(t, drainer, http.MethodGet).Draining)
+
+	w := httptest.NewRecorder()
+	drainer.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, relay.DrainPath, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
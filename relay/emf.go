@@ -0,0 +1,156 @@
+package relay
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// emfMetrics are the metrics emitted, in order, with their CloudWatch unit
+var emfMetrics = []struct {
+	name string
+	unit string
+}{
+	{"Enqueued", "Count"},
+	{"Relayed", "Count"},
+	{"Dropped", "Count"},
+	{"AbandonedDeadline", "Count"},
+	{"AbandonedStopped", "Count"},
+	{"Spilled", "Count"},
+	{"Retried", "Count"},
+	{"Failed", "Count"},
+	{"BytesRelayed", "Bytes"},
+	{"FlushDuration", "Milliseconds"},
+	{"QueueDepth", "Count"},
+}
+
+type EMFCfg struct {
+	// Namespace is the CloudWatch namespace the metrics are published to
+	Namespace string
+	// Dimensions are added to every metric, eg FunctionName
+	Dimensions map[string]string
+	// Output is where the EMF documents are written to, defaults to stdout
+	// which is shipped to CloudWatch Logs by Lambda
+	Output io.Writer
+}
+
+// EMFEmitter writes the relay metrics as CloudWatch Embedded Metric Format documents
+// See https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/CloudWatch_Embedded_Metric_Format_Specification.html
+type EMFEmitter struct {
+	config  *EMFCfg
+	logger  *logrus.Logger
+	metrics *Metrics
+
+	mu   sync.Mutex
+	last metricsSnapshot
+}
+
+func NewEMFEmitter(config *EMFCfg, metrics *Metrics) *EMFEmitter {
+	// Setup defaults
+	if config.Namespace == "" {
+		config.Namespace = "PyroscopeLambdaExtension"
+	}
+	if config.Output == nil {
+		config.Output = os.Stdout
+	}
+
+	// a dedicated logger, so that documents are emitted regardless of the log level and format
+	logger := logrus.New()
+	logger.SetOutput(config.Output)
+	logger.SetLevel(logrus.InfoLevel)
+	logger.SetFormatter(&emfFormatter{
+		namespace:  config.Namespace,
+		dimensions: config.Dimensions,
+	})
+
+	return &EMFEmitter{
+		config:  config,
+		logger:  logger,
+		metrics: metrics,
+	}
+}
+
+// Emit writes a document with what happened since the previous one
+// Counters are emitted as deltas, so that they can be summed up in CloudWatch
+func (e *EMFEmitter) Emit() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	s := e.metrics.snapshot()
+	last := e.last
+	e.last = s
+
+	e.logger.WithFields(logrus.Fields{
+		"Enqueued":          s.enqueued - last.enqueued,
+		"Relayed":           s.sent - last.sent,
+		"Dropped":           s.dropped - last.dropped,
+		"AbandonedDeadline": s.abandonedDeadline - last.abandonedDeadline,
+		"AbandonedStopped":  s.abandonedStopped - last.abandonedStopped,
+		"Spilled":           s.spilled - last.spilled,
+		"Retried":           s.retried - last.retried,
+		"Failed":            s.failed - last.failed,
+		"BytesRelayed":      s.sentBytes - last.sentBytes,
+		"FlushDuration":     (s.flushDuration - last.flushDuration).Milliseconds(),
+		"QueueDepth":        s.queueDepth,
+	}).Info()
+}
+
+// emfFormatter formats the numeric fields of an entry as EMF metrics
+type emfFormatter struct {
+	namespace  string
+	dimensions map[string]string
+}
+
+type emfMetadata struct {
+	Timestamp         int64          `json:"Timestamp"`
+	CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+}
+
+type emfDirective struct {
+	Namespace  string                `json:"Namespace"`
+	Dimensions [][]string            `json:"Dimensions"`
+	Metrics    []emfMetricDefinition `json:"Metrics"`
+}
+
+type emfMetricDefinition struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+func (f *emfFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	doc := make(map[string]interface{}, len(entry.Data)+len(f.dimensions)+1)
+
+	definitions := make([]emfMetricDefinition, 0, len(emfMetrics))
+	for _, m := range emfMetrics {
+		if v, ok := entry.Data[m.name]; ok {
+			doc[m.name] = v
+			definitions = append(definitions, emfMetricDefinition{Name: m.name, Unit: m.unit})
+		}
+	}
+
+	dimensions := make([]string, 0, len(f.dimensions))
+	for k, v := range f.dimensions {
+		doc[k] = v
+		dimensions = append(dimensions, k)
+	}
+	sort.Strings(dimensions)
+
+	doc["_aws"] = emfMetadata{
+		Timestamp: entry.Time.UnixMilli(),
+		CloudWatchMetrics: []emfDirective{{
+			Namespace:  f.namespace,
+			Dimensions: [][]string{dimensions},
+			Metrics:    definitions,
+		}},
+	}
+
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
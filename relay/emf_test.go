@@ -0,0 +1,98 @@
+package relay_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+)
+
+type emfDocument struct {
+	AWS struct {
+		Timestamp         int64 `json:"Timestamp"`
+		CloudWatchMetrics []struct {
+			Namespace  string     `json:"Namespace"`
+			Dimensions [][]string `json:"Dimensions"`
+			Metrics    []struct {
+				Name string `json:"Name"`
+				Unit string `json:"Unit"`
+			} `json:"Metrics"`
+		} `json:"CloudWatchMetrics"`
+	} `json:"_aws"`
+	FunctionName string `json:"FunctionName"`
+	Relayed      int64  `json:"Relayed"`
+	Failed       int64  `json:"Failed"`
+	BytesRelayed int64  `json:"BytesRelayed"`
+}
+
+func readEMFDocuments(t *testing.T, out *bytes.Buffer) []emfDocument {
+	var docs []emfDocument
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		var doc emfDocument
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &doc))
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+func TestEMFEmitter(t *testing.T) {
+	profile := readTestdataFile(t, "testdata/profile.pprof")
+
+	remoteServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer remoteServer.Close()
+
+	metrics := relay.NewMetrics()
+	queue := relay.NewRemoteQueue(noopLogger(), &relay.RemoteQueueCfg{Metrics: metrics},
+		relay.NewRemoteClient(noopLogger(), &relay.RemoteClientCfg{Address: remoteServer.URL}))
+	require.NoError(t, queue.Start())
+
+	out := &bytes.Buffer{}
+	emf := relay.NewEMFEmitter(&relay.EMFCfg{
+		Dimensions: map[string]string{"FunctionName": "my-function"},
+		Output:     out,
+	}, metrics)
+
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodPost, "/ingest?name=my.app%7B%7D", bytes.NewReader(profile))
+		require.NoError(t, err)
+		require.NoError(t, queue.Send(req))
+	}
+	queue.Flush(context.Background())
+	emf.Emit()
+	emf.Emit()
+
+	docs := readEMFDocuments(t, out)
+	require.Len(t, docs, 2)
+
+	doc := docs[0]
+	require.Len(t, doc.AWS.CloudWatchMetrics, 1)
+	directive := doc.AWS.CloudWatchMetrics[0]
+	assert.Equal(t, "PyroscopeLambdaExtension", directive.Namespace)
+	assert.Equal(t, [][]string{{"FunctionName"}}, directive.Dimensions)
+	assert.NotZero(t, doc.AWS.Timestamp)
+	assert.Equal(t, "my-function", doc.FunctionName)
+
+	units := map[string]string{}
+	for _, m := range directive.Metrics {
+		units[m.Name] = m.Unit
+	}
+	assert.Equal(t, "Count", units["Relayed"])
+	assert.Equal(t, "Bytes", units["BytesRelayed"])
+	assert.Equal(t, "Milliseconds", units["FlushDuration"])
+
+	assert.Equal(t, int64(2), doc.Relayed)
+	assert.Equal(t, int64(2*len(profile)), doc.BytesRelayed)
+	assert.Equal(t, int64(0), doc.Failed)
+
+	assert.Equal(t, int64(0), docs[1].Relayed, "counters are emitted as deltas")
+	assert.Equal(t, "my-function", docs[1].FunctionName)
+}
@@ -0,0 +1,161 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+// Queue relays requests asynchronously, eg a RemoteQueue or a FanOut
+type Queue interface {
+	Relayer
+	Start() error
+	Stop(ctx context.Context) error
+	Flush(ctx context.Context)
+	DrainSpill()
+}
+
+// Destination is a named remote profiles are relayed to, through its own queue
+type Destination struct {
+	Name  string
+	Queue Queue
+}
+
+type FanOutCfg struct {
+	// FlushTimeout is how long Flush waits for each destination, defaults to 10s
+	// Destinations that take longer keep relaying their pending requests in the background, without blocking Send
+	FlushTimeout time.Duration
+}
+
+// FanOut relays every request to each of the destinations
+// Each destination has its own queue, retries and metrics, so that a slow or failing one doesn't hold back the others
+type FanOut struct {
+	log          *logrus.Entry
+	config       *FanOutCfg
+	destinations []Destination
+}
+
+func NewFanOut(log *logrus.Entry, config *FanOutCfg, destinations []Destination) *FanOut {
+	// Setup defaults
+	if config.FlushTimeout <= 0 {
+		config.FlushTimeout = time.Second * 10
+	}
+
+	return &FanOut{
+		log:          log.WithField("comp", "fanout"),
+		config:       config,
+		destinations: destinations,
+	}
+}
+
+// Send enqueues a copy of the request in each destination
+// Destinations are enqueued concurrently, so that one blocking on a full queue doesn't delay the others
+// It only fails if none of the destinations accepted the request
+func (f *FanOut) Send(req *http.Request) error {
+	if err := bufferBody(req); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+
+	sendErrs := make([]error, len(f.destinations))
+	var wg sync.WaitGroup
+	for i, d := range f.destinations {
+		r2, err := cloneForAttempt(req)
+		if err != nil {
+			sendErrs[i] = err
+			continue
+		}
+		wg.Add(1)
+		go func(i int, q Queue, r2 *http.Request) {
+			defer wg.Done()
+			sendErrs[i] = q.Send(r2)
+		}(i, d.Queue, r2)
+	}
+	wg.Wait()
+
+	var errs []error
+	for i, err := range sendErrs {
+		if err != nil {
+			name := f.destinations[i].Name
+			f.log.Errorf("Failed to relay request to destination '%s': %v", name, err)
+			errs = append(errs, fmt.Errorf("destination '%s': %w", name, err))
+		}
+	}
+
+	if len(errs) == len(f.destinations) {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+func (f *FanOut) Start() error {
+	for _, d := range f.destinations {
+		if err := d.Queue.Start(); err != nil {
+			return fmt.Errorf("destination '%s': %w", d.Name, err)
+		}
+	}
+	return nil
+}
+
+// Stop stops the queues concurrently
+func (f *FanOut) Stop(ctx context.Context) error {
+	var g errgroup.Group
+	for _, d := range f.destinations {
+		d := d
+		g.Go(func() error {
+			return d.Queue.Stop(ctx)
+		})
+	}
+	return g.Wait()
+}
+
+// Flush flushes the queues concurrently, waiting up to FlushTimeout for each
+// so it takes as long as the slowest destination, or FlushTimeout
+func (f *FanOut) Flush(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, d := range f.destinations {
+		wg.Add(1)
+		go func(d Destination) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, f.config.FlushTimeout)
+			defer cancel()
+
+			d.Queue.Flush(ctx)
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				f.log.Warnf("Destination '%s' wasn't flushed within %s, its requests keep being relayed in the background", d.Name, f.config.FlushTimeout)
+			}
+		}(d)
+	}
+	wg.Wait()
+}
+
+func (f *FanOut) DrainSpill() {
+	for _, d := range f.destinations {
+		d.Queue.DrainSpill()
+	}
+}
+
+// bufferBody reads the body into memory, unless it can already be replayed via GetBody
+func bufferBody(req *http.Request) error {
+	if isReplayable(req) {
+		return nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	_ = req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return nil
+}
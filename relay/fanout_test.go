@@ -0,0 +1,199 @@
+package relay_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+)
+
+func TestFanOut(t *testing.T) {
+	profile := readTestdataFile(t, "testdata/profile.pprof")
+
+	var okReceived int32
+	okServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body := new(bytes.Buffer)
+			_, _ = body.ReadFrom(r.Body)
+			assert.Equal(t, profile, body.Bytes())
+			assert.Equal(t, "tenant-a", r.Header.Get("X-Scope-OrgID"))
+			atomic.AddInt32(&okReceived, 1)
+		}),
+	)
+	t.Cleanup(okServer.Close)
+
+	// slow and failing, it shouldn't hold back the other destination
+	unblock := make(chan struct{})
+	var failingReceived int32
+	failingServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "tenant-b", r.Header.Get("X-Scope-OrgID"))
+			atomic.AddInt32(&failingReceived, 1)
+			<-unblock
+			w.WriteHeader(http.StatusBadRequest)
+		}),
+	)
+	t.Cleanup(failingServer.Close)
+
+	metrics := relay.NewMetrics()
+	newDestination := func(name string, address string, tenantID string) relay.Destination {
+		remoteClient := relay.NewRemoteClient(noopLogger(), &relay.RemoteClientCfg{Address: address, TenantID: tenantID})
+		return relay.Destination{
+			Name: name,
+			Queue: relay.NewRemoteQueue(noopLogger(), &relay.RemoteQueueCfg{
+				NumWorkers: 1,
+				QueueSize:  5,
+				Metrics:    metrics.Destination(name),
+			}, remoteClient),
+		}
+	}
+	fanOut := relay.NewFanOut(noopLogger(), &relay.FanOutCfg{}, []relay.Destination{
+		newDestination("ok", okServer.URL, "tenant-a"),
+		newDestination("failing", failingServer.URL, "tenant-b"),
+	})
+	require.NoError(t, fanOut.Start())
+
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest(http.MethodPost, "/ingest?name=my.app%7B%7D", bytes.NewReader(profile))
+		require.NoError(t, err)
+		require.NoError(t, fanOut.Send(req))
+	}
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&okReceived) == 3
+	}, time.Second, time.Millisecond*10)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&failingReceived))
+
+	close(unblock)
+	fanOut.Flush(context.Background())
+	assert.Equal(t, int32(3), atomic.LoadInt32(&failingReceived))
+	require.NoError(t, fanOut.Stop(context.Background()))
+
+	summary := metrics.Summary()
+	assert.Equal(t, int64(3), summary["sent"])
+	assert.Equal(t, int64(3), summary["failed"])
+	assert.Equal(t, map[string]map[string]int64{
+		"ok":      {"sent": 3, "failed": 0, "dropped": 0, "queueDepth": 0},
+		"failing": {"sent": 0, "failed": 3, "dropped": 0, "queueDepth": 0},
+	}, summary["destinations"])
+
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, httptest.NewRequest(http.MethodGet, relay.MetricsPath, nil))
+	body := w.Body.String()
+	assert.Contains(t, body, `pyroscope_extension_requests_sent_total{destination="ok"} 3`+"\n")
+	assert.Contains(t, body, `pyroscope_extension_requests_sent_total{destination="failing"} 0`+"\n")
+	assert.Contains(t, body, `pyroscope_extension_requests_failed_total{destination="failing",code="400"} 3`+"\n")
+}
+
+func TestFanOutQueueFull(t *testing.T) {
+	remoteServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(remoteServer.Close)
+
+	newQueue := func(size int) relay.Queue {
+		remoteClient := relay.NewRemoteClient(noopLogger(), &relay.RemoteClientCfg{Address: remoteServer.URL})
+		return relay.NewRemoteQueue(noopLogger(), &relay.RemoteQueueCfg{NumWorkers: 1, QueueSize: size}, remoteClient)
+	}
+	a, b := newQueue(1), newQueue(2)
+	fanOut := relay.NewFanOut(noopLogger(), &relay.FanOutCfg{}, []relay.Destination{{Name: "a", Queue: a}, {Name: "b", Queue: b}})
+
+	newRequest := func() *http.Request {
+		req, err := http.NewRequest(http.MethodPost, "/ingest", bytes.NewReader([]byte("profile")))
+		require.NoError(t, err)
+		return req
+	}
+	// the queues are not started yet, so they fill up
+	require.NoError(t, fanOut.Send(newRequest()))
+	require.NoError(t, fanOut.Send(newRequest()), "a destination still accepted it")
+	assert.ErrorIs(t, fanOut.Send(newRequest()), relay.ErrQueueFull)
+}
+
+// stubQueue is a Queue whose Send and Flush are provided by the test
+type stubQueue struct {
+	send  func(*http.Request) error
+	flush func(context.Context)
+}
+
+func (q *stubQueue) Send(req *http.Request) error   { return q.send(req) }
+func (q *stubQueue) Start() error                   { return nil }
+func (q *stubQueue) Stop(ctx context.Context) error { return nil }
+func (q *stubQueue) Flush(ctx context.Context)      { q.flush(ctx) }
+func (q *stubQueue) DrainSpill()                    {}
+
+func TestFanOutSendConcurrently(t *testing.T) {
+	// a blocks until b got the request, which never happens if they are enqueued one after the other
+	bSent := make(chan struct{})
+	var aTimedOut int32
+	a := &stubQueue{send: func(*http.Request) error {
+		select {
+		case <-bSent:
+			return nil
+		case <-time.After(time.Second):
+			atomic.StoreInt32(&aTimedOut, 1)
+			return relay.ErrQueueFull
+		}
+	}}
+	b := &stubQueue{send: func(*http.Request) error {
+		close(bSent)
+		return nil
+	}}
+	fanOut := relay.NewFanOut(noopLogger(), &relay.FanOutCfg{}, []relay.Destination{{Name: "a", Queue: a}, {Name: "b", Queue: b}})
+
+	req, err := http.NewRequest(http.MethodPost, "/ingest", bytes.NewReader([]byte("profile")))
+	require.NoError(t, err)
+	require.NoError(t, fanOut.Send(req))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&aTimedOut))
+}
+
+func TestFanOutFlushTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	defer close(unblock)
+	var flushed int32
+	stuck := &stubQueue{flush: func(ctx context.Context) {
+		select {
+		case <-unblock:
+		case <-ctx.Done():
+		}
+	}}
+	ok := &stubQueue{flush: func(context.Context) { atomic.AddInt32(&flushed, 1) }}
+	fanOut := relay.NewFanOut(noopLogger(), &relay.FanOutCfg{FlushTimeout: time.Millisecond * 50}, []relay.Destination{{Name: "stuck", Queue: stuck}, {Name: "ok", Queue: ok}})
+
+	start := time.Now()
+	fanOut.Flush(context.Background())
+	assert.Less(t, time.Since(start), time.Second, "it shouldn't wait for the stuck destination")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&flushed))
+}
+
+func TestFanOutSendAfterFlushTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	defer close(unblock)
+	stuck := relay.NewRemoteQueue(noopLogger(), &relay.RemoteQueueCfg{NumWorkers: 1, QueueSize: 10}, mockRelayer{fn: func(*http.Request) error {
+		<-unblock
+		return nil
+	}})
+	ok := relay.NewRemoteQueue(noopLogger(), &relay.RemoteQueueCfg{NumWorkers: 1, QueueSize: 10}, mockRelayer{fn: func(*http.Request) error {
+		return nil
+	}})
+	fanOut := relay.NewFanOut(noopLogger(), &relay.FanOutCfg{FlushTimeout: time.Millisecond * 50}, []relay.Destination{{Name: "stuck", Queue: stuck}, {Name: "ok", Queue: ok}})
+	require.NoError(t, fanOut.Start())
+
+	newRequest := func() *http.Request {
+		req, err := http.NewRequest(http.MethodPost, "/ingest", bytes.NewReader([]byte("profile")))
+		require.NoError(t, err)
+		return req
+	}
+	require.NoError(t, fanOut.Send(newRequest()))
+	fanOut.Flush(context.Background())
+
+	// the stuck destination is still relaying, which must not block the next requests
+	start := time.Now()
+	require.NoError(t, fanOut.Send(newRequest()))
+	assert.Less(t, time.Since(start), time.Millisecond*500)
+}
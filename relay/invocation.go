@@ -0,0 +1,118 @@
+package relay
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the labels describing the invocation a profile belongs to
+const (
+	RequestIDLabel = "request_id"
+	ColdStartLabel = "cold_start"
+	TraceIDLabel   = "trace_id"
+)
+
+// how many invocations are remembered, profiles are relayed shortly after being collected
+const maxTrackedInvocations = 16
+
+// Invocation is a single lambda invocation
+type Invocation struct {
+	RequestID          string
+	InvokedFunctionArn string
+	TraceID            string
+	ColdStart          bool
+	Start              time.Time
+	// End is zero while the invocation is in progress
+	End time.Time
+}
+
+// Labels returns the labels describing the invocation
+func (i *Invocation) Labels() map[string]string {
+	return map[string]string{
+		RequestIDLabel: i.RequestID,
+		ColdStartLabel: strconv.FormatBool(i.ColdStart),
+		TraceIDLabel:   i.TraceID,
+	}
+}
+
+// InvocationTracker keeps track of the most recent invocations
+// So that profiles can be matched to the invocation they were collected in
+type InvocationTracker struct {
+	mu          sync.Mutex
+	invocations []*Invocation
+	count       int
+}
+
+func NewInvocationTracker() *InvocationTracker {
+	return &InvocationTracker{}
+}
+
+// Start records the start of an invocation, which also ends the previous one
+// traceHeader is the value of the X-Amzn-Trace-Id header
+func (t *InvocationTracker) Start(requestID string, invokedFunctionArn string, traceHeader string, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if n := len(t.invocations); n > 0 && t.invocations[n-1].End.IsZero() {
+		t.invocations[n-1].End = at
+	}
+
+	t.invocations = append(t.invocations, &Invocation{
+		RequestID:          requestID,
+		InvokedFunctionArn: invokedFunctionArn,
+		TraceID:            parseTraceID(traceHeader),
+		ColdStart:          t.count == 0,
+		Start:              at,
+	})
+	t.count++
+
+	if len(t.invocations) > maxTrackedInvocations {
+		t.invocations = t.invocations[1:]
+	}
+}
+
+// End records the end of an invocation, eg when the runtime is done with it
+func (t *InvocationTracker) End(requestID string, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, inv := range t.invocations {
+		if inv.RequestID == requestID && inv.End.IsZero() {
+			inv.End = at
+		}
+	}
+}
+
+// Lookup returns the invocation the time range falls within, or nil if there's none
+// The range is compared with a second precision, since that's what's used by the clients
+func (t *InvocationTracker) Lookup(from time.Time, until time.Time) *Invocation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i := len(t.invocations) - 1; i >= 0; i-- {
+		inv := t.invocations[i]
+
+		end := inv.End
+		if end.IsZero() {
+			end = time.Now()
+		}
+		if from.Unix() >= inv.Start.Unix() && until.Unix() <= end.Add(time.Second-1).Unix() {
+			res := *inv
+			return &res
+		}
+	}
+	return nil
+}
+
+// parseTraceID extracts the root trace ID from the X-Amzn-Trace-Id header
+// eg 'Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1'
+func parseTraceID(header string) string {
+	for _, part := range strings.Split(header, ";") {
+		if kv := strings.SplitN(strings.TrimSpace(part), "=", 2); len(kv) == 2 && kv[0] == "Root" {
+			return kv[1]
+		}
+	}
+	return ""
+}
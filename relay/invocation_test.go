@@ -0,0 +1,88 @@
+package relay_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/flameql"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+)
+
+func TestInvocationTracker(t *testing.T) {
+	tracker := relay.NewInvocationTracker()
+	start := time.Unix(1655819920, 0)
+
+	tracker.Start("first", "arn", "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1", start)
+	tracker.End("first", start.Add(time.Second*5))
+	tracker.Start("second", "arn", "", start.Add(time.Second*10))
+
+	inv := tracker.Lookup(start, start.Add(time.Second*4))
+	require.NotNil(t, inv)
+	assert.Equal(t, "first", inv.RequestID)
+	assert.True(t, inv.ColdStart)
+	assert.Equal(t, "1-5759e988-bd862e3fe1be46a994272793", inv.TraceID)
+
+	inv = tracker.Lookup(start.Add(time.Second*10), start.Add(time.Second*12))
+	require.NotNil(t, inv)
+	assert.Equal(t, "second", inv.RequestID)
+	assert.False(t, inv.ColdStart)
+
+	assert.Nil(t, tracker.Lookup(start, start.Add(time.Second*12)), "spans multiple invocations")
+	assert.Nil(t, tracker.Lookup(start.Add(time.Second*6), start.Add(time.Second*8)), "between invocations")
+}
+
+func TestControllerInjectsInvocationLabels(t *testing.T) {
+	start := time.Now().Add(-time.Second * 5)
+	tracker := relay.NewInvocationTracker()
+	tracker.Start("abc", "arn", "Root=1-5759e988-bd862e3fe1be46a994272793", start)
+
+	// pyroscope-go sends nanoseconds, older clients seconds
+	testCases := []struct {
+		name   string
+		format func(time.Time) int64
+	}{
+		{name: "seconds", format: time.Time.Unix},
+		{name: "milliseconds", format: time.Time.UnixMilli},
+		{name: "microseconds", format: time.Time.UnixMicro},
+		{name: "nanoseconds", format: time.Time.UnixNano},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			relayed := make(chan *http.Request, 1)
+			queue := relay.NewRemoteQueue(noopLogger(), &relay.RemoteQueueCfg{}, mockRelayer{
+				fn: func(r *http.Request) error {
+					relayed <- r
+					return nil
+				},
+			})
+			queue.Start()
+
+			ctrl := relay.NewController(noopLogger(), queue, tracker)
+
+			from := strconv.FormatInt(tc.format(start), 10)
+			until := strconv.FormatInt(tc.format(start.Add(time.Second)), 10)
+			req := httptest.NewRequest(http.MethodPost, "/ingest?name=my.app%7B%7D&from="+from+"&until="+until, bytes.NewReader(nil))
+			w := httptest.NewRecorder()
+			ctrl.RelayRequest(w, req)
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			r := <-relayed
+			parsed, err := flameql.ParseKey(r.URL.Query().Get("name"))
+			require.NoError(t, err)
+			assert.Equal(t, map[string]string{
+				"__name__":           "my.app",
+				relay.RequestIDLabel: "abc",
+				relay.ColdStartLabel: "true",
+				relay.TraceIDLabel:   "1-5759e988-bd862e3fe1be46a994272793",
+			}, parsed.Labels())
+		})
+	}
+}
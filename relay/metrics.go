@@ -0,0 +1,488 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MetricsPath is where the relay server exposes the metrics
+const MetricsPath = "/metrics"
+
+const metricsPrefix = "pyroscope_extension_"
+
+// failedCodeError labels failures that didn't get a response, eg a timeout
+const failedCodeError = "error"
+
+// Reasons requests are abandoned for
+const (
+	// abandonedDeadline are the pending requests that were not relayed before the shutdown deadline
+	abandonedDeadline = "deadline"
+	// abandonedStopped are the requests sent once the queue was stopped
+	abandonedStopped = "stopped"
+)
+
+var (
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	flushBuckets   = []float64{.001, .01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+)
+
+// Metrics keeps track of what happens to the relayed profiles
+// It's exposed in the Prometheus text format, all methods are safe to call on a nil Metrics
+type Metrics struct {
+	// filtered, sampledOut and rateLimited are recorded before the destinations, so they're never recorded by them
+	filtered    atomic.Int64
+	sampledOut  atomic.Int64
+	rateLimited atomic.Int64
+	enqueued    atomic.Int64
+	dropped     atomic.Int64
+	// abandoned at the shutdown deadline or after the queue was stopped, they are told apart by a 'reason' label
+	abandonedDeadline atomic.Int64
+	abandonedStopped  atomic.Int64
+	spilled           atomic.Int64
+	retried           atomic.Int64
+	sent              atomic.Int64
+	sentBytes         atomic.Int64
+
+	failedMu sync.Mutex
+	failed   map[string]int64
+
+	sendDuration  *histogram
+	flushDuration *histogram
+
+	queueMu sync.Mutex
+	queue   func() (depth int64, bytes int64)
+
+	// destination labels the metrics of a destination, see Destination
+	destination    string
+	destinationsMu sync.Mutex
+	destinations   []*Metrics
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		failed:        make(map[string]int64),
+		sendDuration:  newHistogram(latencyBuckets),
+		flushDuration: newHistogram(flushBuckets),
+	}
+}
+
+// Destination returns the metrics of a destination, which are exposed with a 'destination' label
+// Once there are destinations, metrics are only recorded by them, and summed up in Summary
+func (m *Metrics) Destination(name string) *Metrics {
+	if m == nil {
+		return nil
+	}
+
+	d := NewMetrics()
+	d.destination = name
+	m.destinationsMu.Lock()
+	m.destinations = append(m.destinations, d)
+	m.destinationsMu.Unlock()
+	return d
+}
+
+// sets returns the metrics to expose, either the destinations' or its own
+func (m *Metrics) sets() []*Metrics {
+	m.destinationsMu.Lock()
+	defer m.destinationsMu.Unlock()
+
+	if len(m.destinations) == 0 {
+		return []*Metrics{m}
+	}
+	return append([]*Metrics(nil), m.destinations...)
+}
+
+// labels formats the labels of a series, including the destination if any
+func (m *Metrics) labels(pairs ...string) string {
+	if m.destination != "" {
+		pairs = append([]string{"destination", m.destination}, pairs...)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString("{")
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, "%s=%q", pairs[i], pairs[i+1])
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+func (m *Metrics) requestFiltered() {
+	if m != nil {
+		m.filtered.Add(1)
+	}
+}
+
+func (m *Metrics) requestSampledOut() {
+	if m != nil {
+		m.sampledOut.Add(1)
+	}
+}
+
+func (m *Metrics) requestRateLimited() {
+	if m != nil {
+		m.rateLimited.Add(1)
+	}
+}
+
+func (m *Metrics) requestEnqueued() {
+	if m != nil {
+		m.enqueued.Add(1)
+	}
+}
+
+func (m *Metrics) requestDropped() {
+	if m != nil {
+		m.dropped.Add(1)
+	}
+}
+
+// requestAbandoned records a request that won't be relayed, reason is abandonedDeadline or abandonedStopped
+func (m *Metrics) requestAbandoned(reason string) {
+	if m == nil {
+		return
+	}
+	if reason == abandonedStopped {
+		m.abandonedStopped.Add(1)
+	} else {
+		m.abandonedDeadline.Add(1)
+	}
+}
+
+func (m *Metrics) requestSpilled() {
+	if m != nil {
+		m.spilled.Add(1)
+	}
+}
+
+func (m *Metrics) requestRetried() {
+	if m != nil {
+		m.retried.Add(1)
+	}
+}
+
+// requestRelayed records the outcome of relaying a request
+func (m *Metrics) requestRelayed(size int64, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	m.sendDuration.observe(d.Seconds())
+	if err == nil {
+		m.sent.Add(1)
+		m.sentBytes.Add(size)
+		return
+	}
+
+	code := failedCodeError
+	var resErr *ResponseError
+	if errors.As(err, &resErr) {
+		code = strconv.Itoa(resErr.StatusCode)
+	}
+	m.failedMu.Lock()
+	m.failed[code]++
+	m.failedMu.Unlock()
+}
+
+func (m *Metrics) flushed(d time.Duration) {
+	if m != nil {
+		m.flushDuration.observe(d.Seconds())
+	}
+}
+
+// observeQueue sets where the queue depth gauges are read from
+func (m *Metrics) observeQueue(fn func() (depth int64, bytes int64)) {
+	if m == nil {
+		return
+	}
+	m.queueMu.Lock()
+	m.queue = fn
+	m.queueMu.Unlock()
+}
+
+func (m *Metrics) queueState() (depth int64, bytes int64) {
+	m.queueMu.Lock()
+	fn := m.queue
+	m.queueMu.Unlock()
+	if fn == nil {
+		return 0, 0
+	}
+	return fn()
+}
+
+func (m *Metrics) failedByCode() map[string]int64 {
+	m.failedMu.Lock()
+	defer m.failedMu.Unlock()
+
+	failed := make(map[string]int64, len(m.failed))
+	for k, v := range m.failed {
+		failed[k] = v
+	}
+	return failed
+}
+
+// metricsSnapshot are the metric values at a point in time
+type metricsSnapshot struct {
+	enqueued          int64
+	dropped           int64
+	abandonedDeadline int64
+	abandonedStopped  int64
+	spilled           int64
+	retried           int64
+	sent              int64
+	sentBytes         int64
+	failed            int64
+	flushDuration     time.Duration
+	queueDepth        int64
+	queueBytes        int64
+}
+
+// snapshot sums up the metrics of the destinations, if any
+func (m *Metrics) snapshot() metricsSnapshot {
+	var total metricsSnapshot
+	for _, set := range m.sets() {
+		s := set.ownSnapshot()
+		total.enqueued += s.enqueued
+		total.dropped += s.dropped
+		total.abandonedDeadline += s.abandonedDeadline
+		total.abandonedStopped += s.abandonedStopped
+		total.spilled += s.spilled
+		total.retried += s.retried
+		total.sent += s.sent
+		total.sentBytes += s.sentBytes
+		total.failed += s.failed
+		total.flushDuration += s.flushDuration
+		total.queueDepth += s.queueDepth
+		total.queueBytes += s.queueBytes
+	}
+	return total
+}
+
+func (m *Metrics) ownSnapshot() metricsSnapshot {
+	var failed int64
+	for _, v := range m.failedByCode() {
+		failed += v
+	}
+	depth, bytes := m.queueState()
+
+	return metricsSnapshot{
+		enqueued:          m.enqueued.Load(),
+		dropped:           m.dropped.Load(),
+		abandonedDeadline: m.abandonedDeadline.Load(),
+		abandonedStopped:  m.abandonedStopped.Load(),
+		spilled:           m.spilled.Load(),
+		retried:           m.retried.Load(),
+		sent:              m.sent.Load(),
+		sentBytes:         m.sentBytes.Load(),
+		failed:            failed,
+		flushDuration:     m.flushDuration.total(),
+		queueDepth:        depth,
+		queueBytes:        bytes,
+	}
+}
+
+// Summary returns the metrics as log fields, eg to be logged on shutdown
+func (m *Metrics) Summary() logrus.Fields {
+	if m == nil {
+		return logrus.Fields{}
+	}
+
+	s := m.snapshot()
+	sets := m.sets()
+	failedByCode := map[string]int64{}
+	var sendDuration, sendCount float64
+	for _, set := range sets {
+		for code, v := range set.failedByCode() {
+			failedByCode[code] += v
+		}
+		sum, count := set.sendDuration.sumCount()
+		sendDuration += sum
+		sendCount += float64(count)
+	}
+	var avgSendDuration time.Duration
+	if sendCount > 0 {
+		avgSendDuration = time.Duration(sendDuration / sendCount * float64(time.Second))
+	}
+
+	fields := logrus.Fields{
+		"filtered":    m.filtered.Load(),
+		"sampledOut":  m.sampledOut.Load(),
+		"rateLimited": m.rateLimited.Load(),
+		"enqueued":    s.enqueued,
+		"dropped":     s.dropped,
+		"abandoned":   s.abandonedDeadline + s.abandonedStopped,
+		"abandonedByReason": map[string]int64{
+			abandonedDeadline: s.abandonedDeadline,
+			abandonedStopped:  s.abandonedStopped,
+		},
+		"spilled":         s.spilled,
+		"retried":         s.retried,
+		"sent":            s.sent,
+		"sentBytes":       s.sentBytes,
+		"failed":          s.failed,
+		"failedByCode":    failedByCode,
+		"avgSendDuration": avgSendDuration.String(),
+		"flushDuration":   s.flushDuration.String(),
+		"queueDepth":      s.queueDepth,
+		"queueBytes":      s.queueBytes,
+	}
+	if sets[0].destination != "" {
+		destinations := map[string]map[string]int64{}
+		for _, set := range sets {
+			ds := set.ownSnapshot()
+			destinations[set.destination] = map[string]int64{
+				"sent":       ds.sent,
+				"failed":     ds.failed,
+				"dropped":    ds.dropped,
+				"queueDepth": ds.queueDepth,
+			}
+		}
+		fields["destinations"] = destinations
+	}
+	return fields
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WritePrometheus(w)
+}
+
+// WritePrometheus writes the metrics in the Prometheus text format
+func (m *Metrics) WritePrometheus(w io.Writer) {
+	if m == nil {
+		return
+	}
+
+	sets := m.sets()
+	writeMetric(w, []*Metrics{m}, "requests_filtered_total", "counter", "Requests dropped by the relabel rules.", func(s *Metrics) int64 { return s.filtered.Load() })
+	writeMetric(w, []*Metrics{m}, "requests_sampled_out_total", "counter", "Requests dropped because the execution environment was sampled out.", func(s *Metrics) int64 { return s.sampledOut.Load() })
+	writeMetric(w, []*Metrics{m}, "requests_rate_limited_total", "counter", "Requests dropped because they were over the rate limits.", func(s *Metrics) int64 { return s.rateLimited.Load() })
+	writeMetric(w, sets, "requests_enqueued_total", "counter", "Requests added to the relay queue.", func(s *Metrics) int64 { return s.enqueued.Load() })
+	writeMetric(w, sets, "requests_dropped_total", "counter", "Requests dropped because the relay queue was full.", func(s *Metrics) int64 { return s.dropped.Load() })
+
+	name := writeHeader(w, "requests_abandoned_total", "counter", "Requests that were not relayed, by reason: pending at the shutdown deadline or sent once the queue was stopped.")
+	for _, s := range sets {
+		fmt.Fprintf(w, "%s%s %d\n", name, s.labels("reason", abandonedDeadline), s.abandonedDeadline.Load())
+		fmt.Fprintf(w, "%s%s %d\n", name, s.labels("reason", abandonedStopped), s.abandonedStopped.Load())
+	}
+
+	writeMetric(w, sets, "requests_spilled_total", "counter", "Requests stored on disk to be relayed later.", func(s *Metrics) int64 { return s.spilled.Load() })
+	writeMetric(w, sets, "requests_retried_total", "counter", "Attempts to relay a request that were retried.", func(s *Metrics) int64 { return s.retried.Load() })
+	writeMetric(w, sets, "requests_sent_total", "counter", "Requests successfully relayed to the remote.", func(s *Metrics) int64 { return s.sent.Load() })
+	writeMetric(w, sets, "sent_bytes_total", "counter", "Size of the bodies successfully relayed to the remote.", func(s *Metrics) int64 { return s.sentBytes.Load() })
+
+	name = writeHeader(w, "requests_failed_total", "counter", "Requests that failed to be relayed, by status code.")
+	for _, s := range sets {
+		failed := s.failedByCode()
+		codes := make([]string, 0, len(failed))
+		for code := range failed {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			fmt.Fprintf(w, "%s%s %d\n", name, s.labels("code", code), failed[code])
+		}
+	}
+
+	name = writeHeader(w, "send_duration_seconds", "histogram", "Time spent relaying a request, including retries.")
+	for _, s := range sets {
+		s.sendDuration.write(w, name, s.labels)
+	}
+	name = writeHeader(w, "flush_duration_seconds", "histogram", "Time the relay queue blocked waiting for a flush.")
+	for _, s := range sets {
+		s.flushDuration.write(w, name, s.labels)
+	}
+
+	writeMetric(w, sets, "queue_depth", "gauge", "Requests waiting in the relay queue.", func(s *Metrics) int64 {
+		depth, _ := s.queueState()
+		return depth
+	})
+	writeMetric(w, sets, "queue_bytes", "gauge", "Size of the requests waiting in the relay queue.", func(s *Metrics) int64 {
+		_, bytes := s.queueState()
+		return bytes
+	})
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric, it returns its full name
+func writeHeader(w io.Writer, name string, typ string, help string) string {
+	name = metricsPrefix + name
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	return name
+}
+
+func writeMetric(w io.Writer, sets []*Metrics, name string, typ string, help string, value func(*Metrics) int64) {
+	name = writeHeader(w, name, typ, help)
+	for _, s := range sets {
+		fmt.Fprintf(w, "%s%s %d\n", name, s.labels(), value(s))
+	}
+}
+
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) total() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return time.Duration(h.sum * float64(time.Second))
+}
+
+func (h *histogram) sumCount() (float64, uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sum, h.count
+}
+
+// write writes the series of the histogram, labels formats the labels of each series
+func (h *histogram) write(w io.Writer, name string, labels func(pairs ...string) string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, labels("le", strconv.FormatFloat(b, 'g', -1, 64)), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, labels("le", "+Inf"), h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels(), strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels(), h.count)
+}
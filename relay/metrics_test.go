@@ -0,0 +1,71 @@
+package relay_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+)
+
+func TestMetrics(t *testing.T) {
+	profile := readTestdataFile(t, "testdata/profile.pprof")
+
+	fail := false
+	remoteServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if fail {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}),
+	)
+	defer remoteServer.Close()
+
+	metrics := relay.NewMetrics()
+	remoteClient := relay.NewRemoteClient(noopLogger(), &relay.RemoteClientCfg{Address: remoteServer.URL})
+	queue := relay.NewRemoteQueue(noopLogger(), &relay.RemoteQueueCfg{
+		NumWorkers: 1,
+		QueueSize:  1,
+		Metrics:    metrics,
+	}, remoteClient)
+
+	newRequest := func() *http.Request {
+		req, err := http.NewRequest(http.MethodPost, "/ingest?name=my.app%7B%7D", bytes.NewReader(profile))
+		require.NoError(t, err)
+		return req
+	}
+
+	// the queue is not started yet, so the second request doesn't fit
+	require.NoError(t, queue.Send(newRequest()))
+	require.ErrorIs(t, queue.Send(newRequest()), relay.ErrQueueFull)
+
+	require.NoError(t, queue.Start())
+	queue.Flush(context.Background())
+
+	fail = true
+	require.NoError(t, queue.Send(newRequest()))
+	queue.Flush(context.Background())
+
+	summary := metrics.Summary()
+	assert.Equal(t, int64(2), summary["enqueued"])
+	assert.Equal(t, int64(1), summary["dropped"])
+	assert.Equal(t, int64(1), summary["sent"])
+	assert.Equal(t, int64(len(profile)), summary["sentBytes"])
+	assert.Equal(t, int64(1), summary["failed"])
+	assert.Equal(t, map[string]int64{"503": 1}, summary["failedByCode"])
+
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, httptest.NewRequest(http.MethodGet, relay.MetricsPath, nil))
+	body := w.Body.String()
+	assert.Contains(t, body, "pyroscope_extension_requests_sent_total 1\n")
+	assert.Contains(t, body, "pyroscope_extension_requests_dropped_total 1\n")
+	assert.Contains(t, body, `pyroscope_extension_requests_failed_total{code="503"} 1`+"\n")
+	assert.Contains(t, body, `pyroscope_extension_send_duration_seconds_bucket{le="+Inf"} 2`+"\n")
+	assert.Contains(t, body, "pyroscope_extension_flush_duration_seconds_count 2\n")
+	assert.Contains(t, body, "pyroscope_extension_queue_depth 0\n")
+}
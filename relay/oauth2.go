@@ -0,0 +1,174 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var ErrFetchingToken = errors.New("failed to fetch oauth2 token")
+
+// OAuth2Cfg configures the OAuth2 client credentials grant
+// See https://www.rfc-editor.org/rfc/rfc6749#section-4.4
+type OAuth2Cfg struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	// Audience is sent as the 'audience' parameter, which some providers (eg Auth0) require
+	Audience string
+	// AuthInBody sends the client credentials as form parameters rather than via basic auth
+	AuthInBody bool
+	// ExpiryMargin is how long before they expire tokens are refreshed
+	ExpiryMargin time.Duration
+	Timeout      time.Duration
+}
+
+// OAuth2CredentialsProvider provides bearer tokens obtained with the client credentials grant
+// Tokens are cached until they are about to expire, or the remote rejects them
+type OAuth2CredentialsProvider struct {
+	config *OAuth2Cfg
+	log    *logrus.Entry
+	client *http.Client
+
+	mu    sync.Mutex
+	token string
+	// refreshAt is when the token is fetched again, expiresAt when it can't be used anymore
+	// both are zero for tokens without expiry
+	refreshAt time.Time
+	expiresAt time.Time
+}
+
+type oauth2TokenResponse struct {
+	AccessToken string      `json:"access_token"`
+	TokenType   string      `json:"token_type"`
+	ExpiresIn   json.Number `json:"expires_in"`
+}
+
+func NewOAuth2CredentialsProvider(log *logrus.Entry, config *OAuth2Cfg) *OAuth2CredentialsProvider {
+	return newOAuth2CredentialsProvider(log, config, http.DefaultTransport)
+}
+
+func newOAuth2CredentialsProvider(log *logrus.Entry, config *OAuth2Cfg, transport http.RoundTripper) *OAuth2CredentialsProvider {
+	// Setup defaults
+	if config.ExpiryMargin <= 0 {
+		config.ExpiryMargin = time.Second * 30
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = time.Second * 10
+	}
+
+	return &OAuth2CredentialsProvider{
+		config: config,
+		log:    log.WithField("comp", "oauth2"),
+		client: &http.Client{Timeout: config.Timeout, Transport: transport},
+	}
+}
+
+// Credentials returns the cached token, fetching a new one if it's about to expire
+// If fetching fails, the previous token is returned as long as it hasn't expired
+func (p *OAuth2CredentialsProvider) Credentials(ctx context.Context) (Credentials, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if p.token != "" && (p.refreshAt.IsZero() || now.Before(p.refreshAt)) {
+		return Credentials{Token: p.token}, nil
+	}
+
+	if err := p.fetch(ctx, now); err != nil {
+		if p.token != "" && now.Before(p.expiresAt) {
+			p.log.Error("Failed to refresh token, using the previous one: ", err)
+			return Credentials{Token: p.token}, nil
+		}
+		return Credentials{}, err
+	}
+	return Credentials{Token: p.token}, nil
+}
+
+// Invalidate drops the token, unless it was already refreshed
+func (p *OAuth2CredentialsProvider) Invalidate(rejected Credentials) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.token == rejected.Token {
+		p.token = ""
+	}
+}
+
+func (p *OAuth2CredentialsProvider) fetch(ctx context.Context, now time.Time) error {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if len(p.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(p.config.Scopes, " "))
+	}
+	if p.config.Audience != "" {
+		form.Set("audience", p.config.Audience)
+	}
+	if p.config.AuthInBody {
+		form.Set("client_id", p.config.ClientID)
+		form.Set("client_secret", p.config.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFetchingToken, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if !p.config.AuthInBody {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFetchingToken, err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFetchingToken, err)
+	}
+	if !(res.StatusCode >= 200 && res.StatusCode < 300) {
+		return fmt.Errorf("%w: status code: '%d'. body: '%s'", ErrFetchingToken, res.StatusCode, body)
+	}
+
+	var token oauth2TokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return fmt.Errorf("%w: invalid response: %v", ErrFetchingToken, err)
+	}
+	if token.AccessToken == "" {
+		return fmt.Errorf("%w: response has no access_token", ErrFetchingToken)
+	}
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return fmt.Errorf("%w: unsupported token type '%s'", ErrFetchingToken, token.TokenType)
+	}
+
+	var expiresIn time.Duration
+	if token.ExpiresIn != "" {
+		secs, err := token.ExpiresIn.Int64()
+		if err != nil {
+			return fmt.Errorf("%w: invalid expires_in '%s'", ErrFetchingToken, token.ExpiresIn)
+		}
+		expiresIn = time.Duration(secs) * time.Second
+	}
+
+	p.token = token.AccessToken
+	p.refreshAt, p.expiresAt = time.Time{}, time.Time{}
+	if expiresIn > 0 {
+		p.expiresAt = now.Add(expiresIn)
+		// short lived tokens are used for at least half their lifetime
+		p.refreshAt = p.expiresAt.Add(-minDuration(p.config.ExpiryMargin, expiresIn/2))
+	}
+	p.log.Debugf("Fetched token, expires at '%s'", p.expiresAt)
+	return nil
+}
@@ -0,0 +1,229 @@
+package relay_test
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+)
+
+// fakeTokenServer issues 'token-<n>' tokens with the client credentials grant
+// Invalid token requests are recorded, to be checked from the test with err
+type fakeTokenServer struct {
+	expiresIn interface{}
+	status    int32
+	issued    int32
+
+	mu   sync.Mutex
+	errs []error
+}
+
+func (f *fakeTokenServer) err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return errors.Join(f.errs...)
+}
+
+func (f *fakeTokenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err == nil && r.PostForm.Get("grant_type") != "client_credentials" {
+		err = fmt.Errorf("unexpected grant type '%s'", r.PostForm.Get("grant_type"))
+	}
+	if err != nil {
+		f.mu.Lock()
+		f.errs = append(f.errs, err)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != "id" || clientSecret != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if status := atomic.LoadInt32(&f.status); status != 0 {
+		w.WriteHeader(int(status))
+		return
+	}
+
+	n := atomic.AddInt32(&f.issued, 1)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": fmt.Sprintf("token-%d", n),
+		"token_type":   "Bearer",
+		"expires_in":   f.expiresIn,
+		"scope":        r.PostForm.Get("scope"),
+	})
+}
+
+func TestOAuth2CredentialsProvider(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeTokenServer{expiresIn: 3600}
+	tokenServer := httptest.NewServer(fake)
+	defer tokenServer.Close()
+	provider := relay.NewOAuth2CredentialsProvider(noopLogger(), &relay.OAuth2Cfg{TokenURL: tokenServer.URL, ClientID: "id", ClientSecret: "secret"})
+
+	creds, err := provider.Credentials(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, relay.Credentials{Token: "token-1"}, creds)
+
+	creds, err = provider.Credentials(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", creds.Token, "token is cached until it's about to expire")
+
+	provider.Invalidate(creds)
+	creds, err = provider.Credentials(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "token-2", creds.Token, "rejected tokens are refreshed")
+	assert.NoError(t, fake.err())
+}
+
+func TestOAuth2CredentialsProviderExpiry(t *testing.T) {
+	ctx := context.Background()
+	// expires_in is sometimes a string
+	fake := &fakeTokenServer{expiresIn: "2"}
+	tokenServer := httptest.NewServer(fake)
+	defer tokenServer.Close()
+	provider := relay.NewOAuth2CredentialsProvider(noopLogger(), &relay.OAuth2Cfg{
+		TokenURL:     tokenServer.URL,
+		ClientID:     "id",
+		ClientSecret: "secret",
+		AuthInBody:   true,
+		ExpiryMargin: time.Minute,
+	})
+
+	creds, err := provider.Credentials(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", creds.Token)
+
+	// the margin is capped at half the lifetime of the token
+	creds, _ = provider.Credentials(ctx)
+	assert.Equal(t, "token-1", creds.Token)
+
+	time.Sleep(time.Millisecond * 1100)
+	atomic.StoreInt32(&fake.status, http.StatusServiceUnavailable)
+	creds, err = provider.Credentials(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", creds.Token, "the previous token is used until it expires")
+
+	atomic.StoreInt32(&fake.status, 0)
+	creds, err = provider.Credentials(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "token-2", creds.Token, "tokens are refreshed before they expire")
+	assert.NoError(t, fake.err())
+}
+
+func TestOAuth2CredentialsProviderError(t *testing.T) {
+	tokenServer := httptest.NewServer(&fakeTokenServer{expiresIn: 3600})
+	defer tokenServer.Close()
+	provider := relay.NewOAuth2CredentialsProvider(noopLogger(), &relay.OAuth2Cfg{TokenURL: tokenServer.URL, ClientID: "id", ClientSecret: "wrong"})
+
+	_, err := provider.Credentials(context.Background())
+	assert.ErrorIs(t, err, relay.ErrFetchingToken)
+}
+
+func TestRemoteClientOAuth2(t *testing.T) {
+	fake := &fakeTokenServer{expiresIn: 3600}
+	tokenServer := httptest.NewServer(fake)
+	defer tokenServer.Close()
+
+	remoteServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "Bearer token-1", r.Header.Get("Authorization"))
+		}),
+	)
+	defer remoteServer.Close()
+
+	remoteClient := relay.NewRemoteClient(noopLogger(), &relay.RemoteClientCfg{
+		Address: remoteServer.URL,
+		OAuth2: &relay.OAuth2Cfg{
+			TokenURL:     tokenServer.URL,
+			ClientID:     "id",
+			ClientSecret: "secret",
+			Scopes:       []string{"profiles:write"},
+		},
+	})
+
+	req, err := http.NewRequest(http.MethodPost, "/ingest", nil)
+	require.NoError(t, err)
+	assert.NoError(t, remoteClient.Send(req))
+	assert.NoError(t, fake.err())
+}
+
+func TestRemoteClientOAuth2WithTLS(t *testing.T) {
+	remoteServer := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "Bearer token-1", r.Header.Get("Authorization"))
+		}),
+	)
+	defer remoteServer.Close()
+	caFile := writeFile(t, "ca.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: remoteServer.Certificate().Raw}))
+	// the httptest certificate is valid for example.com
+	tlsCfg := &relay.TLSCfg{CAFile: caFile, ServerName: "example.com"}
+
+	t.Run("token endpoint", func(t *testing.T) {
+		fake := &fakeTokenServer{expiresIn: 3600}
+		tokenServer := httptest.NewServer(fake)
+		defer tokenServer.Close()
+
+		remoteClient := relay.NewRemoteClient(noopLogger(), &relay.RemoteClientCfg{
+			Address: remoteServer.URL,
+			TLS:     tlsCfg,
+			OAuth2:  &relay.OAuth2Cfg{TokenURL: tokenServer.URL, ClientID: "id", ClientSecret: "secret"},
+		})
+
+		req, err := http.NewRequest(http.MethodPost, "/ingest", nil)
+		require.NoError(t, err)
+		assert.NoError(t, remoteClient.Send(req))
+		assert.NoError(t, fake.err())
+	})
+
+	t.Run("the remote server name isn't used for the token endpoint", func(t *testing.T) {
+		var mu sync.Mutex
+		var serverNames []string
+		tokenServer := httptest.NewUnstartedServer(&fakeTokenServer{expiresIn: 3600})
+		tokenServer.TLS = &tls.Config{
+			GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				serverNames = append(serverNames, hello.ServerName)
+				return nil, nil
+			},
+		}
+		tokenServer.StartTLS()
+		defer tokenServer.Close()
+
+		remoteClient := relay.NewRemoteClient(noopLogger(), &relay.RemoteClientCfg{
+			Address: remoteServer.URL,
+			TLS:     tlsCfg,
+			OAuth2:  &relay.OAuth2Cfg{TokenURL: tokenServer.URL, ClientID: "id", ClientSecret: "secret"},
+		})
+
+		// the token endpoint certificate isn't trusted by the system roots, so the request fails
+		req, err := http.NewRequest(http.MethodPost, "/ingest", nil)
+		require.NoError(t, err)
+		assert.Error(t, remoteClient.Send(req))
+
+		mu.Lock()
+		defer mu.Unlock()
+		require.NotEmpty(t, serverNames)
+		assert.NotContains(t, serverNames, "example.com")
+	})
+}
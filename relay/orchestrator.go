@@ -3,18 +3,30 @@ package relay
 // Orchestrator orchestrates the start/shutdown of underlying components
 import (
 	"context"
+	"errors"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 )
 
-type Orchestrator struct {
-	log *logrus.Entry
-
+type OrchestratorCfg struct {
 	// TODO(eh-am): take a generic startstopper
-	queue        *RemoteQueue
-	server       *Server
-	selfProfiler StartStopper
+	Queue  Queue
+	Server *Server
+	// ExtraServers are optional servers (eg OTLP receivers) with the same lifecycle as Server
+	ExtraServers []*Server
+	SelfProfiler StartStopper
+	// Drainer, if set, keeps the servers accepting profiles on shutdown until the clients flushed theirs, up to GracePeriod
+	Drainer     *Drainer
+	GracePeriod time.Duration
+	// Batcher, if set, is flushed once the servers are stopped, before the queue is
+	Batcher *Batcher
+}
+
+type Orchestrator struct {
+	log    *logrus.Entry
+	config *OrchestratorCfg
 }
 
 type StartStopper interface {
@@ -22,50 +34,66 @@ type StartStopper interface {
 	Stop(context.Context) error
 }
 
-func NewOrchestrator(log *logrus.Entry, queue *RemoteQueue, server *Server, selfProfiler StartStopper) *Orchestrator {
+// NewOrchestrator creates an orchestrator
+func NewOrchestrator(log *logrus.Entry, config *OrchestratorCfg) *Orchestrator {
 	log = log.WithField("comp", "orchestrator")
 
 	return &Orchestrator{
-		log:          log,
-		queue:        queue,
-		server:       server,
-		selfProfiler: selfProfiler,
+		log:    log,
+		config: config,
 	}
 }
 
 func (o *Orchestrator) Start() error {
 	o.log.Debug("Starting queue")
-	err := o.queue.Start()
+	err := o.config.Queue.Start()
 	if err != nil {
 		return err
 	}
 
 	o.log.Debug("Starting self profiler")
-	err = o.selfProfiler.Start()
+	err = o.config.SelfProfiler.Start()
 	if err != nil {
 		o.log.Error("Error starting self profiler", err)
 	}
 
 	o.log.Debug("Starting Server")
-	return o.server.Start()
+	var g errgroup.Group
+	for _, s := range o.config.ExtraServers {
+		g.Go(s.Start)
+	}
+	g.Go(o.config.Server.Start)
+	return g.Wait()
 }
 
-func (o *Orchestrator) Shutdown() error {
+// Shutdown stops the components in the order profiles flow through them, so that none is lost on the way
+// The servers keep accepting profiles while the clients are drained, then the pending batches
+// go to the queue, whose pending requests are relayed until ctx is done
+func (o *Orchestrator) Shutdown(ctx context.Context) error {
 	o.log.Debug("Shutting down")
 
-	ctx := context.Background()
-	g, _ := errgroup.WithContext(context.Background())
+	if o.config.Drainer != nil {
+		o.config.Drainer.Drain(ctx, o.config.GracePeriod)
+	}
 
-	// TODO(eh-am): validate this can indeed be done concurrently
-	g.Go(func() error {
-		return o.selfProfiler.Stop(ctx)
-	})
+	// servers wait for the requests being handled, which are enqueued before they respond
+	var g errgroup.Group
 	g.Go(func() error {
-		return o.server.Stop(ctx)
+		return o.config.SelfProfiler.Stop(ctx)
 	})
 	g.Go(func() error {
-		return o.queue.Stop(ctx)
+		return o.config.Server.Stop(ctx)
 	})
+	for _, s := range o.config.ExtraServers {
+		s := s
+		g.Go(func() error {
+			return s.Stop(ctx)
+		})
+	}
+	err := g.Wait()
 
-	return g.Wait()
+	if o.config.Batcher != nil {
+		o.config.Batcher.Flush()
+	}
+	return errors.Join(err, o.config.Queue.Stop(ctx))
 }
@@ -0,0 +1,165 @@
+package relay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/otlpprofiles"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/pushv1"
+)
+
+// ErrMessageTooLarge is returned for OTLP messages bigger than MaxGRPCMessageSize
+var ErrMessageTooLarge = errors.New("message too large")
+
+const (
+	// OTLPHTTPPath is where OTLP/HTTP profiles are sent to, both locally and on the remote
+	OTLPHTTPPath = "/v1development/profiles"
+	// OTLPGRPCPath is the path of the OTLP/gRPC Export procedure
+	OTLPGRPCPath = "/opentelemetry.proto.collector.profiles.v1development.ProfilesService/Export"
+
+	otlpContentTypeProto = otlpprofiles.ContentTypeProto
+	otlpContentTypeJSON  = otlpprofiles.ContentTypeJSON
+
+	// MaxGRPCMessageSize is the size above which OTLP/gRPC messages are rejected, once decompressed
+	// It's the default limit of gRPC servers, which also applies to the bodies of OTLP/HTTP requests
+	MaxGRPCMessageSize = 4 << 20
+
+	// https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+	grpcStatusOK                = "0"
+	grpcStatusInvalidArgument   = "3"
+	grpcStatusResourceExhausted = "8"
+	grpcStatusUnavailable       = "14"
+)
+
+// RelayOTLPHTTP relays OTLP/HTTP profiles as is
+func (c *Controller) RelayOTLPHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != OTLPHTTPPath {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxGRPCMessageSize))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		c.log.Errorf("Rejected an OTLP request: %v: more than %d bytes", ErrMessageTooLarge, maxBytesErr.Limit)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		c.log.Errorf("Failed to read an OTLP request for relay. Error: %+v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	contentType := pushv1.MediaType(r.Header.Get("Content-Type"))
+	if contentType != otlpContentTypeProto && contentType != otlpContentTypeJSON {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if err := c.queue.Send(c.newOTLPRequest(body, contentType, r.Header.Get("Content-Encoding"))); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	// an empty ExportProfilesServiceResponse
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	if contentType == otlpContentTypeJSON {
+		_, _ = w.Write([]byte("{}"))
+	}
+}
+
+// RelayOTLPGRPC relays OTLP/gRPC profiles, which are forwarded as OTLP/HTTP
+// It only implements the bits of the gRPC protocol needed for a unary call
+func (c *Controller) RelayOTLPGRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != OTLPGRPCPath {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	msg, err := readGRPCMessage(r, MaxGRPCMessageSize)
+	if errors.Is(err, ErrMessageTooLarge) {
+		c.log.Errorf("Rejected an OTLP/gRPC request for relay. Error: %+v", err)
+		writeGRPCStatus(w, grpcStatusResourceExhausted, err.Error())
+		return
+	}
+	if err != nil {
+		c.log.Errorf("Failed to read an OTLP/gRPC request for relay. Error: %+v", err)
+		writeGRPCStatus(w, grpcStatusInvalidArgument, err.Error())
+		return
+	}
+
+	if err := c.queue.Send(c.newOTLPRequest(msg, otlpContentTypeProto, "")); err != nil {
+		writeGRPCStatus(w, grpcStatusUnavailable, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	// a single, uncompressed and empty ExportProfilesServiceResponse
+	_, _ = w.Write([]byte{0, 0, 0, 0, 0})
+	w.Header().Set("Grpc-Status", grpcStatusOK)
+}
+
+func (*Controller) newOTLPRequest(body []byte, contentType string, contentEncoding string) *http.Request {
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, OTLPHTTPPath, bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	return req
+}
+
+// readGRPCMessage reads a single length prefixed message, of up to maxSize bytes both before and after decompression
+// See https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md
+func readGRPCMessage(r *http.Request, maxSize int) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r.Body, prefix[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if uint64(size) > uint64(maxSize) {
+		return nil, fmt.Errorf("%w: %d bytes, max is %d", ErrMessageTooLarge, size, maxSize)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r.Body, msg); err != nil {
+		return nil, err
+	}
+
+	if prefix[0] == 0 {
+		return msg, nil
+	}
+	if encoding := r.Header.Get("Grpc-Encoding"); encoding != "gzip" {
+		return nil, fmt.Errorf("unsupported grpc encoding '%s'", encoding)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	// one more byte than allowed tells a message of maxSize apart from a bigger one
+	msg, err = io.ReadAll(io.LimitReader(zr, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) > maxSize {
+		return nil, fmt.Errorf("%w: more than %d bytes once decompressed", ErrMessageTooLarge, maxSize)
+	}
+	return msg, nil
+}
+
+// writeGRPCStatus writes a "trailers only" error response
+func writeGRPCStatus(w http.ResponseWriter, status string, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", status)
+	w.Header().Set("Grpc-Message", message)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,293 @@
+package relay_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/sessionid"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+)
+
+func newOTLPTestController(relayed chan *http.Request) *relay.Controller {
+	queue := relay.NewRemoteQueue(noopLogger(), &relay.RemoteQueueCfg{}, mockRelayer{
+		fn: func(r *http.Request) error {
+			relayed <- r
+			return nil
+		},
+	})
+	queue.Start()
+	return relay.NewController(noopLogger(), queue, nil)
+}
+
+func TestControllerRelayOTLPHTTP(t *testing.T) {
+	payload := []byte("not really a protobuf")
+	relayed := make(chan *http.Request, 1)
+	ctrl := newOTLPTestController(relayed)
+
+	req := httptest.NewRequest(http.MethodPost, relay.OTLPHTTPPath, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	w := httptest.NewRecorder()
+	ctrl.RelayOTLPHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-protobuf", w.Header().Get("Content-Type"))
+
+	r := <-relayed
+	assert.Equal(t, relay.OTLPHTTPPath, r.URL.Path)
+	assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, payload, body)
+}
+
+func TestControllerRelayOTLPHTTPUnsupportedContentType(t *testing.T) {
+	ctrl := newOTLPTestController(make(chan *http.Request, 1))
+
+	req := httptest.NewRequest(http.MethodPost, relay.OTLPHTTPPath, bytes.NewReader(nil))
+	req.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	ctrl.RelayOTLPHTTP(w, req)
+
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+}
+
+func TestControllerRelayOTLPHTTPTooLarge(t *testing.T) {
+	relayed := make(chan *http.Request, 1)
+	ctrl := newOTLPTestController(relayed)
+
+	req := httptest.NewRequest(http.MethodPost, relay.OTLPHTTPPath, bytes.NewReader(make([]byte, relay.MaxGRPCMessageSize+1)))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	w := httptest.NewRecorder()
+	ctrl.RelayOTLPHTTP(w, req)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Empty(t, relayed)
+}
+
+func TestControllerRelayOTLPGRPC(t *testing.T) {
+	payload := []byte("not really a protobuf")
+	relayed := make(chan *http.Request, 1)
+	ctrl := newOTLPTestController(relayed)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(ctrl.RelayOTLPGRPC))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{Protocols: server.Config.Protocols}}
+
+	frame := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	frame = append(frame, payload...)
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+relay.OTLPGRPCPath, bytes.NewReader(frame))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, 2, res.ProtoMajor)
+	assert.Equal(t, []byte{0, 0, 0, 0, 0}, resBody, "empty response message")
+	assert.Equal(t, "0", res.Trailer.Get("Grpc-Status"))
+
+	r := <-relayed
+	assert.Equal(t, relay.OTLPHTTPPath, r.URL.Path, "forwarded as OTLP/HTTP")
+	assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, payload, body)
+}
+
+func TestControllerRelayOTLPGRPCTooLarge(t *testing.T) {
+	compressed := gzipBytes(t, make([]byte, relay.MaxGRPCMessageSize+1))
+
+	testCases := []struct {
+		name       string
+		compressed bool
+		size       uint32
+		payload    []byte
+	}{
+		{name: "length prefix", size: relay.MaxGRPCMessageSize + 1},
+		{name: "length prefix of 4GiB", size: 1<<32 - 1},
+		{name: "decompressed", compressed: true, size: uint32(len(compressed)), payload: compressed},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			relayed := make(chan *http.Request, 1)
+			ctrl := newOTLPTestController(relayed)
+
+			frame := make([]byte, 5, 5+len(tc.payload))
+			if tc.compressed {
+				frame[0] = 1
+			}
+			binary.BigEndian.PutUint32(frame[1:], tc.size)
+			frame = append(frame, tc.payload...)
+
+			req := httptest.NewRequest(http.MethodPost, relay.OTLPGRPCPath, bytes.NewReader(frame))
+			req.Header.Set("Content-Type", "application/grpc")
+			req.Header.Set("Grpc-Encoding", "gzip")
+			w := httptest.NewRecorder()
+			ctrl.RelayOTLPGRPC(w, req)
+
+			assert.Equal(t, "8", w.Header().Get("Grpc-Status"), "RESOURCE_EXHAUSTED")
+			assert.Empty(t, relayed)
+		})
+	}
+}
+
+// newOTLPRequestBody encodes an ExportProfilesServiceRequest
+// with a ResourceProfiles per set of resource attributes, nil meaning no resource
+func newOTLPRequestBody(resources ...[][2]string) []byte {
+	var req []byte
+	for _, attributes := range resources {
+		var resourceProfiles []byte
+		if attributes != nil {
+			var resource []byte
+			for _, a := range attributes {
+				var value []byte
+				value = protowire.AppendTag(value, 1, protowire.BytesType)
+				value = protowire.AppendString(value, a[1])
+				var kv []byte
+				kv = protowire.AppendTag(kv, 1, protowire.BytesType)
+				kv = protowire.AppendString(kv, a[0])
+				kv = protowire.AppendTag(kv, 2, protowire.BytesType)
+				kv = protowire.AppendBytes(kv, value)
+				resource = protowire.AppendTag(resource, 1, protowire.BytesType)
+				resource = protowire.AppendBytes(resource, kv)
+			}
+			resourceProfiles = protowire.AppendTag(resourceProfiles, 1, protowire.BytesType)
+			resourceProfiles = protowire.AppendBytes(resourceProfiles, resource)
+		}
+		// an opaque ScopeProfiles
+		resourceProfiles = protowire.AppendTag(resourceProfiles, 2, protowire.BytesType)
+		resourceProfiles = protowire.AppendBytes(resourceProfiles, []byte("scope"))
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, resourceProfiles)
+	}
+	return req
+}
+
+// decodeOTLPRequestBody returns the resource attributes and the scope profiles of every ResourceProfiles
+func decodeOTLPRequestBody(t *testing.T, body []byte) ([]map[string]string, [][]byte) {
+	fields := func(b []byte) map[protowire.Number][][]byte {
+		res := map[protowire.Number][][]byte{}
+		for len(b) > 0 {
+			num, _, n := protowire.ConsumeTag(b)
+			require.True(t, n > 0)
+			v, m := protowire.ConsumeBytes(b[n:])
+			require.True(t, m > 0)
+			res[num] = append(res[num], v)
+			b = b[n+m:]
+		}
+		return res
+	}
+
+	var resources []map[string]string
+	var scopes [][]byte
+	for _, resourceProfiles := range fields(body)[1] {
+		rpFields := fields(resourceProfiles)
+		attributes := map[string]string{}
+		// occurrences of the resource are merged
+		for _, resource := range rpFields[1] {
+			for _, kv := range fields(resource)[1] {
+				kvFields := fields(kv)
+				attributes[string(kvFields[1][0])] = string(fields(kvFields[2][0])[1][0])
+			}
+		}
+		resources = append(resources, attributes)
+		scopes = append(scopes, rpFields[2]...)
+	}
+	return resources, scopes
+}
+
+func TestRemoteClientOTLPAttributes(t *testing.T) {
+	body := newOTLPRequestBody([][2]string{{"service.name", "my-app"}, {"region", "mine"}}, nil)
+
+	remoteServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, relay.OTLPHTTPPath, r.URL.Path)
+
+			b, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			resources, scopes := decodeOTLPRequestBody(t, b)
+
+			assert.Equal(t, []map[string]string{
+				{
+					"service.name":      "my-app",
+					"region":            "mine",
+					"function_name":     "my-function",
+					sessionid.LabelName: "abc",
+				},
+				{
+					"region":            "us-east-1",
+					"function_name":     "my-function",
+					sessionid.LabelName: "abc",
+				},
+			}, resources, "attributes are added to every resource, without overriding existing ones")
+			assert.Equal(t, [][]byte{[]byte("scope"), []byte("scope")}, scopes, "profiles are mirrored")
+		}),
+	)
+	defer remoteServer.Close()
+
+	remoteClient := relay.NewRemoteClient(noopLogger(), &relay.RemoteClientCfg{
+		Address:   remoteServer.URL,
+		SessionID: "abc",
+		Labels:    map[string]string{"function_name": "my-function", "region": "us-east-1"},
+	})
+
+	req, err := http.NewRequest(http.MethodPost, relay.OTLPHTTPPath, bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-protobuf")
+
+	assert.NoError(t, remoteClient.Send(req))
+}
+
+func TestRemoteClientOTLPAttributesJSON(t *testing.T) {
+	body := `{"resourceProfiles": [{"resource": {"attributes": [{"key": "region", "value": {"stringValue": "mine"}}]}, "scopeProfiles": [{"schemaUrl": "x"}]}], "dictionary": {}}`
+
+	remoteServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			b, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			assert.JSONEq(t, `{
+				"resourceProfiles": [{
+					"resource": {"attributes": [
+						{"key": "region", "value": {"stringValue": "mine"}},
+						{"key": "`+sessionid.LabelName+`", "value": {"stringValue": "abc"}}
+					]},
+					"scopeProfiles": [{"schemaUrl": "x"}]
+				}],
+				"dictionary": {}
+			}`, string(b))
+		}),
+	)
+	defer remoteServer.Close()
+
+	remoteClient := relay.NewRemoteClient(noopLogger(), &relay.RemoteClientCfg{
+		Address:   remoteServer.URL,
+		SessionID: "abc",
+		Labels:    map[string]string{"region": "us-east-1"},
+	})
+
+	req, err := http.NewRequest(http.MethodPost, relay.OTLPHTTPPath, bytes.NewBufferString(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	assert.NoError(t, remoteClient.Send(req))
+}
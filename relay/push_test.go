@@ -0,0 +1,163 @@
+package relay_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/pushv1"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/sessionid"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+)
+
+// newPushRequestBody encodes a PushRequest with a single series
+func newPushRequestBody(labels [][2]string, profile []byte) []byte {
+	var series []byte
+	for _, l := range labels {
+		var pair []byte
+		pair = protowire.AppendTag(pair, 1, protowire.BytesType)
+		pair = protowire.AppendString(pair, l[0])
+		pair = protowire.AppendTag(pair, 2, protowire.BytesType)
+		pair = protowire.AppendString(pair, l[1])
+		series = protowire.AppendTag(series, 1, protowire.BytesType)
+		series = protowire.AppendBytes(series, pair)
+	}
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.BytesType)
+	sample = protowire.AppendBytes(sample, profile)
+	series = protowire.AppendTag(series, 2, protowire.BytesType)
+	series = protowire.AppendBytes(series, sample)
+
+	var req []byte
+	req = protowire.AppendTag(req, 1, protowire.BytesType)
+	return protowire.AppendBytes(req, series)
+}
+
+// decodePushRequestBody returns the labels and the raw profile of a PushRequest with a single series
+func decodePushRequestBody(t *testing.T, body []byte) (map[string]string, []byte) {
+	fields := func(b []byte) map[protowire.Number][][]byte {
+		res := map[protowire.Number][][]byte{}
+		for len(b) > 0 {
+			num, _, n := protowire.ConsumeTag(b)
+			require.True(t, n > 0)
+			v, m := protowire.ConsumeBytes(b[n:])
+			require.True(t, m > 0)
+			res[num] = append(res[num], v)
+			b = b[n+m:]
+		}
+		return res
+	}
+
+	series := fields(body)[1]
+	require.Len(t, series, 1)
+	seriesFields := fields(series[0])
+
+	labels := map[string]string{}
+	for _, pair := range seriesFields[1] {
+		pairFields := fields(pair)
+		labels[string(pairFields[1][0])] = string(pairFields[2][0])
+	}
+	return labels, fields(seriesFields[2][0])[1][0]
+}
+
+func TestRemoteClientPushLabels(t *testing.T) {
+	profile := readTestdataFile(t, "testdata/profile.pprof")
+	body := newPushRequestBody([][2]string{
+		{"__name__", "process_cpu"},
+		{"service_name", "my-app"},
+		{"region", "mine"},
+	}, profile)
+
+	remoteServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, pushv1.Path, r.URL.Path)
+			assert.Equal(t, "my-tenant", r.Header.Get("X-Scope-OrgID"))
+
+			b, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			labels, rawProfile := decodePushRequestBody(t, b)
+
+			assert.Equal(t, map[string]string{
+				"__name__":          "process_cpu",
+				"service_name":      "my-app",
+				"region":            "mine",
+				"function_name":     "my-function",
+				sessionid.LabelName: "abc",
+			}, labels, "labels are added to the series, without overriding existing ones")
+			assert.Equal(t, profile, rawProfile, "samples are mirrored")
+		}),
+	)
+	defer remoteServer.Close()
+
+	remoteClient := relay.NewRemoteClient(noopLogger(), &relay.RemoteClientCfg{
+		Address:   remoteServer.URL,
+		TenantID:  "my-tenant",
+		SessionID: "abc",
+		Labels:    map[string]string{"function_name": "my-function", "region": "us-east-1"},
+	})
+
+	req, err := http.NewRequest(http.MethodPost, pushv1.Path, bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", pushv1.ContentTypeProto)
+
+	assert.NoError(t, remoteClient.Send(req))
+}
+
+func TestRemoteClientPushLabelsJSON(t *testing.T) {
+	body := `{"series": [{"labels": [{"name": "__name__", "value": "process_cpu"}], "samples": [{"ID": "1", "rawProfile": "AAE="}]}]}`
+
+	remoteServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var req struct {
+				Series []struct {
+					Labels []struct {
+						Name  string `json:"name"`
+						Value string `json:"value"`
+					} `json:"labels"`
+					Samples []map[string]string `json:"samples"`
+				} `json:"series"`
+			}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			require.Len(t, req.Series, 1)
+
+			labels := map[string]string{}
+			for _, l := range req.Series[0].Labels {
+				labels[l.Name] = l.Value
+			}
+			assert.Equal(t, map[string]string{"__name__": "process_cpu", sessionid.LabelName: "abc"}, labels)
+			assert.Equal(t, []map[string]string{{"ID": "1", "rawProfile": "AAE="}}, req.Series[0].Samples)
+		}),
+	)
+	defer remoteServer.Close()
+
+	remoteClient := relay.NewRemoteClient(noopLogger(), &relay.RemoteClientCfg{Address: remoteServer.URL, SessionID: "abc"})
+
+	req, err := http.NewRequest(http.MethodPost, pushv1.Path, bytes.NewBufferString(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	assert.NoError(t, remoteClient.Send(req))
+}
+
+func TestControllerPushResponse(t *testing.T) {
+	queue := relay.NewRemoteQueue(noopLogger(), &relay.RemoteQueueCfg{}, mockRelayer{
+		fn: func(r *http.Request) error { return nil },
+	})
+	ctrl := relay.NewController(noopLogger(), queue, nil)
+
+	req := httptest.NewRequest(http.MethodPost, pushv1.Path, bytes.NewBufferString("{}"))
+	req.Header.Set("Content-Type", pushv1.ContentTypeJSON)
+	w := httptest.NewRecorder()
+	ctrl.RelayRequest(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, pushv1.ContentTypeJSON, w.Header().Get("Content-Type"))
+	assert.Equal(t, "{}", w.Body.String())
+}
@@ -0,0 +1,246 @@
+package relay
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/flameql"
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/sessionid"
+)
+
+// RelabelAction is what a relabel rule does, named after the Prometheus relabel actions
+type RelabelAction string
+
+const (
+	// RelabelKeep drops the profiles that don't match Match
+	RelabelKeep RelabelAction = "keep"
+	// RelabelDrop drops the profiles matching Match
+	RelabelDrop RelabelAction = "drop"
+	// RelabelLabelDrop removes the labels whose name matches Regex
+	RelabelLabelDrop RelabelAction = "labeldrop"
+	// RelabelLabelKeep removes the labels whose name doesn't match Regex
+	RelabelLabelKeep RelabelAction = "labelkeep"
+	// RelabelReplace sets TargetLabel to Replacement if the values of SourceLabels match Regex
+	// A replacement that expands to nothing removes TargetLabel
+	RelabelReplace RelabelAction = "replace"
+	// RelabelHashMod sets TargetLabel to the hash of the values of SourceLabels modulo Modulus
+	// Combined with keep, eg '{__sample="0"}', it keeps a consistent share of the series
+	RelabelHashMod RelabelAction = "hashmod"
+)
+
+const (
+	defaultRelabelSeparator   = ";"
+	defaultRelabelRegex       = "(.*)"
+	defaultRelabelReplacement = "$1"
+	// labels with this prefix (other than the app name) are removed once the rules are applied
+	relabelTmpPrefix = "__"
+)
+
+type RelabelRule struct {
+	Action RelabelAction
+	// Match is the flameql query of keep and drop, eg '{env="dev"}', whose app name is optional
+	Match string
+	// SourceLabels are the labels whose values, joined by Separator, are matched by replace and hashed by hashmod
+	// The app name is the '__name__' label
+	SourceLabels []string
+	// Separator defaults to ';'
+	Separator string
+	// Regex is anchored on both ends, it defaults to '(.*)'
+	Regex       string
+	TargetLabel string
+	// Replacement can refer to the groups of Regex, eg '$1' (the default)
+	Replacement string
+	Modulus     uint64
+}
+
+type RelabelCfg struct {
+	// Rules are applied in order to the name of the profiles
+	Rules   []RelabelRule
+	Metrics *Metrics
+}
+
+type relabelRule struct {
+	RelabelRule
+	query *flameql.Query
+	regex *regexp.Regexp
+}
+
+// Relabeler rewrites the labels of the profiles sent to /ingest, or drops them, before relaying them
+// Other profiles (eg OTLP ones), whose labels are in the body, are relayed as is
+type Relabeler struct {
+	log     *logrus.Entry
+	relayer Relayer
+	rules   []*relabelRule
+	metrics *Metrics
+}
+
+// NewRelabeler creates a relabeler, invalid rules are logged and skipped
+func NewRelabeler(log *logrus.Entry, config *RelabelCfg, relayer Relayer) *Relabeler {
+	log = log.WithField("comp", "relabeler")
+
+	r := &Relabeler{
+		log:     log,
+		relayer: relayer,
+		metrics: config.Metrics,
+	}
+	for i, rule := range config.Rules {
+		compiled, err := compileRelabelRule(rule)
+		if err != nil {
+			log.Errorf("Skipping relabel rule %d: %v", i, err)
+			continue
+		}
+		r.rules = append(r.rules, compiled)
+	}
+	return r
+}
+
+// compileRelabelRule validates the rule and sets up its defaults
+func compileRelabelRule(rule RelabelRule) (*relabelRule, error) {
+	if (rule.Action == RelabelLabelDrop || rule.Action == RelabelLabelKeep) && rule.Regex == "" {
+		// the default one would match every label
+		return nil, fmt.Errorf("%s: regex is required", rule.Action)
+	}
+
+	// Setup defaults
+	if rule.Separator == "" {
+		rule.Separator = defaultRelabelSeparator
+	}
+	if rule.Regex == "" {
+		rule.Regex = defaultRelabelRegex
+	}
+	if rule.Replacement == "" {
+		rule.Replacement = defaultRelabelReplacement
+	}
+
+	r := &relabelRule{RelabelRule: rule}
+	var err error
+	switch rule.Action {
+	case RelabelKeep, RelabelDrop:
+		if rule.Match == "" {
+			return nil, fmt.Errorf("%s: match is required", rule.Action)
+		}
+		if r.query, err = parseMatch(rule.Match); err != nil {
+			return nil, fmt.Errorf("%s: match '%s': %v", rule.Action, rule.Match, err)
+		}
+		return r, nil
+	case RelabelLabelDrop, RelabelLabelKeep:
+	case RelabelReplace, RelabelHashMod:
+		if len(rule.SourceLabels) == 0 {
+			return nil, fmt.Errorf("%s: source labels are required", rule.Action)
+		}
+		if rule.TargetLabel != flameql.ReservedTagKeyName {
+			if err := flameql.ValidateTagKey(rule.TargetLabel); err != nil {
+				return nil, fmt.Errorf("%s: target label '%s': %v", rule.Action, rule.TargetLabel, err)
+			}
+		}
+		if rule.Action == RelabelHashMod && rule.Modulus == 0 {
+			return nil, fmt.Errorf("%s: modulus is required", rule.Action)
+		}
+	default:
+		return nil, fmt.Errorf("unknown action '%s'", rule.Action)
+	}
+
+	if r.regex, err = regexp.Compile("^(?:" + rule.Regex + ")$"); err != nil {
+		return nil, fmt.Errorf("%s: regex '%s': %v", rule.Action, rule.Regex, err)
+	}
+	return r, nil
+}
+
+// Send relabels the request, unless its profile is dropped
+func (r *Relabeler) Send(req *http.Request) error {
+	if len(r.rules) == 0 || req.URL.Path != "/ingest" {
+		return r.relayer.Send(req)
+	}
+
+	q := req.URL.Query()
+	name := q.Get("name")
+	key, err := flameql.ParseKey(name)
+	if err != nil {
+		// the backend will reject it
+		r.log.Debugf("Failed to parse profile name, relaying it as is: %v", err)
+		return r.relayer.Send(req)
+	}
+
+	if !r.relabel(key) {
+		r.log.Tracef("Dropping profile '%s'", name)
+		r.metrics.requestFiltered()
+		return nil
+	}
+	if normalized := key.Normalized(); normalized != name {
+		q.Set("name", normalized)
+		req.URL.RawQuery = q.Encode()
+	}
+	return r.relayer.Send(req)
+}
+
+// relabel applies the rules to key, it reports whether the profile is kept
+func (r *Relabeler) relabel(key *flameql.Key) bool {
+	for _, rule := range r.rules {
+		if !rule.apply(key) {
+			return false
+		}
+	}
+
+	// the session id of the client is kept, so that it isn't replaced by the one of the extension
+	for k := range key.Labels() {
+		if k != flameql.ReservedTagKeyName && k != sessionid.LabelName && strings.HasPrefix(k, relabelTmpPrefix) {
+			key.Add(k, "")
+		}
+	}
+	return true
+}
+
+func (r *relabelRule) apply(key *flameql.Key) bool {
+	switch r.Action {
+	case RelabelKeep:
+		return matchKey(key, r.query)
+	case RelabelDrop:
+		return !matchKey(key, r.query)
+	case RelabelLabelDrop, RelabelLabelKeep:
+		for k := range key.Labels() {
+			if k != flameql.ReservedTagKeyName && r.regex.MatchString(k) == (r.Action == RelabelLabelDrop) {
+				key.Add(k, "")
+			}
+		}
+	case RelabelReplace:
+		value := r.sourceValue(key)
+		match := r.regex.FindStringSubmatchIndex(value)
+		if match == nil {
+			return true
+		}
+		replaced := string(r.regex.ExpandString(nil, r.Replacement, value, match))
+		r.setTarget(key, replaced)
+	case RelabelHashMod:
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(r.sourceValue(key)))
+		r.setTarget(key, strconv.FormatUint(h.Sum64()%r.Modulus, 10))
+	}
+	return true
+}
+
+func (r *relabelRule) sourceValue(key *flameql.Key) string {
+	values := make([]string, len(r.SourceLabels))
+	for i, l := range r.SourceLabels {
+		values[i] = key.Labels()[l]
+	}
+	return strings.Join(values, r.Separator)
+}
+
+// setTarget sets the target label, values that couldn't be parsed back are sanitized
+func (r *relabelRule) setTarget(key *flameql.Key, value string) {
+	value = relabelValueReplacer.Replace(value)
+	if r.TargetLabel == flameql.ReservedTagKeyName && flameql.ValidateAppName(value) != nil {
+		// a profile can't go without an app name
+		return
+	}
+	key.Add(r.TargetLabel, value)
+}
+
+// relabelValueReplacer replaces the characters that delimit label values in a name
+var relabelValueReplacer = strings.NewReplacer("}", "_", ",", "_")
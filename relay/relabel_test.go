@@ -0,0 +1,276 @@
+package relay_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+)
+
+func relabel(t *testing.T, rules []relay.RelabelRule, name string) string {
+	next := &recordingRelayer{}
+	relabeler := relay.NewRelabeler(noopLogger(), &relay.RelabelCfg{Rules: rules}, next)
+	req, err := http.NewRequest(http.MethodPost, "/ingest?name="+url.QueryEscape(name), nil)
+	require.NoError(t, err)
+	require.NoError(t, relabeler.Send(req))
+
+	requests := next.Requests()
+	if len(requests) == 0 {
+		return ""
+	}
+	require.Len(t, requests, 1)
+	return requests[0].URL.Query().Get("name")
+}
+
+func TestRelabeler(t *testing.T) {
+	testCases := []struct {
+		name     string
+		rules    []relay.RelabelRule
+		in       string
+		expected string // empty if the profile is dropped
+	}{
+		{
+			name:     "no rules",
+			in:       "my.app{user_id=42}",
+			expected: "my.app{user_id=42}",
+		},
+		{
+			name:     "labeldrop",
+			rules:    []relay.RelabelRule{{Action: relay.RelabelLabelDrop, Regex: "user_id|request_.*"}},
+			in:       "my.app{env=prod,user_id=42,request_path=/a}",
+			expected: "my.app{env=prod}",
+		},
+		{
+			name:     "labeldrop keeps the app name",
+			rules:    []relay.RelabelRule{{Action: relay.RelabelLabelDrop, Regex: ".*name.*"}},
+			in:       "my.app{hostname=a}",
+			expected: "my.app{}",
+		},
+		{
+			name:     "labelkeep",
+			rules:    []relay.RelabelRule{{Action: relay.RelabelLabelKeep, Regex: "env|region"}},
+			in:       "my.app{env=prod,region=eu,user_id=42}",
+			expected: "my.app{env=prod,region=eu}",
+		},
+		{
+			name:     "keep matching",
+			rules:    []relay.RelabelRule{{Action: relay.RelabelKeep, Match: `{env=~"prod|staging"}`}},
+			in:       "my.app{env=prod}",
+			expected: "my.app{env=prod}",
+		},
+		{
+			name:  "keep not matching",
+			rules: []relay.RelabelRule{{Action: relay.RelabelKeep, Match: `{env=~"prod|staging"}`}},
+			in:    "my.app{env=dev}",
+		},
+		{
+			name:  "keep with an app name",
+			rules: []relay.RelabelRule{{Action: relay.RelabelKeep, Match: `other.app{env="prod"}`}},
+			in:    "my.app{env=prod}",
+		},
+		{
+			name:  "drop matching",
+			rules: []relay.RelabelRule{{Action: relay.RelabelDrop, Match: `{env="dev"}`}},
+			in:    "my.app{env=dev}",
+		},
+		{
+			name:     "drop not matching",
+			rules:    []relay.RelabelRule{{Action: relay.RelabelDrop, Match: `{env="dev"}`}},
+			in:       "my.app{env=prod}",
+			expected: "my.app{env=prod}",
+		},
+		{
+			name: "replace",
+			rules: []relay.RelabelRule{{
+				Action:       relay.RelabelReplace,
+				SourceLabels: []string{"request_path"},
+				Regex:        `/users/[0-9]+(/.*)?`,
+				TargetLabel:  "request_path",
+				Replacement:  "/users/:id$1",
+			}},
+			in:       "my.app{request_path=/users/42/orders}",
+			expected: "my.app{request_path=/users/:id/orders}",
+		},
+		{
+			name: "replace not matching",
+			rules: []relay.RelabelRule{{
+				Action:       relay.RelabelReplace,
+				SourceLabels: []string{"request_path"},
+				Regex:        `/users/[0-9]+`,
+				TargetLabel:  "request_path",
+				Replacement:  "/users/:id",
+			}},
+			in:       "my.app{request_path=/health}",
+			expected: "my.app{request_path=/health}",
+		},
+		{
+			name: "replace with several source labels and the default regex",
+			rules: []relay.RelabelRule{{
+				Action:       relay.RelabelReplace,
+				SourceLabels: []string{"__name__", "env"},
+				Separator:    "-",
+				TargetLabel:  "service",
+			}},
+			in:       "my.app{env=prod}",
+			expected: "my.app{env=prod,service=my.app-prod}",
+		},
+		{
+			name: "replace removing a label",
+			rules: []relay.RelabelRule{{
+				Action:       relay.RelabelReplace,
+				SourceLabels: []string{"env"},
+				Regex:        "dev()",
+				TargetLabel:  "user_id",
+			}},
+			in:       "my.app{env=dev,user_id=42}",
+			expected: "my.app{env=dev}",
+		},
+		{
+			name: "replace the app name",
+			rules: []relay.RelabelRule{{
+				Action:       relay.RelabelReplace,
+				SourceLabels: []string{"__name__"},
+				Regex:        `(.*)\.cpu`,
+				TargetLabel:  "__name__",
+			}},
+			in:       "my.app.cpu{}",
+			expected: "my.app{}",
+		},
+		{
+			name: "replace with an invalid app name",
+			rules: []relay.RelabelRule{{
+				Action:       relay.RelabelReplace,
+				SourceLabels: []string{"env"},
+				TargetLabel:  "__name__",
+			}},
+			in:       "my.app{}",
+			expected: "my.app{}",
+		},
+		{
+			name: "replace sanitizes values",
+			rules: []relay.RelabelRule{{
+				Action:       relay.RelabelReplace,
+				SourceLabels: []string{"a", "b"},
+				Separator:    ",",
+				TargetLabel:  "c",
+			}},
+			in:       "my.app{a=1,b=2}",
+			expected: "my.app{a=1,b=2,c=1_2}",
+		},
+		{
+			name: "hashmod",
+			rules: []relay.RelabelRule{{
+				Action:       relay.RelabelHashMod,
+				SourceLabels: []string{"user_id"},
+				TargetLabel:  "shard",
+				Modulus:      1,
+			}},
+			in:       "my.app{user_id=42}",
+			expected: "my.app{shard=0,user_id=42}",
+		},
+		{
+			name: "hashmod sampling removes temporary labels",
+			rules: []relay.RelabelRule{
+				{Action: relay.RelabelHashMod, SourceLabels: []string{"user_id"}, TargetLabel: "__sample", Modulus: 1},
+				{Action: relay.RelabelKeep, Match: `{__sample="0"}`},
+				{Action: relay.RelabelLabelDrop, Regex: "user_id"},
+			},
+			in:       "my.app{user_id=42}",
+			expected: "my.app{}",
+		},
+		{
+			name:     "the session id of the client is kept",
+			rules:    []relay.RelabelRule{{Action: relay.RelabelLabelDrop, Regex: "env"}},
+			in:       "my.app{__session_id__=abc,env=prod}",
+			expected: "my.app{__session_id__=abc}",
+		},
+		{
+			name:     "rules are applied in order",
+			rules:    []relay.RelabelRule{{Action: relay.RelabelLabelDrop, Regex: "env"}, {Action: relay.RelabelKeep, Match: `{env="prod"}`}},
+			in:       "my.app{env=prod}",
+			expected: "",
+		},
+		{
+			name:     "invalid names are relayed as is",
+			rules:    []relay.RelabelRule{{Action: relay.RelabelDrop, Match: `{env="dev"}`}},
+			in:       "{env=dev}",
+			expected: "{env=dev}",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, relabel(t, tc.rules, tc.in))
+		})
+	}
+}
+
+func TestRelabelerHashModSampling(t *testing.T) {
+	rules := []relay.RelabelRule{
+		{Action: relay.RelabelHashMod, SourceLabels: []string{"user_id"}, TargetLabel: "__sample", Modulus: 4},
+		{Action: relay.RelabelKeep, Match: `{__sample="0"}`},
+	}
+
+	var kept int
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("my.app{user_id=%d}", i)
+		out := relabel(t, rules, name)
+		// series are consistently kept or dropped
+		assert.Equal(t, out, relabel(t, rules, name))
+		if out != "" {
+			kept++
+		}
+	}
+	assert.InDelta(t, 250, kept, 50)
+}
+
+func TestRelabelerMetrics(t *testing.T) {
+	metrics := relay.NewMetrics()
+	next := &recordingRelayer{}
+	relabeler := relay.NewRelabeler(noopLogger(), &relay.RelabelCfg{
+		Rules:   []relay.RelabelRule{{Action: relay.RelabelDrop, Match: `{env="dev"}`}},
+		Metrics: metrics,
+	}, next)
+
+	for _, path := range []string{"/ingest?name=my.app%7Benv%3Ddev%7D", "/ingest?name=my.app%7Benv%3Dprod%7D", relay.OTLPHTTPPath} {
+		req, err := http.NewRequest(http.MethodPost, path, nil)
+		require.NoError(t, err)
+		require.NoError(t, relabeler.Send(req))
+	}
+	assert.Len(t, next.Requests(), 2)
+	assert.Equal(t, int64(1), metrics.Summary()["filtered"])
+}
+
+func TestRelabelCfgValidate(t *testing.T) {
+	testCases := []struct {
+		name string
+		rule relay.RelabelRule
+	}{
+		{name: "unknown action", rule: relay.RelabelRule{Action: "rename"}},
+		{name: "keep without match", rule: relay.RelabelRule{Action: relay.RelabelKeep}},
+		{name: "drop with an invalid match", rule: relay.RelabelRule{Action: relay.RelabelDrop, Match: "{env=dev}"}},
+		{name: "labeldrop without regex", rule: relay.RelabelRule{Action: relay.RelabelLabelDrop}},
+		{name: "labelkeep with an invalid regex", rule: relay.RelabelRule{Action: relay.RelabelLabelKeep, Regex: "("}},
+		{name: "replace without source labels", rule: relay.RelabelRule{Action: relay.RelabelReplace, TargetLabel: "a"}},
+		{name: "replace with an invalid target label", rule: relay.RelabelRule{Action: relay.RelabelReplace, SourceLabels: []string{"a"}, TargetLabel: "a-b"}},
+		{name: "hashmod without modulus", rule: relay.RelabelRule{Action: relay.RelabelHashMod, SourceLabels: []string{"a"}, TargetLabel: "b"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := (&relay.RelabelCfg{Rules: []relay.RelabelRule{tc.rule}}).Validate()
+			assert.ErrorIs(t, err, relay.ErrInvalidConfig)
+		})
+	}
+
+	assert.NoError(t, (&relay.RelabelCfg{Rules: []relay.RelabelRule{
+		{Action: relay.RelabelLabelDrop, Regex: "user_id"},
+		{Action: relay.RelabelReplace, SourceLabels: []string{"__name__"}, TargetLabel: "__name__"},
+		{Action: relay.RelabelHashMod, SourceLabels: []string{"a"}, TargetLabel: "__sample", Modulus: 10},
+		{Action: relay.RelabelKeep, Match: `my.app{__sample="0"}`},
+	}}).Validate())
+}
@@ -2,26 +2,109 @@ package relay
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+var (
+	ErrQueueFull    = errors.New("request queue is full")
+	ErrQueueStopped = errors.New("request queue is stopped")
+)
+
+// OverflowPolicy determines what happens when a request is sent to a full queue
+type OverflowPolicy string
+
+const (
+	// OverflowDropNewest drops the request being sent
+	OverflowDropNewest OverflowPolicy = "drop-newest"
+	// OverflowDropOldest drops the oldest enqueued requests to make room for the one being sent
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+	// OverflowBlock blocks the sender until there's room in the queue, or BlockTimeout elapses
+	OverflowBlock OverflowPolicy = "block"
+	// OverflowSpill stores the request being sent in the spill store
+	OverflowSpill OverflowPolicy = "spill"
+)
+
+// ParseOverflowPolicy parses an overflow policy, an empty string means the default policy
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch p := OverflowPolicy(s); p {
+	case "", OverflowDropNewest, OverflowDropOldest, OverflowBlock, OverflowSpill:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown overflow policy '%s'", s)
+	}
+}
+
+// DrainOrder determines which pending requests are relayed first when the queue is stopped
+type DrainOrder string
+
+const (
+	// DrainOldestFirst relays the pending requests in the order they were enqueued
+	DrainOldestFirst DrainOrder = "oldest-first"
+	// DrainNewestFirst relays the most recent profiles first, eg the ones of the last invocation
+	DrainNewestFirst DrainOrder = "newest-first"
+)
+
+// ParseDrainOrder parses a drain order, an empty string means the default order
+func ParseDrainOrder(s string) (DrainOrder, error) {
+	switch o := DrainOrder(s); o {
+	case "", DrainOldestFirst, DrainNewestFirst:
+		return o, nil
+	default:
+		return "", fmt.Errorf("unknown drain order '%s'", s)
+	}
+}
+
 type RemoteQueueCfg struct {
 	NumWorkers int
+	// QueueSize is the max number of enqueued requests
+	QueueSize int
+	// MaxQueueBytes is the max size of the bodies of the enqueued requests, 0 means no limit
+	MaxQueueBytes int64
+	// OverflowPolicy defaults to OverflowSpill if Spill is set, or OverflowDropNewest otherwise
+	OverflowPolicy OverflowPolicy
+	// BlockTimeout is how long Send blocks when using OverflowBlock
+	BlockTimeout time.Duration
+	// Spill is where profiles that can't be delivered are stored, optional
+	Spill *SpillStore
+	// DrainOrder is the order pending requests are relayed in when the queue is stopped, defaults to DrainOldestFirst
+	DrainOrder DrainOrder
+	// SpillOnStop stores the requests that couldn't be relayed before the Stop deadline in Spill
+	SpillOnStop bool
+	// Metrics records what happens to the requests, optional
+	Metrics *Metrics
 }
 
 type RemoteQueue struct {
-	config     *RemoteQueueCfg
-	jobs       chan *http.Request
-	done       chan struct{}
-	wg         sync.WaitGroup
-	flushWG    sync.WaitGroup
-	flushGuard sync.Mutex
-	log        *logrus.Entry
-	relayer    Relayer
+	config      *RemoteQueueCfg
+	jobs        chan *http.Request
+	queuedBytes int64
+	dequeued    chan struct{}
+	done        chan struct{}
+	wg          sync.WaitGroup
+	flushGuard  sync.Mutex
+	log         *logrus.Entry
+	relayer     Relayer
+
+	// stopMu guards stopping, so that no request is enqueued once Stop collected the pending ones
+	stopMu   sync.RWMutex
+	stopping bool
+	// inflight is the context requests are relayed with, it's cancelled when the Stop deadline is reached
+	inflight       context.Context
+	cancelInflight context.CancelFunc
+
+	// pendingMu guards pending, the number of enqueued jobs not done yet
+	// idle is closed once there are none, so that Flush can stop waiting for it
+	pendingMu sync.Mutex
+	pending   int
+	idle      chan struct{}
 }
 
 type Relayer interface {
@@ -30,85 +113,361 @@ type Relayer interface {
 
 func NewRemoteQueue(log *logrus.Entry, config *RemoteQueueCfg, relayer Relayer) *RemoteQueue {
 	// Setup defaults
-	if config.NumWorkers == 0 {
+	if config.NumWorkers <= 0 {
 		// TODO(eh-am): figure out a good default value?
 		config.NumWorkers = 5
 	}
-
-	return &RemoteQueue{
-		config: config,
-		log:    log,
+	if config.QueueSize <= 0 {
 		// TODO(eh-am): figure out a good default value?
-		jobs:    make(chan *http.Request, 20),
-		done:    make(chan struct{}),
-		relayer: relayer,
+		config.QueueSize = 20
+	}
+	if config.OverflowPolicy == "" {
+		config.OverflowPolicy = OverflowDropNewest
+		if config.Spill != nil {
+			config.OverflowPolicy = OverflowSpill
+		}
+	}
+	if config.BlockTimeout <= 0 {
+		config.BlockTimeout = time.Second
 	}
+	if config.DrainOrder == "" {
+		config.DrainOrder = DrainOldestFirst
+	}
+
+	inflight, cancelInflight := context.WithCancel(context.Background())
+	r := &RemoteQueue{
+		config:         config,
+		log:            log,
+		jobs:           make(chan *http.Request, config.QueueSize),
+		dequeued:       make(chan struct{}, 1),
+		done:           make(chan struct{}),
+		relayer:        relayer,
+		inflight:       inflight,
+		cancelInflight: cancelInflight,
+		idle:           make(chan struct{}),
+	}
+	// the queue starts empty
+	close(r.idle)
+	config.Metrics.observeQueue(func() (int64, int64) {
+		return int64(len(r.jobs)), atomic.LoadInt64(&r.queuedBytes)
+	})
+	return r
 }
 
 func (r *RemoteQueue) Start() error {
+	r.wg.Add(r.config.NumWorkers)
 	for i := 0; i < r.config.NumWorkers; i++ {
 		i := i
 		go r.handleJobs(i)
 	}
+
+	// pick up whatever a previous run in the same execution environment left behind
+	r.DrainSpill()
 	return nil
 }
 
-// Stop signals for the workers to not handle any more jobs
-// Then waits for existing jobs to finish
-// Currently context is not used for anything
-func (r *RemoteQueue) Stop(_ context.Context) error {
+// Stop stops accepting requests, and relays the pending ones until ctx is done
+// Requests being relayed when ctx is done are cancelled, the pending ones left are abandoned,
+// and stored in the spill store if SpillOnStop is set
+func (r *RemoteQueue) Stop(ctx context.Context) error {
+	r.stopMu.Lock()
+	r.stopping = true
+	r.stopMu.Unlock()
 	close(r.done)
 
-	r.log.Debugf("Waiting for %d pending jobs to finish...", len(r.jobs))
+	stopInflight := context.AfterFunc(ctx, r.cancelInflight)
+	defer stopInflight()
+
+	pending := r.dequeuePending()
+	r.log.Debugf("Relaying %d pending jobs...", len(pending))
+	abandoned := r.relayPending(ctx, pending)
+	for _, job := range abandoned {
+		r.config.Metrics.requestAbandoned(abandonedDeadline)
+		if r.config.SpillOnStop && r.spill(job) {
+			r.log.Trace("Spilled abandoned request to disk")
+		}
+		r.jobDone()
+	}
+	if len(abandoned) > 0 {
+		r.log.Warnf("Abandoned %d pending jobs, the shutdown deadline was reached: %v", len(abandoned), ctx.Err())
+	}
+
+	// workers are done once the request they are relaying is, which is cancelled if ctx is done
 	r.wg.Wait()
+	r.cancelInflight()
 	r.log.Debug("Requests finished.")
 
 	return nil
 }
 
+// dequeuePending removes the pending requests from the queue, in the configured drain order
+func (r *RemoteQueue) dequeuePending() []*http.Request {
+	var pending []*http.Request
+loop:
+	for {
+		select {
+		case job := <-r.jobs:
+			atomic.AddInt64(&r.queuedBytes, -requestSize(job))
+			pending = append(pending, job)
+		default:
+			break loop
+		}
+	}
+
+	if r.config.DrainOrder == DrainNewestFirst {
+		slices.Reverse(pending)
+	}
+	return pending
+}
+
+// relayPending relays the requests in order with NumWorkers goroutines until ctx is done
+// It returns the ones that were not relayed
+func (r *RemoteQueue) relayPending(ctx context.Context, pending []*http.Request) []*http.Request {
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < r.config.NumWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				i := int(next.Add(1)) - 1
+				if i >= len(pending) {
+					return
+				}
+				r.relay(pending[i])
+			}
+		}()
+	}
+	wg.Wait()
+
+	taken := min(int(next.Load()), len(pending))
+	return pending[taken:]
+}
+
 // Send adds a request to the queue to be processed later
+// If the queue is full, the configured OverflowPolicy is applied
 func (r *RemoteQueue) Send(req *http.Request) error {
 	r.flushGuard.Lock() // block if we are currently trying to Flush
 	defer r.flushGuard.Unlock()
-	r.flushWG.Add(1)
+
+	r.stopMu.RLock()
+	defer r.stopMu.RUnlock()
+	if r.stopping {
+		r.config.Metrics.requestAbandoned(abandonedStopped)
+		return ErrQueueStopped
+	}
+
+	// Since Send is guarded, there's a single producer at a time
+	// which means room in the queue can only grow while we are here
+	size := requestSize(req)
+	if r.tryEnqueue(req, size) {
+		return nil
+	}
+
+	switch r.config.OverflowPolicy {
+	case OverflowDropOldest:
+		for r.dropOldest() {
+			if r.tryEnqueue(req, size) {
+				return nil
+			}
+		}
+	case OverflowBlock:
+		if r.enqueueWithTimeout(req, size) {
+			return nil
+		}
+	case OverflowSpill:
+		if r.spill(req) {
+			r.log.Warn("Request queue is full, spilled a profile job to disk.")
+			return nil
+		}
+	}
+
+	r.log.Error("Request queue is full, dropping a profile job.")
+	r.config.Metrics.requestDropped()
+	return ErrQueueFull
+}
+
+// tryEnqueue enqueues the request if both the item and byte limits allow it
+func (r *RemoteQueue) tryEnqueue(req *http.Request, size int64) bool {
+	queued := atomic.LoadInt64(&r.queuedBytes)
+	// a request bigger than the limit is still accepted in an empty queue
+	if r.config.MaxQueueBytes > 0 && queued > 0 && queued+size > r.config.MaxQueueBytes {
+		return false
+	}
+
+	atomic.AddInt64(&r.queuedBytes, size)
+	r.jobAdded()
 	select {
 	case r.jobs <- req:
+		r.config.Metrics.requestEnqueued()
+		return true
 	default:
-		r.flushWG.Done()
-		r.log.Error("Request queue is full, dropping a profile job.")
-		return fmt.Errorf("request queue is full")
+		atomic.AddInt64(&r.queuedBytes, -size)
+		r.jobDone()
+		return false
 	}
+}
 
-	return nil
+// enqueueWithTimeout waits for the workers to make room for the request
+func (r *RemoteQueue) enqueueWithTimeout(req *http.Request, size int64) bool {
+	timer := time.NewTimer(r.config.BlockTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-r.dequeued:
+			if r.tryEnqueue(req, size) {
+				return true
+			}
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// dropOldest discards the oldest enqueued request, it returns false if there's none
+func (r *RemoteQueue) dropOldest() bool {
+	select {
+	case old := <-r.jobs:
+		atomic.AddInt64(&r.queuedBytes, -requestSize(old))
+		r.jobDone()
+		r.log.Error("Request queue is full, dropping the oldest profile job.")
+		r.config.Metrics.requestDropped()
+		return true
+	default:
+		return false
+	}
+}
+
+// requestSize returns the size of the request body, if known
+func requestSize(req *http.Request) int64 {
+	if req.ContentLength > 0 {
+		return req.ContentLength
+	}
+	return 0
+}
+
+// DrainSpill enqueues previously spilled requests, as long as there's room in the queue
+func (r *RemoteQueue) DrainSpill() {
+	if r.config.Spill == nil {
+		return
+	}
+
+	n, err := r.config.Spill.Drain(cap(r.jobs)-len(r.jobs), func(req *http.Request) {
+		_ = r.Send(req)
+	})
+	if err != nil {
+		r.log.Error("Failed to drain spilled requests: ", err)
+	}
+	if n > 0 {
+		r.log.Debugf("Enqueued %d spilled requests", n)
+	}
+}
+
+// spill stores the request on disk, if a spill store is configured
+func (r *RemoteQueue) spill(req *http.Request) bool {
+	if r.config.Spill == nil {
+		return false
+	}
+
+	if err := r.config.Spill.Put(req); err != nil {
+		r.log.Error("Failed to spill request: ", err)
+		return false
+	}
+	r.config.Metrics.requestSpilled()
+	return true
 }
-func (r *RemoteQueue) Flush() {
+
+// Flush waits for the enqueued jobs to finish, or until ctx is done
+// Sends are blocked meanwhile, so that the queue can become empty
+func (r *RemoteQueue) Flush(ctx context.Context) {
 	r.log.Debugf("Flush: Waiting for enqueued jobs to finish")
+	start := time.Now()
 	r.flushGuard.Lock()
 	defer r.flushGuard.Unlock()
-	r.flushWG.Wait()
-	r.log.Debugf("Flush: Done")
+
+	r.pendingMu.Lock()
+	idle := r.idle
+	r.pendingMu.Unlock()
+
+	select {
+	case <-idle:
+		r.config.Metrics.flushed(time.Since(start))
+		r.log.Debugf("Flush: Done")
+	case <-ctx.Done():
+		r.log.Debugf("Flush: Gave up waiting: %v", ctx.Err())
+	}
+}
+
+// jobAdded records a job being enqueued
+func (r *RemoteQueue) jobAdded() {
+	r.pendingMu.Lock()
+	defer r.pendingMu.Unlock()
+	if r.pending == 0 {
+		r.idle = make(chan struct{})
+	}
+	r.pending++
+}
+
+// jobDone records a job being relayed, dropped or abandoned
+func (r *RemoteQueue) jobDone() {
+	r.pendingMu.Lock()
+	defer r.pendingMu.Unlock()
+	r.pending--
+	if r.pending == 0 {
+		close(r.idle)
+	}
 }
 
 func (r *RemoteQueue) handleJobs(workerID int) {
+	defer r.wg.Done()
 	for {
+		// pending jobs are left to Stop once it's called, so that they are relayed in the drain order
+		select {
+		case <-r.done:
+			r.log.Tracef("Worker #%d closing. Not taking any more jobs", workerID)
+			return
+		default:
+		}
+
 		select {
 		case <-r.done:
 			r.log.Tracef("Worker #%d closing. Not taking any more jobs", workerID)
 			return
 		case job := <-r.jobs:
-			log := r.log.WithField("path", job.URL.Path)
-
-			log.Trace("Relaying request to remote")
-			r.wg.Add(1)
-			err := r.relayer.Send(job)
-			r.wg.Done()
-			r.flushWG.Done()
-
-			if err != nil {
-				log.Error("Failed to relay request: ", err)
-			} else {
-				log.Trace("Successfully relayed request to remote", job.URL.RawQuery)
+			atomic.AddInt64(&r.queuedBytes, -requestSize(job))
+			select {
+			case r.dequeued <- struct{}{}:
+			default:
 			}
+			r.relay(job)
+		}
+	}
+}
+
+// relay relays a dequeued request, spilling it if it failed to be relayed for a transient reason
+func (r *RemoteQueue) relay(job *http.Request) {
+	defer r.jobDone()
+
+	size := requestSize(job)
+	log := r.log.WithField("path", job.URL.Path)
+
+	log.Trace("Relaying request to remote")
+	start := time.Now()
+	// the job is canceled with the inflight requests, but keeps the tenant of its route
+	ctx := r.inflight
+	if tenantID := tenantIDFrom(job.Context()); tenantID != "" {
+		ctx = withTenantID(ctx, tenantID)
+	}
+	err := r.relayer.Send(job.WithContext(ctx))
+	r.config.Metrics.requestRelayed(size, time.Since(start), err)
+
+	if err != nil {
+		log.Error("Failed to relay request: ", err)
+		if isTransient(err) && r.spill(job) {
+			log.Debug("Spilled request to disk")
 		}
+	} else {
+		log.Trace("Successfully relayed request to remote", job.URL.RawQuery)
 	}
 }
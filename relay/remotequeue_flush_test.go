@@ -1,6 +1,7 @@
 package relay_test
 
 import (
+	"context"
 	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
 	"github.com/sirupsen/logrus"
 	"net/http"
@@ -78,7 +79,7 @@ func (h *flushTestHelper) respond() {
 
 func (h *flushTestHelper) flushAsync() *asyncJob {
 	return newAsyncJob(h.t, "flush", func() {
-		h.queue.Flush()
+		h.queue.Flush(context.Background())
 	})
 }
 
@@ -5,8 +5,10 @@ import (
 	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
 	"github.com/stretchr/testify/assert"
 	"net/http"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 type mockRelayer struct {
@@ -28,7 +30,8 @@ func TestRemoteQueue(t *testing.T) {
 	relayer := mockRelayer{
 		fn: func(r *http.Request) error {
 			defer wg.Done()
-			assert.Equal(t, req, r)
+			// requests are relayed with a context cancelled on shutdown
+			assert.Equal(t, req.WithContext(r.Context()), r)
 			return nil
 		},
 	}
@@ -97,3 +100,175 @@ func TestRemoteQueueShutdown(t *testing.T) {
 	<-shutdown
 	assert.True(t, jobProcessed)
 }
+
+func newOverflowTestRequest(t *testing.T, name string, body string) *http.Request {
+	req, err := http.NewRequest(http.MethodPost, "/ingest?name="+name, strings.NewReader(body))
+	assert.NoError(t, err)
+	return req
+}
+
+func TestRemoteQueueOverflowDropNewest(t *testing.T) {
+	var mu sync.Mutex
+	var relayed []string
+	relayer := mockRelayer{
+		fn: func(r *http.Request) error {
+			mu.Lock()
+			defer mu.Unlock()
+			relayed = append(relayed, r.URL.Query().Get("name"))
+			return nil
+		},
+	}
+
+	queue := relay.NewRemoteQueue(noopLogger(), &relay.RemoteQueueCfg{QueueSize: 2}, relayer)
+	assert.NoError(t, queue.Send(newOverflowTestRequest(t, "1", "")))
+	assert.NoError(t, queue.Send(newOverflowTestRequest(t, "2", "")))
+	assert.ErrorIs(t, queue.Send(newOverflowTestRequest(t, "3", "")), relay.ErrQueueFull)
+
+	queue.Start()
+	queue.Flush(context.Background())
+	assert.Equal(t, []string{"1", "2"}, relayed)
+}
+
+func TestRemoteQueueOverflowDropOldest(t *testing.T) {
+	var mu sync.Mutex
+	var relayed []string
+	relayer := mockRelayer{
+		fn: func(r *http.Request) error {
+			mu.Lock()
+			defer mu.Unlock()
+			relayed = append(relayed, r.URL.Query().Get("name"))
+			return nil
+		},
+	}
+
+	queue := relay.NewRemoteQueue(noopLogger(), &relay.RemoteQueueCfg{
+		NumWorkers:     1,
+		QueueSize:      2,
+		OverflowPolicy: relay.OverflowDropOldest,
+	}, relayer)
+	for _, name := range []string{"1", "2", "3"} {
+		assert.NoError(t, queue.Send(newOverflowTestRequest(t, name, "")))
+	}
+
+	queue.Start()
+	queue.Flush(context.Background())
+	assert.Equal(t, []string{"2", "3"}, relayed)
+}
+
+func TestRemoteQueueOverflowBlock(t *testing.T) {
+	relayer := mockRelayer{
+		fn: func(r *http.Request) error { return nil },
+	}
+
+	queue := relay.NewRemoteQueue(noopLogger(), &relay.RemoteQueueCfg{
+		QueueSize:      1,
+		OverflowPolicy: relay.OverflowBlock,
+		BlockTimeout:   time.Millisecond * 50,
+	}, relayer)
+	assert.NoError(t, queue.Send(newOverflowTestRequest(t, "1", "")))
+
+	start := time.Now()
+	assert.ErrorIs(t, queue.Send(newOverflowTestRequest(t, "2", "")), relay.ErrQueueFull)
+	assert.GreaterOrEqual(t, time.Since(start), time.Millisecond*50, "blocks until the timeout")
+
+	queue.Start()
+	queue.Flush(context.Background())
+
+	queue = relay.NewRemoteQueue(noopLogger(), &relay.RemoteQueueCfg{
+		QueueSize:      1,
+		OverflowPolicy: relay.OverflowBlock,
+		BlockTimeout:   time.Second * 5,
+	}, relayer)
+	assert.NoError(t, queue.Send(newOverflowTestRequest(t, "1", "")))
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		queue.Start()
+	}()
+	assert.NoError(t, queue.Send(newOverflowTestRequest(t, "2", "")), "unblocks once there's room")
+	queue.Flush(context.Background())
+}
+
+func TestRemoteQueueMaxBytes(t *testing.T) {
+	relayer := mockRelayer{
+		fn: func(r *http.Request) error { return nil },
+	}
+
+	queue := relay.NewRemoteQueue(noopLogger(), &relay.RemoteQueueCfg{MaxQueueBytes: 10}, relayer)
+	assert.NoError(t, queue.Send(newOverflowTestRequest(t, "1", "123456")))
+	assert.ErrorIs(t, queue.Send(newOverflowTestRequest(t, "2", "123456")), relay.ErrQueueFull)
+	assert.NoError(t, queue.Send(newOverflowTestRequest(t, "3", "1234")))
+
+	queue.Start()
+	queue.Flush(context.Background())
+}
+
+func TestRemoteQueueStopRelaysPending(t *testing.T) {
+	var relayed []string
+	relayer := mockRelayer{
+		fn: func(r *http.Request) error {
+			relayed = append(relayed, r.URL.Query().Get("name"))
+			return nil
+		},
+	}
+
+	metrics := relay.NewMetrics()
+	queue := relay.NewRemoteQueue(noopLogger(), &relay.RemoteQueueCfg{
+		NumWorkers: 1,
+		DrainOrder: relay.DrainNewestFirst,
+		Metrics:    metrics,
+	}, relayer)
+	for _, name := range []string{"1", "2", "3"} {
+		assert.NoError(t, queue.Send(newOverflowTestRequest(t, name, "")))
+	}
+
+	assert.NoError(t, queue.Stop(context.Background()))
+	assert.Equal(t, []string{"3", "2", "1"}, relayed)
+
+	assert.ErrorIs(t, queue.Send(newOverflowTestRequest(t, "4", "")), relay.ErrQueueStopped)
+	summary := metrics.Summary()
+	assert.Equal(t, int64(1), summary["abandoned"])
+	assert.Equal(t, map[string]int64{"deadline": 0, "stopped": 1}, summary["abandonedByReason"])
+
+	w := &strings.Builder{}
+	metrics.WritePrometheus(w)
+	assert.Contains(t, w.String(), `pyroscope_extension_requests_abandoned_total{reason="deadline"} 0`+"\n")
+	assert.Contains(t, w.String(), `pyroscope_extension_requests_abandoned_total{reason="stopped"} 1`+"\n")
+	queue.Flush(context.Background())
+}
+
+func TestRemoteQueueStopDeadline(t *testing.T) {
+	store, err := relay.NewSpillStore(noopLogger(), &relay.SpillCfg{Dir: t.TempDir()})
+	assert.NoError(t, err)
+
+	relayer := mockRelayer{
+		fn: func(r *http.Request) error {
+			// a remote that doesn't respond
+			<-r.Context().Done()
+			return r.Context().Err()
+		},
+	}
+
+	metrics := relay.NewMetrics()
+	queue := relay.NewRemoteQueue(noopLogger(), &relay.RemoteQueueCfg{
+		NumWorkers:  1,
+		Spill:       store,
+		SpillOnStop: true,
+		Metrics:     metrics,
+	}, relayer)
+	for _, name := range []string{"1", "2", "3"} {
+		assert.NoError(t, queue.Send(newOverflowTestRequest(t, name, "body")))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	start := time.Now()
+	assert.NoError(t, queue.Stop(ctx))
+	assert.Less(t, time.Since(start), time.Second, "the request being relayed is cancelled")
+
+	// the first one was cancelled, the others were never relayed
+	summary := metrics.Summary()
+	assert.Equal(t, int64(2), summary["abandoned"])
+	assert.Equal(t, map[string]int64{"deadline": 2, "stopped": 0}, summary["abandonedByReason"])
+	assert.Equal(t, int64(1), summary["failed"])
+	assert.Equal(t, 2, store.Len())
+}
@@ -0,0 +1,186 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultRetryableStatusCodes are the status codes considered transient by default
+var DefaultRetryableStatusCodes = []int{
+	http.StatusRequestTimeout,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+type RetryCfg struct {
+	// MaxAttempts is the total number of attempts, including the first one
+	// A value of 1 disables retrying
+	MaxAttempts int
+	// BaseBackoff is the delay before the first retry, it doubles on every subsequent retry
+	BaseBackoff time.Duration
+	// MaxBackoff caps the delay between attempts, including the one requested via Retry-After
+	MaxBackoff time.Duration
+	// Jitter is the fraction (between 0 and 1) of the backoff that is randomized
+	Jitter float64
+	// RetryableStatusCodes are the non 2xx status codes worth retrying
+	// Any other status code is considered a permanent failure
+	RetryableStatusCodes []int
+	// RespectRetryAfter makes the Retry-After response header take precedence over the computed backoff
+	RespectRetryAfter bool
+	// Metrics records the retries, optional
+	Metrics *Metrics
+}
+
+// RetryRelayer wraps a Relayer, retrying requests that failed with a transient error
+type RetryRelayer struct {
+	config    *RetryCfg
+	log       *logrus.Entry
+	relayer   Relayer
+	retryable map[int]bool
+
+	randMu sync.Mutex
+	rand   *rand.Rand
+}
+
+func NewRetryRelayer(log *logrus.Entry, config *RetryCfg, relayer Relayer) *RetryRelayer {
+	// Setup defaults
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 1
+	}
+	if config.BaseBackoff <= 0 {
+		config.BaseBackoff = time.Millisecond * 100
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = time.Second * 2
+	}
+	if config.Jitter > 1 {
+		config.Jitter = 1
+	}
+	if config.RetryableStatusCodes == nil {
+		config.RetryableStatusCodes = DefaultRetryableStatusCodes
+	}
+
+	retryable := make(map[int]bool, len(config.RetryableStatusCodes))
+	for _, code := range config.RetryableStatusCodes {
+		retryable[code] = true
+	}
+
+	return &RetryRelayer{
+		config:    config,
+		log:       log.WithField("comp", "retry"),
+		relayer:   relayer,
+		retryable: retryable,
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Send relays the request, retrying it according to the retry policy
+// Each attempt works on a copy of the original request, so that the request can be replayed
+func (r *RetryRelayer) Send(req *http.Request) error {
+	maxAttempts := r.config.MaxAttempts
+	if !isReplayable(req) {
+		maxAttempts = 1
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		var attemptReq *http.Request
+		attemptReq, err = cloneForAttempt(req)
+		if err != nil {
+			return err
+		}
+
+		err = r.relayer.Send(attemptReq)
+		if err == nil || attempt >= maxAttempts || !r.isRetryable(err) {
+			break
+		}
+
+		backoff := r.backoff(attempt, err)
+		r.log.Debugf("Attempt %d/%d failed, retrying in %s. Error: %v", attempt, maxAttempts, backoff, err)
+		r.config.Metrics.requestRetried()
+
+		select {
+		case <-req.Context().Done():
+			return fmt.Errorf("%w: %v", err, req.Context().Err())
+		case <-time.After(backoff):
+		}
+	}
+
+	return err
+}
+
+func (r *RetryRelayer) isRetryable(err error) bool {
+	var respErr *ResponseError
+	if errors.As(err, &respErr) {
+		return r.retryable[respErr.StatusCode]
+	}
+
+	return errors.Is(err, ErrMakingRequest)
+}
+
+// backoff returns how long to wait after the given (1-indexed) attempt failed
+func (r *RetryRelayer) backoff(attempt int, err error) time.Duration {
+	var respErr *ResponseError
+	if r.config.RespectRetryAfter && errors.As(err, &respErr) && respErr.RetryAfter > 0 {
+		return minDuration(respErr.RetryAfter, r.config.MaxBackoff)
+	}
+
+	d := r.config.BaseBackoff
+	for i := 1; i < attempt && d < r.config.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = minDuration(d, r.config.MaxBackoff)
+
+	if r.config.Jitter > 0 {
+		r.randMu.Lock()
+		f := r.rand.Float64()
+		r.randMu.Unlock()
+		d -= time.Duration(f * r.config.Jitter * float64(d))
+	}
+
+	return d
+}
+
+// isTransient reports whether the error is likely to go away if the request is sent later
+// Unlike RetryRelayer's policy, it's not configurable
+func isTransient(err error) bool {
+	var respErr *ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.StatusCode == http.StatusTooManyRequests || respErr.StatusCode >= 500
+	}
+
+	return errors.Is(err, ErrMakingRequest)
+}
+
+// isReplayable reports whether the request body can be read more than once
+func isReplayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+func cloneForAttempt(req *http.Request) (*http.Request, error) {
+	r2 := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		r2.Body = body
+	}
+	return r2, nil
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
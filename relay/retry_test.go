@@ -0,0 +1,145 @@
+package relay_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+)
+
+func newTestRetryRelayer(address string, maxAttempts int) *relay.RetryRelayer {
+	logger := noopLogger()
+	remoteClient := relay.NewRemoteClient(logger, &relay.RemoteClientCfg{Address: address})
+
+	return relay.NewRetryRelayer(logger, &relay.RetryCfg{
+		MaxAttempts:       maxAttempts,
+		BaseBackoff:       time.Millisecond,
+		MaxBackoff:        time.Millisecond * 10,
+		RespectRetryAfter: true,
+	}, remoteClient)
+}
+
+func TestRetryRelayerRetriesTransientErrors(t *testing.T) {
+	profile := readTestdataFile(t, "testdata/profile.pprof")
+
+	var calls int32
+	remoteServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			assert.Equal(t, profile, body, "body is replayed")
+			assert.Equal(t, "/ingest", r.URL.Path, "path is not rewritten twice")
+
+			if atomic.AddInt32(&calls, 1) < 3 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+		}),
+	)
+	defer remoteServer.Close()
+
+	req, err := http.NewRequest(http.MethodPost, "/ingest?name=my.app%7B%7D", bytes.NewReader(profile))
+	require.NoError(t, err)
+
+	err = newTestRetryRelayer(remoteServer.URL, 3).Send(req)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&calls))
+}
+
+func TestRetryRelayerGivesUpAfterMaxAttempts(t *testing.T) {
+	var calls int32
+	remoteServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}),
+	)
+	defer remoteServer.Close()
+
+	req, err := http.NewRequest(http.MethodPost, "/ingest", nil)
+	require.NoError(t, err)
+
+	err = newTestRetryRelayer(remoteServer.URL, 2).Send(req)
+	assert.ErrorIs(t, err, relay.ErrNotOkResponse)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+}
+
+func TestRetryRelayerDoesNotRetryPermanentErrors(t *testing.T) {
+	var calls int32
+	remoteServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.WriteHeader(http.StatusBadRequest)
+		}),
+	)
+	defer remoteServer.Close()
+
+	req, err := http.NewRequest(http.MethodPost, "/ingest", nil)
+	require.NoError(t, err)
+
+	err = newTestRetryRelayer(remoteServer.URL, 3).Send(req)
+
+	var respErr *relay.ResponseError
+	require.ErrorAs(t, err, &respErr)
+	assert.Equal(t, http.StatusBadRequest, respErr.StatusCode)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+}
+
+func TestRetryRelayerRetriesConnectionErrors(t *testing.T) {
+	var calls int32
+	relayer := relay.NewRetryRelayer(noopLogger(), &relay.RetryCfg{
+		MaxAttempts: 3,
+		BaseBackoff: time.Millisecond,
+	}, mockRelayer{
+		fn: func(r *http.Request) error {
+			atomic.AddInt32(&calls, 1)
+			return relay.ErrMakingRequest
+		},
+	})
+
+	req, err := http.NewRequest(http.MethodPost, "/ingest", nil)
+	require.NoError(t, err)
+
+	err = relayer.Send(req)
+	assert.ErrorIs(t, err, relay.ErrMakingRequest)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&calls))
+}
+
+func TestRetryRelayerHonorsRetryAfter(t *testing.T) {
+	var calls int32
+	var firstCall time.Time
+	remoteServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				firstCall = time.Now()
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			assert.GreaterOrEqual(t, time.Since(firstCall), time.Millisecond*500)
+		}),
+	)
+	defer remoteServer.Close()
+
+	relayer := relay.NewRetryRelayer(noopLogger(), &relay.RetryCfg{
+		MaxAttempts:       2,
+		BaseBackoff:       time.Millisecond,
+		MaxBackoff:        time.Millisecond * 500,
+		RespectRetryAfter: true,
+	}, relay.NewRemoteClient(noopLogger(), &relay.RemoteClientCfg{Address: remoteServer.URL}))
+
+	req, err := http.NewRequest(http.MethodPost, "/ingest", nil)
+	require.NoError(t, err)
+
+	err = relayer.Send(req)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+}
@@ -0,0 +1,177 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/flameql"
+)
+
+// tenantIDKey is the context key carrying the tenant of a route down to the RemoteClient
+// It's a context value rather than a header, so that the function can't set it
+// Spilled requests keep it, see SpillStore
+type tenantIDKey struct{}
+
+func withTenantID(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, tenantIDKey{}, tenantID)
+}
+
+// tenantIDFrom returns the tenant of the route a request took, if any
+func tenantIDFrom(ctx context.Context) string {
+	tenantID, _ := ctx.Value(tenantIDKey{}).(string)
+	return tenantID
+}
+
+type RouteCfg struct {
+	// Match is a flameql query the name of the profiles is matched against, eg 'my.app{env="prod"}'
+	// Without an app name, eg '{team="payments"}', profiles of any app match
+	Match string
+	// Destination is the name of the destination matching profiles are relayed to, all of them if empty
+	Destination string
+	// TenantID, if set, overrides the tenant of the destination
+	TenantID string
+}
+
+type RouterCfg struct {
+	// Routes are evaluated in order, the first one matching a profile is used
+	Routes []RouteCfg
+	// Default is the route of profiles matching none of the routes, its Match is ignored
+	// Profiles that are not sent to /ingest (eg OTLP ones) always take it, since their labels are in the body
+	Default RouteCfg
+	// FanOut configures the relaying to all the destinations, eg by routes without a destination
+	FanOut FanOutCfg
+}
+
+type route struct {
+	query    *flameql.Query
+	tenantID string
+	queue    Queue
+}
+
+// Router relays requests to destinations depending on the labels of the profiles
+type Router struct {
+	log          *logrus.Entry
+	routes       []route
+	defaultRoute route
+	// all is where the lifecycle of the queues is delegated to
+	all Queue
+}
+
+// NewRouter creates a router over destinations
+// Routes that are invalid, or whose destination doesn't exist, are logged and skipped
+func NewRouter(log *logrus.Entry, config *RouterCfg, destinations []Destination) *Router {
+	log = log.WithField("comp", "router")
+
+	queues := make(map[string]Queue, len(destinations))
+	for _, d := range destinations {
+		queues[d.Name] = d.Queue
+	}
+	var all Queue = NewFanOut(log, &config.FanOut, destinations)
+	if len(destinations) == 1 {
+		all = destinations[0].Queue
+	}
+	newRoute := func(config RouteCfg) (route, error) {
+		r := route{tenantID: config.TenantID, queue: all}
+		if config.Destination != "" {
+			var ok bool
+			if r.queue, ok = queues[config.Destination]; !ok {
+				return r, fmt.Errorf("unknown destination '%s'", config.Destination)
+			}
+		}
+		return r, nil
+	}
+
+	router := &Router{log: log, all: all}
+	for _, rc := range config.Routes {
+		r, err := newRoute(rc)
+		if err == nil {
+			r.query, err = parseMatch(rc.Match)
+		}
+		if err != nil {
+			log.Errorf("Skipping route '%s': %v", rc.Match, err)
+			continue
+		}
+		router.routes = append(router.routes, r)
+	}
+	defaultRoute, err := newRoute(config.Default)
+	if err != nil {
+		log.Errorf("Invalid default route, relaying to all destinations instead: %v", err)
+		defaultRoute = route{queue: all}
+	}
+	router.defaultRoute = defaultRoute
+	return router
+}
+
+// parseMatch parses a flameql query, whose app name is optional
+func parseMatch(s string) (*flameql.Query, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "{") {
+		return flameql.ParseQuery(s)
+	}
+
+	if !strings.HasSuffix(s, "}") {
+		return nil, fmt.Errorf("%w: expected } at the end: %s", flameql.ErrInvalidQuerySyntax, s)
+	}
+	matchers, err := flameql.ParseMatchers(s[1 : len(s)-1])
+	if err != nil {
+		return nil, err
+	}
+	return &flameql.Query{Matchers: matchers}, nil
+}
+
+// matchKey reports whether the key matches a query parsed by parseMatch
+func matchKey(key *flameql.Key, q *flameql.Query) bool {
+	if q.AppName == "" {
+		q2 := *q
+		q2.AppName = key.AppName()
+		q = &q2
+	}
+	return key.Match(q)
+}
+
+// Send relays the request through the route of its profile
+func (r *Router) Send(req *http.Request) error {
+	route := r.route(req)
+	if route.tenantID != "" {
+		req = req.WithContext(withTenantID(req.Context(), route.tenantID))
+	}
+	return route.queue.Send(req)
+}
+
+func (r *Router) route(req *http.Request) route {
+	if len(r.routes) == 0 || req.URL.Path != "/ingest" {
+		return r.defaultRoute
+	}
+	key, err := flameql.ParseKey(req.URL.Query().Get("name"))
+	if err != nil {
+		r.log.Debugf("Failed to parse profile name, using the default route: %v", err)
+		return r.defaultRoute
+	}
+
+	for _, route := range r.routes {
+		if matchKey(key, route.query) {
+			return route
+		}
+	}
+	return r.defaultRoute
+}
+
+func (r *Router) Start() error {
+	return r.all.Start()
+}
+
+func (r *Router) Stop(ctx context.Context) error {
+	return r.all.Stop(ctx)
+}
+
+func (r *Router) Flush(ctx context.Context) {
+	r.all.Flush(ctx)
+}
+
+func (r *Router) DrainSpill() {
+	r.all.DrainSpill()
+}
@@ -0,0 +1,170 @@
+package relay_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+)
+
+// tenantRecorder is a remote recording the tenant of every request it receives
+type tenantRecorder struct {
+	mu      sync.Mutex
+	tenants []string
+}
+
+func (r *tenantRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tenants = append(r.tenants, req.Header.Get("X-Scope-OrgID"))
+}
+
+func (r *tenantRecorder) received() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tenants
+}
+
+func TestRouter(t *testing.T) {
+	backendA, backendB := &tenantRecorder{}, &tenantRecorder{}
+	serverA, serverB := httptest.NewServer(backendA), httptest.NewServer(backendB)
+	defer serverA.Close()
+	defer serverB.Close()
+	newDestination := func(name string, address string) relay.Destination {
+		remoteClient := relay.NewRemoteClient(noopLogger(), &relay.RemoteClientCfg{Address: address, TenantID: "tenant-" + name})
+		return relay.Destination{
+			Name:  name,
+			Queue: relay.NewRemoteQueue(noopLogger(), &relay.RemoteQueueCfg{NumWorkers: 1}, remoteClient),
+		}
+	}
+
+	router := relay.NewRouter(noopLogger(), &relay.RouterCfg{
+		Routes: []relay.RouteCfg{
+			{Match: `{team="payments"}`, Destination: "a", TenantID: "payments"},
+			{Match: `checkout{env=~"prod|staging"}`, Destination: "b"},
+			{Match: `{team="search",env!="dev"}`, TenantID: "search"},
+		},
+		Default: relay.RouteCfg{Destination: "a"},
+	}, []relay.Destination{newDestination("a", serverA.URL), newDestination("b", serverB.URL)})
+	require.NoError(t, router.Start())
+
+	for _, name := range []string{
+		"api{team=payments}",
+		"checkout{env=prod,team=payments}", // the first matching route is used
+		"checkout{env=staging}",
+		"checkout{env=dev}",
+		"indexer{team=search,env=prod}",
+		"indexer{team=search,env=dev}",
+		"not a valid name{",
+	} {
+		req, err := http.NewRequest(http.MethodPost, "/ingest?name="+url.QueryEscape(name), strings.NewReader("profile"))
+		require.NoError(t, err)
+		require.NoError(t, router.Send(req))
+	}
+	router.Flush(context.Background())
+	require.NoError(t, router.Stop(context.Background()))
+
+	assert.ElementsMatch(t, []string{"payments", "payments", "tenant-a", "search", "tenant-a", "tenant-a"}, backendA.received())
+	assert.ElementsMatch(t, []string{"tenant-b", "search"}, backendB.received())
+}
+
+func TestRouterDefaultRoute(t *testing.T) {
+	backendA, backendB := &tenantRecorder{}, &tenantRecorder{}
+	serverA, serverB := httptest.NewServer(backendA), httptest.NewServer(backendB)
+	defer serverA.Close()
+	defer serverB.Close()
+	destinations := []relay.Destination{}
+	for name, address := range map[string]string{"a": serverA.URL, "b": serverB.URL} {
+		remoteClient := relay.NewRemoteClient(noopLogger(), &relay.RemoteClientCfg{Address: address})
+		destinations = append(destinations, relay.Destination{
+			Name:  name,
+			Queue: relay.NewRemoteQueue(noopLogger(), &relay.RemoteQueueCfg{NumWorkers: 1}, remoteClient),
+		})
+	}
+
+	// without a destination, the default route relays to all of them
+	router := relay.NewRouter(noopLogger(), &relay.RouterCfg{
+		Routes:  []relay.RouteCfg{{Match: `{team="payments"}`, Destination: "a"}},
+		Default: relay.RouteCfg{TenantID: "shared"},
+	}, destinations)
+	require.NoError(t, router.Start())
+
+	// labels of OTLP requests are in the body, so they take the default route
+	req, err := http.NewRequest(http.MethodPost, relay.OTLPHTTPPath+"?name="+url.QueryEscape("api{team=payments}"), strings.NewReader("{}"))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	require.NoError(t, router.Send(req))
+	router.Flush(context.Background())
+
+	assert.Equal(t, []string{"shared"}, backendA.received())
+	assert.Equal(t, []string{"shared"}, backendB.received())
+}
+
+func TestRouterTenantSurvivesSpilling(t *testing.T) {
+	backend := &tenantRecorder{}
+	var remoteDown int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&remoteDown) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	store, err := relay.NewSpillStore(noopLogger(), &relay.SpillCfg{Dir: t.TempDir()})
+	require.NoError(t, err)
+	remoteClient := relay.NewRemoteClient(noopLogger(), &relay.RemoteClientCfg{Address: server.URL, TenantID: "tenant-a"})
+	queue := relay.NewRemoteQueue(noopLogger(), &relay.RemoteQueueCfg{NumWorkers: 1, Spill: store}, remoteClient)
+	router := relay.NewRouter(noopLogger(), &relay.RouterCfg{
+		Routes: []relay.RouteCfg{{Match: `{team="payments"}`, TenantID: "payments"}},
+	}, []relay.Destination{{Name: "a", Queue: queue}})
+	require.NoError(t, router.Start())
+
+	req, err := http.NewRequest(http.MethodPost, "/ingest?name="+url.QueryEscape("api{team=payments}"), strings.NewReader("profile"))
+	require.NoError(t, err)
+	require.NoError(t, router.Send(req))
+	router.Flush(context.Background())
+	require.Equal(t, 1, store.Len(), "request is spilled after failing")
+
+	atomic.StoreInt32(&remoteDown, 0)
+	router.DrainSpill()
+	router.Flush(context.Background())
+	require.NoError(t, router.Stop(context.Background()))
+
+	assert.Equal(t, []string{"payments"}, backend.received())
+}
+
+func TestRouterCfgValidate(t *testing.T) {
+	testCases := []struct {
+		match string
+		valid bool
+	}{
+		{match: `{team="payments"}`, valid: true},
+		{match: `my.app{env=~"prod.*"}`, valid: true},
+		{match: `my.app`, valid: true},
+		{match: ``},
+		{match: `{team="payments"`},
+		{match: `{team=payments}`},
+		{match: `{env=~"("}`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.match, func(t *testing.T) {
+			err := (&relay.RouterCfg{Routes: []relay.RouteCfg{{Match: tc.match}}}).Validate()
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, relay.ErrInvalidConfig)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package relay
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/internal/flameql"
+)
+
+// bytesBurst is how many seconds of BytesPerSecond can be relayed at once
+// Profilers upload every 10s, all profile types at once
+const bytesBurst = 10
+
+type SamplingCfg struct {
+	// Rate is the share of the execution environments whose profiles are relayed, between 0 and 1
+	// The decision is made once per session, so that the profiles of an environment are either all relayed or none
+	// 0 (the default) means 1, use a relabel rule to drop all profiles
+	Rate float64
+	// BytesPerSecond caps the size of the relayed profiles, 0 means no limit
+	BytesPerSecond int64
+	// ProfilesPerMinute caps the number of relayed profiles, 0 means no limit
+	ProfilesPerMinute int64
+}
+
+type SamplingOverride struct {
+	// Match is a flameql query, whose app name is optional, eg 'my.app{env="prod"}'
+	Match string
+	// Rate, BytesPerSecond and ProfilesPerMinute are the ones of SamplerCfg if nil
+	// so that an override can lift a limit with 0, its Rate can't be 0 though
+	// Profiles matching an override are limited by its own buckets, rather than the global ones
+	Rate              *float64
+	BytesPerSecond    *int64
+	ProfilesPerMinute *int64
+}
+
+// samplingCfg returns the config of the override, inheriting the unset values from the global one
+func (o *SamplingOverride) samplingCfg(global SamplingCfg) SamplingCfg {
+	c := global
+	if o.Rate != nil {
+		c.Rate = *o.Rate
+	}
+	if o.BytesPerSecond != nil {
+		c.BytesPerSecond = *o.BytesPerSecond
+	}
+	if o.ProfilesPerMinute != nil {
+		c.ProfilesPerMinute = *o.ProfilesPerMinute
+	}
+	return c
+}
+
+type SamplerCfg struct {
+	SamplingCfg
+	// SessionID identifies the execution environment, it's what the sampling decision is based on
+	SessionID string
+	// Overrides are evaluated in order, the first one matching a profile is used
+	// Only profiles sent to /ingest can match them, since the labels of others are in the body
+	Overrides []SamplingOverride
+	Metrics   *Metrics
+}
+
+type samplingPolicy struct {
+	query    *flameql.Query
+	sampled  bool
+	bytes    *tokenBucket
+	profiles *tokenBucket
+}
+
+// Sampler drops profiles to cap the cost of high volume functions, by sampling execution environments and rate limiting
+type Sampler struct {
+	log           *logrus.Entry
+	relayer       Relayer
+	metrics       *Metrics
+	overrides     []*samplingPolicy
+	defaultPolicy *samplingPolicy
+
+	// bucketsMu guards the token buckets of the policies
+	bucketsMu sync.Mutex
+}
+
+// NewSampler creates a sampler, invalid overrides are logged and skipped
+func NewSampler(log *logrus.Entry, config *SamplerCfg, relayer Relayer) *Sampler {
+	log = log.WithField("comp", "sampler")
+
+	// the same environment is sampled in by all the rates above its score
+	sum := sha256.Sum256([]byte(config.SessionID))
+	score := float64(binary.BigEndian.Uint64(sum[:8])) / math.MaxUint64
+
+	// Setup defaults
+	global := config.SamplingCfg
+	if global.Rate == 0 {
+		global.Rate = 1
+	}
+
+	newPolicy := func(c SamplingCfg) *samplingPolicy {
+		p := &samplingPolicy{sampled: score < c.Rate}
+		if c.BytesPerSecond > 0 {
+			p.bytes = newTokenBucket(float64(c.BytesPerSecond), float64(c.BytesPerSecond*bytesBurst))
+		}
+		if c.ProfilesPerMinute > 0 {
+			p.profiles = newTokenBucket(float64(c.ProfilesPerMinute)/60, float64(c.ProfilesPerMinute))
+		}
+		return p
+	}
+
+	s := &Sampler{
+		log:           log,
+		relayer:       relayer,
+		metrics:       config.Metrics,
+		defaultPolicy: newPolicy(global),
+	}
+	if !s.defaultPolicy.sampled {
+		log.Infof("Execution environment sampled out, its profiles won't be relayed (rate: %g)", global.Rate)
+	}
+	for _, o := range config.Overrides {
+		q, err := parseMatch(o.Match)
+		if err != nil {
+			log.Errorf("Skipping sampling override '%s': %v", o.Match, err)
+			continue
+		}
+		p := newPolicy(o.samplingCfg(global))
+		p.query = q
+		s.overrides = append(s.overrides, p)
+	}
+	return s
+}
+
+// Send relays the request, unless it's sampled out or over the limits
+func (s *Sampler) Send(req *http.Request) error {
+	p := s.policy(req)
+	if !p.sampled {
+		s.metrics.requestSampledOut()
+		return nil
+	}
+
+	size := req.ContentLength
+	if size < 0 {
+		size = 0
+	}
+	if !s.allow(p, size) {
+		s.log.Debugf("Rate limited profile of %d bytes", size)
+		s.metrics.requestRateLimited()
+		return nil
+	}
+	return s.relayer.Send(req)
+}
+
+// allow reports whether a profile of size bytes is within the limits of the policy
+// It only counts against both limits if it's within both
+func (s *Sampler) allow(p *samplingPolicy, size int64) bool {
+	s.bucketsMu.Lock()
+	defer s.bucketsMu.Unlock()
+
+	now := time.Now()
+	if !p.profiles.allow(now, 1) || !p.bytes.allow(now, float64(size)) {
+		return false
+	}
+	p.profiles.take(1)
+	p.bytes.take(float64(size))
+	return true
+}
+
+func (s *Sampler) policy(req *http.Request) *samplingPolicy {
+	if len(s.overrides) == 0 || req.URL.Path != "/ingest" {
+		return s.defaultPolicy
+	}
+	key, err := flameql.ParseKey(req.URL.Query().Get("name"))
+	if err != nil {
+		return s.defaultPolicy
+	}
+
+	for _, p := range s.overrides {
+		if matchKey(key, p.query) {
+			return p
+		}
+	}
+	return s.defaultPolicy
+}
+
+// tokenBucket refills at rate tokens per second, up to capacity
+// Requests bigger than the capacity are allowed once the bucket is full, so that they are relayed too,
+// and the debt is paid back before the next one
+// All methods are safe to call on a nil tokenBucket, which has no limit
+type tokenBucket struct {
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(rate float64, capacity float64) *tokenBucket {
+	return &tokenBucket{rate: rate, capacity: capacity, tokens: capacity}
+}
+
+// allow refills the bucket and reports whether there are enough tokens for n
+func (b *tokenBucket) allow(now time.Time, n float64) bool {
+	if b == nil {
+		return true
+	}
+
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	return b.tokens >= math.Min(n, b.capacity)
+}
+
+func (b *tokenBucket) take(n float64) {
+	if b == nil {
+		return
+	}
+	b.tokens -= n
+}
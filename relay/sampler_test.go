@@ -0,0 +1,229 @@
+package relay_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func newSampledRequest(t *testing.T, name string, size int) *http.Request {
+	req, err := http.NewRequest(http.MethodPost, "/ingest?name="+url.QueryEscape(name), strings.NewReader(strings.Repeat("a", size)))
+	require.NoError(t, err)
+	return req
+}
+
+// sampledIn reports whether the profiles of the session are relayed
+func sampledIn(t *testing.T, config relay.SamplerCfg, name string) bool {
+	next := &recordingRelayer{}
+	sampler := relay.NewSampler(noopLogger(), &config, next)
+	require.NoError(t, sampler.Send(newSampledRequest(t, name, 1)))
+	return len(next.Requests()) == 1
+}
+
+func TestSamplerSampling(t *testing.T) {
+	var sampled, sampledAtHalf int
+	for i := 0; i < 1000; i++ {
+		sessionID := fmt.Sprintf("session-%d", i)
+		in := sampledIn(t, relay.SamplerCfg{SamplingCfg: relay.SamplingCfg{Rate: 0.2}, SessionID: sessionID}, "my.app{}")
+		// the decision is made once per session
+		assert.Equal(t, in, sampledIn(t, relay.SamplerCfg{SamplingCfg: relay.SamplingCfg{Rate: 0.2}, SessionID: sessionID}, "my.app{}"))
+		// sessions sampled in at a rate are sampled in at higher ones
+		inAtHalf := sampledIn(t, relay.SamplerCfg{SamplingCfg: relay.SamplingCfg{Rate: 0.5}, SessionID: sessionID}, "my.app{}")
+		if in {
+			assert.True(t, inAtHalf)
+			sampled++
+		}
+		if inAtHalf {
+			sampledAtHalf++
+		}
+	}
+	assert.InDelta(t, 200, sampled, 50)
+	assert.InDelta(t, 500, sampledAtHalf, 60)
+
+	// all of them by default
+	assert.True(t, sampledIn(t, relay.SamplerCfg{SessionID: "session-0"}, "my.app{}"))
+}
+
+func TestSamplerOverrides(t *testing.T) {
+	// find a session sampled out at 1%
+	var sessionID string
+	for i := 0; sessionID == ""; i++ {
+		id := fmt.Sprintf("session-%d", i)
+		if !sampledIn(t, relay.SamplerCfg{SamplingCfg: relay.SamplingCfg{Rate: 0.01}, SessionID: id}, "my.app{}") {
+			sessionID = id
+		}
+	}
+
+	config := relay.SamplerCfg{
+		SamplingCfg: relay.SamplingCfg{Rate: 0.01},
+		SessionID:   sessionID,
+		Overrides: []relay.SamplingOverride{
+			{Match: `{env="prod"}`, Rate: ptr(1.0)},
+			{Match: `other.app`, ProfilesPerMinute: ptr[int64](10)},
+		},
+	}
+	assert.False(t, sampledIn(t, config, "my.app{env=dev}"))
+	assert.True(t, sampledIn(t, config, "my.app{env=prod}"))
+	assert.False(t, sampledIn(t, config, "other.app{}"), "the rate is inherited")
+}
+
+func TestSamplerRateLimits(t *testing.T) {
+	testCases := []struct {
+		name     string
+		config   relay.SamplingCfg
+		sizes    []int
+		expected []bool
+	}{
+		{
+			name:     "profiles per minute",
+			config:   relay.SamplingCfg{ProfilesPerMinute: 3},
+			sizes:    []int{1, 1, 1, 1, 1},
+			expected: []bool{true, true, true, false, false},
+		},
+		{
+			// up to 10s worth of bytes at once
+			name:     "bytes per second",
+			config:   relay.SamplingCfg{BytesPerSecond: 100},
+			sizes:    []int{600, 600, 400},
+			expected: []bool{true, false, true},
+		},
+		{
+			// it's let through, but consumes the following ones
+			name:     "profile bigger than the bytes burst",
+			config:   relay.SamplingCfg{BytesPerSecond: 100},
+			sizes:    []int{2000, 1},
+			expected: []bool{true, false},
+		},
+		{
+			name:     "both limits apply",
+			config:   relay.SamplingCfg{BytesPerSecond: 100, ProfilesPerMinute: 2},
+			sizes:    []int{600, 600, 1, 1},
+			expected: []bool{true, false, true, false},
+		},
+		{
+			name:     "no limits",
+			sizes:    []int{1 << 20, 1 << 20, 1 << 20},
+			expected: []bool{true, true, true},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics := relay.NewMetrics()
+			next := &recordingRelayer{}
+			sampler := relay.NewSampler(noopLogger(), &relay.SamplerCfg{SamplingCfg: tc.config, Metrics: metrics}, next)
+
+			var relayed []bool
+			var limited int64
+			for _, size := range tc.sizes {
+				before := len(next.Requests())
+				require.NoError(t, sampler.Send(newSampledRequest(t, "my.app{}", size)))
+				ok := len(next.Requests()) > before
+				relayed = append(relayed, ok)
+				if !ok {
+					limited++
+				}
+			}
+			assert.Equal(t, tc.expected, relayed)
+			assert.Equal(t, limited, metrics.Summary()["rateLimited"])
+			assert.Equal(t, int64(0), metrics.Summary()["sampledOut"])
+		})
+	}
+}
+
+func TestSamplerOverrideBuckets(t *testing.T) {
+	next := &recordingRelayer{}
+	sampler := relay.NewSampler(noopLogger(), &relay.SamplerCfg{
+		SamplingCfg: relay.SamplingCfg{ProfilesPerMinute: 1},
+		Overrides:   []relay.SamplingOverride{{Match: `noisy.app`}},
+	}, next)
+
+	// the override inherits the limit, but has its own bucket
+	for _, name := range []string{"noisy.app{}", "noisy.app{}", "my.app{}", "my.app{}"} {
+		require.NoError(t, sampler.Send(newSampledRequest(t, name, 1)))
+	}
+	var names []string
+	for _, req := range next.Requests() {
+		names = append(names, req.URL.Query().Get("name"))
+	}
+	assert.Equal(t, []string{"noisy.app{}", "my.app{}"}, names)
+}
+
+func TestSamplerOverrideLiftsLimits(t *testing.T) {
+	next := &recordingRelayer{}
+	sampler := relay.NewSampler(noopLogger(), &relay.SamplerCfg{
+		SamplingCfg: relay.SamplingCfg{BytesPerSecond: 1, ProfilesPerMinute: 1},
+		Overrides: []relay.SamplingOverride{
+			{Match: `unlimited.app`, BytesPerSecond: ptr[int64](0), ProfilesPerMinute: ptr[int64](0)},
+			{Match: `bytes.app`, ProfilesPerMinute: ptr[int64](0)},
+		},
+	}, next)
+
+	for _, name := range []string{"unlimited.app{}", "unlimited.app{}", "unlimited.app{}", "bytes.app{}", "bytes.app{}", "my.app{}", "my.app{}"} {
+		require.NoError(t, sampler.Send(newSampledRequest(t, name, 100)))
+	}
+	var names []string
+	for _, req := range next.Requests() {
+		names = append(names, req.URL.Query().Get("name"))
+	}
+	// the bytes limit is still inherited, and lets a bigger profile through once
+	assert.Equal(t, []string{"unlimited.app{}", "unlimited.app{}", "unlimited.app{}", "bytes.app{}", "my.app{}"}, names)
+}
+
+func TestSamplerMetrics(t *testing.T) {
+	var sessionID string
+	for i := 0; sessionID == ""; i++ {
+		id := fmt.Sprintf("session-%d", i)
+		if !sampledIn(t, relay.SamplerCfg{SamplingCfg: relay.SamplingCfg{Rate: 0.5}, SessionID: id}, "my.app{}") {
+			sessionID = id
+		}
+	}
+
+	metrics := relay.NewMetrics()
+	sampler := relay.NewSampler(noopLogger(), &relay.SamplerCfg{
+		SamplingCfg: relay.SamplingCfg{Rate: 0.5},
+		SessionID:   sessionID,
+		Metrics:     metrics,
+	}, &recordingRelayer{})
+	require.NoError(t, sampler.Send(newSampledRequest(t, "my.app{}", 1)))
+
+	summary := metrics.Summary()
+	assert.Equal(t, int64(1), summary["sampledOut"])
+	assert.Equal(t, int64(0), summary["dropped"], "overflow drops are counted separately")
+
+	w := &strings.Builder{}
+	metrics.WritePrometheus(w)
+	assert.Contains(t, w.String(), "pyroscope_extension_requests_sampled_out_total 1\n")
+	assert.Contains(t, w.String(), "pyroscope_extension_requests_rate_limited_total 0\n")
+}
+
+func TestSamplerCfgValidate(t *testing.T) {
+	assert.NoError(t, (&relay.SamplerCfg{
+		SamplingCfg: relay.SamplingCfg{Rate: 0.1, BytesPerSecond: 1000},
+		Overrides:   []relay.SamplingOverride{{Match: `{env="prod"}`, Rate: ptr(1.0)}},
+	}).Validate())
+	assert.ErrorIs(t, (&relay.SamplerCfg{SamplingCfg: relay.SamplingCfg{Rate: 1.5}}).Validate(), relay.ErrInvalidConfig)
+	assert.ErrorIs(t, (&relay.SamplerCfg{SamplingCfg: relay.SamplingCfg{ProfilesPerMinute: -1}}).Validate(), relay.ErrInvalidConfig)
+	assert.ErrorIs(t, (&relay.SamplerCfg{Overrides: []relay.SamplingOverride{{Match: `{env=prod}`}}}).Validate(), relay.ErrInvalidConfig)
+	assert.ErrorIs(t, (&relay.SamplerCfg{Overrides: []relay.SamplingOverride{
+		{Match: `my.app`, Rate: ptr(-1.0)},
+	}}).Validate(), relay.ErrInvalidConfig)
+	assert.ErrorIs(t, (&relay.SamplerCfg{Overrides: []relay.SamplingOverride{
+		{Match: `my.app`, Rate: ptr(0.0)},
+	}}).Validate(), relay.ErrInvalidConfig, "a rate of 0 would drop all profiles")
+	assert.NoError(t, (&relay.SamplerCfg{
+		SamplingCfg: relay.SamplingCfg{ProfilesPerMinute: 10},
+		Overrides:   []relay.SamplingOverride{{Match: `my.app`, ProfilesPerMinute: ptr[int64](0)}},
+	}).Validate(), "an override can lift a limit")
+}
@@ -9,12 +9,15 @@ import (
 
 type ServerCfg struct {
 	ServerAddress string
+	// UnencryptedHTTP2 enables HTTP/2 without TLS (h2c), eg to serve gRPC
+	UnencryptedHTTP2 bool
 }
 
 type Server struct {
 	config *ServerCfg
 	log    *logrus.Entry
 	server *http.Server
+	mux    *http.ServeMux
 }
 
 func NewServer(logger *logrus.Entry, config *ServerCfg, handlerFunc http.HandlerFunc) *Server {
@@ -23,17 +26,29 @@ func NewServer(logger *logrus.Entry, config *ServerCfg, handlerFunc http.Handler
 		Handler: mux,
 		Addr:    config.ServerAddress,
 	}
+	if config.UnencryptedHTTP2 {
+		svr.Protocols = new(http.Protocols)
+		svr.Protocols.SetHTTP1(true)
+		svr.Protocols.SetUnencryptedHTTP2(true)
+	}
 
 	server := &Server{
 		config: config,
 		log:    logger,
 		server: svr,
+		mux:    mux,
 	}
 
 	mux.Handle("/", handlerFunc)
 	return server
 }
 
+// Handle registers an additional handler, eg for MetricsPath
+// It must be called before Start
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
 // Start starts serving requests, this is a blocking operation
 func (s *Server) Start() error {
 	s.log.Debugf("Serving on %s", s.config.ServerAddress)
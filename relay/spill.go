@@ -0,0 +1,263 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var ErrSpillFull = errors.New("spill store is full")
+
+const spillFileExt = ".json"
+
+type SpillCfg struct {
+	// Dir is where spilled requests are stored, it should live under /tmp
+	// so that it survives between invocations of the same execution environment
+	Dir string
+	// MaxBytes caps the total size of the spilled requests on disk
+	MaxBytes int64
+	// MaxAge is how long a spilled request is kept before being discarded
+	MaxAge time.Duration
+}
+
+// SpillStore persists requests that could not be delivered, so that they can be retried later
+type SpillStore struct {
+	config *SpillCfg
+	log    *logrus.Entry
+
+	mu  sync.Mutex
+	seq uint64
+}
+
+// spilledRequest is the on disk representation of a request
+type spilledRequest struct {
+	Method    string      `json:"method"`
+	URL       string      `json:"url"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body"`
+	CreatedAt time.Time   `json:"createdAt"`
+	// TenantID is the tenant of the route the request took, if any
+	TenantID string `json:"tenantId,omitempty"`
+}
+
+func NewSpillStore(log *logrus.Entry, config *SpillCfg) (*SpillStore, error) {
+	// Setup defaults
+	if config.Dir == "" {
+		config.Dir = filepath.Join(os.TempDir(), "pyroscope-spill")
+	}
+	if config.MaxBytes == 0 {
+		config.MaxBytes = 50 * 1024 * 1024
+	}
+	if config.MaxAge == 0 {
+		config.MaxAge = time.Hour
+	}
+
+	if err := os.MkdirAll(config.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create spill dir: %w", err)
+	}
+
+	return &SpillStore{
+		config: config,
+		log:    log.WithField("comp", "spill"),
+	}, nil
+}
+
+// Put serializes the request to disk
+// The request body is consumed, unless it can be replayed via GetBody
+func (s *SpillStore) Put(req *http.Request) error {
+	body, err := readReplayableBody(req)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(spilledRequest{
+		Method:    req.Method,
+		URL:       req.URL.String(),
+		Header:    req.Header,
+		Body:      body,
+		CreatedAt: time.Now(),
+		TenantID:  tenantIDFrom(req.Context()),
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.entries()
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, e := range entries {
+		if time.Since(e.modTime) > s.config.MaxAge {
+			// expired, make room for fresher data
+			_ = os.Remove(e.path)
+			continue
+		}
+		total += e.size
+	}
+	if total+int64(len(data)) > s.config.MaxBytes {
+		return ErrSpillFull
+	}
+
+	s.seq++
+	name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), s.seq%1000000, spillFileExt)
+	tmp := filepath.Join(s.config.Dir, "."+name)
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	// rename is atomic, so that a partially written file is never read
+	return os.Rename(tmp, filepath.Join(s.config.Dir, name))
+}
+
+// Drain removes up to limit requests from disk (oldest first) and passes them to fn
+// Expired or unreadable requests are discarded
+// A negative limit means no limit
+// fn is called without holding any lock, so it's free to Put the request back
+func (s *SpillStore) Drain(limit int, fn func(*http.Request)) (int, error) {
+	reqs, err := s.take(limit)
+	for _, req := range reqs {
+		fn(req)
+	}
+	return len(reqs), err
+}
+
+func (s *SpillStore) take(limit int) ([]*http.Request, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.entries()
+	if err != nil {
+		return nil, err
+	}
+
+	var reqs []*http.Request
+	for _, e := range entries {
+		if limit >= 0 && len(reqs) >= limit {
+			break
+		}
+
+		req, err := s.load(e.path)
+		if rmErr := os.Remove(e.path); rmErr != nil {
+			s.log.Errorf("Failed to remove spilled request '%s'. Error: %v", e.path, rmErr)
+		}
+		if err != nil {
+			s.log.Warnf("Discarding spilled request '%s'. Error: %v", e.path, err)
+			continue
+		}
+
+		reqs = append(reqs, req)
+	}
+
+	return reqs, nil
+}
+
+// Len returns the number of spilled requests
+func (s *SpillStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.entries()
+	if err != nil {
+		return 0
+	}
+	return len(entries)
+}
+
+func (s *SpillStore) load(path string) (*http.Request, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var sr spilledRequest
+	if err := json.Unmarshal(data, &sr); err != nil {
+		return nil, err
+	}
+	if time.Since(sr.CreatedAt) > s.config.MaxAge {
+		return nil, fmt.Errorf("request is older than %s", s.config.MaxAge)
+	}
+
+	ctx := context.Background()
+	if sr.TenantID != "" {
+		ctx = withTenantID(ctx, sr.TenantID)
+	}
+	req, err := http.NewRequestWithContext(ctx, sr.Method, sr.URL, bytes.NewReader(sr.Body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = sr.Header
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	return req, nil
+}
+
+type spillEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// entries lists the spilled requests, oldest first
+func (s *SpillStore) entries() ([]spillEntry, error) {
+	dirEntries, err := os.ReadDir(s.config.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []spillEntry
+	for _, de := range dirEntries {
+		name := de.Name()
+		if de.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, spillFileExt) {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, spillEntry{
+			path:    filepath.Join(s.config.Dir, name),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+
+	// file names are prefixed with a zero padded timestamp
+	sort.Slice(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+	return entries, nil
+}
+
+// readReplayableBody reads the request body
+// If possible, it uses GetBody so that the request can still be sent afterwards
+func readReplayableBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+
+	body := req.Body
+	if req.GetBody != nil {
+		var err error
+		body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer body.Close()
+
+	return io.ReadAll(body)
+}
@@ -0,0 +1,169 @@
+package relay_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+)
+
+func TestSpillStoreRoundtrip(t *testing.T) {
+	profile := readTestdataFile(t, "testdata/profile.pprof")
+
+	store, err := relay.NewSpillStore(noopLogger(), &relay.SpillCfg{Dir: t.TempDir()})
+	require.NoError(t, err)
+
+	endpoint := "/ingest?name=my.app%7B%7D&spyName=gospy"
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(profile))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "binary/octet-stream")
+		require.NoError(t, store.Put(req))
+	}
+	assert.Equal(t, 3, store.Len())
+
+	var drained []*http.Request
+	n, err := store.Drain(2, func(req *http.Request) {
+		drained = append(drained, req)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, 1, store.Len())
+
+	for _, req := range drained {
+		assert.Equal(t, http.MethodPost, req.Method)
+		assert.Equal(t, endpoint, req.URL.String())
+		assert.Equal(t, "binary/octet-stream", req.Header.Get("Content-Type"))
+
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		assert.Equal(t, profile, body)
+	}
+}
+
+func TestSpillStoreMaxBytes(t *testing.T) {
+	profile := readTestdataFile(t, "testdata/profile.pprof")
+
+	store, err := relay.NewSpillStore(noopLogger(), &relay.SpillCfg{
+		Dir: t.TempDir(),
+		// the body is base64 encoded, so only a single request fits
+		MaxBytes: int64(len(profile)) * 2,
+	})
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodPost, "/ingest", bytes.NewReader(profile))
+	require.NoError(t, err)
+	require.NoError(t, store.Put(req))
+
+	assert.ErrorIs(t, store.Put(req), relay.ErrSpillFull)
+	assert.Equal(t, 1, store.Len())
+}
+
+func TestSpillStoreDiscardsExpiredRequests(t *testing.T) {
+	store, err := relay.NewSpillStore(noopLogger(), &relay.SpillCfg{
+		Dir:    t.TempDir(),
+		MaxAge: time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodPost, "/ingest", nil)
+	require.NoError(t, err)
+	require.NoError(t, store.Put(req))
+
+	time.Sleep(time.Millisecond * 5)
+
+	n, err := store.Drain(-1, func(*http.Request) {
+		t.Fatal("expired request should not be drained")
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, 0, store.Len())
+}
+
+func TestRemoteQueueSpillsTransientFailures(t *testing.T) {
+	store, err := relay.NewSpillStore(noopLogger(), &relay.SpillCfg{Dir: t.TempDir()})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	remoteDown := true
+	var mu sync.Mutex
+	relayer := mockRelayer{
+		fn: func(r *http.Request) error {
+			defer wg.Done()
+			mu.Lock()
+			defer mu.Unlock()
+			if remoteDown {
+				return relay.ErrMakingRequest
+			}
+			return nil
+		},
+	}
+
+	queue := relay.NewRemoteQueue(noopLogger(), &relay.RemoteQueueCfg{Spill: store}, relayer)
+	require.NoError(t, queue.Start())
+
+	req, err := http.NewRequest(http.MethodPost, "/ingest", nil)
+	require.NoError(t, err)
+
+	wg.Add(1)
+	require.NoError(t, queue.Send(req))
+	wg.Wait()
+	queue.Flush(context.Background())
+	assert.Equal(t, 1, store.Len(), "request is spilled after failing")
+
+	mu.Lock()
+	remoteDown = false
+	mu.Unlock()
+
+	wg.Add(1)
+	queue.DrainSpill()
+	wg.Wait()
+	queue.Flush(context.Background())
+	assert.Equal(t, 0, store.Len(), "spilled request is relayed")
+}
+
+func TestSpillStoreDrainIntoFullQueue(t *testing.T) {
+	store, err := relay.NewSpillStore(noopLogger(), &relay.SpillCfg{Dir: t.TempDir()})
+	require.NoError(t, err)
+
+	// not started, so that the queue stays full
+	queue := relay.NewRemoteQueue(noopLogger(), &relay.RemoteQueueCfg{Spill: store}, mockRelayer{
+		fn: func(r *http.Request) error { return nil },
+	})
+	for i := 0; i < 20; i++ {
+		req, err := http.NewRequest(http.MethodPost, "/ingest", nil)
+		require.NoError(t, err)
+		require.NoError(t, queue.Send(req))
+	}
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest(http.MethodPost, "/ingest", nil)
+		require.NoError(t, err)
+		require.NoError(t, store.Put(req))
+	}
+
+	drained := make(chan int)
+	go func() {
+		// the queue spills the requests back
+		n, err := store.Drain(-1, func(req *http.Request) {
+			assert.NoError(t, queue.Send(req))
+		})
+		assert.NoError(t, err)
+		drained <- n
+	}()
+
+	select {
+	case n := <-drained:
+		assert.Equal(t, 3, n)
+	case <-time.After(time.Second * 5):
+		t.Fatal("draining into a full queue deadlocked")
+	}
+	assert.Equal(t, 3, store.Len())
+}
@@ -0,0 +1,110 @@
+package relay
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var ErrInvalidTLSConfig = errors.New("invalid tls config")
+
+// TLSCfg configures the TLS connections to the remote
+// Certificates and keys are PEM encoded, and can be either read from a file or passed inline
+type TLSCfg struct {
+	// CAFile and CA are CAs trusted in addition to the system ones, eg a private CA
+	CAFile string
+	CA     string
+	// CertFile/KeyFile or Cert/Key are the client certificate, for mTLS
+	CertFile string
+	KeyFile  string
+	Cert     string
+	Key      string
+	// ServerName overrides the name the server certificate is verified against
+	ServerName string
+	// MinVersion is the minimum TLS version, eg '1.2'. Defaults to Go's default
+	MinVersion string
+}
+
+// IsZero reports whether the config doesn't change the default TLS settings
+func (c *TLSCfg) IsZero() bool {
+	return c == nil || *c == TLSCfg{}
+}
+
+// ParseTLSVersion parses a TLS version, eg '1.2'
+func ParseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unknown tls version '%s'", s)
+	}
+}
+
+// build creates the tls.Config, reading the files it refers to
+func (c *TLSCfg) build() (*tls.Config, error) {
+	minVersion, err := ParseTLSVersion(c.MinVersion)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTLSConfig, err)
+	}
+	config := &tls.Config{
+		ServerName: c.ServerName,
+		MinVersion: minVersion,
+	}
+
+	caPEM, err := pemFromFileOr(c.CAFile, c.CA)
+	if err != nil {
+		return nil, fmt.Errorf("%w: ca: %v", ErrInvalidTLSConfig, err)
+	}
+	if len(caPEM) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("%w: ca: no certificates found", ErrInvalidTLSConfig)
+		}
+		config.RootCAs = pool
+	}
+
+	certPEM, err := pemFromFileOr(c.CertFile, c.Cert)
+	if err != nil {
+		return nil, fmt.Errorf("%w: cert: %v", ErrInvalidTLSConfig, err)
+	}
+	keyPEM, err := pemFromFileOr(c.KeyFile, c.Key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: key: %v", ErrInvalidTLSConfig, err)
+	}
+	switch {
+	case len(certPEM) > 0 && len(keyPEM) > 0:
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("%w: client certificate: %v", ErrInvalidTLSConfig, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	case len(certPEM) > 0 || len(keyPEM) > 0:
+		return nil, fmt.Errorf("%w: a client certificate requires both a cert and a key", ErrInvalidTLSConfig)
+	}
+
+	return config, nil
+}
+
+// pemFromFileOr reads file if set, otherwise returns inline
+func pemFromFileOr(file string, inline string) ([]byte, error) {
+	if file != "" {
+		if inline != "" {
+			return nil, errors.New("both a file and an inline value are set")
+		}
+		return os.ReadFile(file)
+	}
+	return []byte(inline), nil
+}
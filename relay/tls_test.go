@@ -0,0 +1,148 @@
+package relay_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+)
+
+// newClientCert creates a CA and a client certificate signed by it, PEM encoded
+func newClientCert(t *testing.T) (caPEM []byte, certPEM []byte, keyPEM []byte) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "lambda"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+	return path
+}
+
+func TestRemoteClientMTLS(t *testing.T) {
+	clientCAPEM, certPEM, keyPEM := newClientCert(t)
+	clientCAs := x509.NewCertPool()
+	require.True(t, clientCAs.AppendCertsFromPEM(clientCAPEM))
+
+	remoteServer := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "lambda", r.TLS.PeerCertificates[0].Subject.CommonName)
+		}),
+	)
+	remoteServer.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+		MaxVersion: tls.VersionTLS12,
+	}
+	remoteServer.StartTLS()
+	t.Cleanup(remoteServer.Close)
+
+	serverCAPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: remoteServer.Certificate().Raw})
+	caFile := writeFile(t, "ca.pem", serverCAPEM)
+	certFile := writeFile(t, "cert.pem", certPEM)
+	keyFile := writeFile(t, "key.pem", keyPEM)
+
+	testCases := []struct {
+		name string
+		tls  *relay.TLSCfg
+		ok   bool
+	}{
+		{"unknown ca", nil, false},
+		{"no client certificate", &relay.TLSCfg{CAFile: caFile}, false},
+		{"files", &relay.TLSCfg{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}, true},
+		{"inline", &relay.TLSCfg{CA: string(serverCAPEM), Cert: string(certPEM), Key: string(keyPEM)}, true},
+		// the httptest certificate is valid for example.com
+		{"server name", &relay.TLSCfg{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerName: "example.com"}, true},
+		{"wrong server name", &relay.TLSCfg{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerName: "pyroscope.internal"}, false},
+		{"min version", &relay.TLSCfg{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, MinVersion: "1.3"}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &relay.RemoteClientCfg{Address: remoteServer.URL, TLS: tc.tls}
+			require.NoError(t, cfg.Validate())
+			remoteClient := relay.NewRemoteClient(noopLogger(), cfg)
+
+			req, err := http.NewRequest(http.MethodPost, "/ingest", nil)
+			require.NoError(t, err)
+			err = remoteClient.Send(req)
+			if tc.ok {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, relay.ErrMakingRequest)
+			}
+		})
+	}
+}
+
+func TestTLSCfgValidate(t *testing.T) {
+	_, certPEM, keyPEM := newClientCert(t)
+
+	testCases := []struct {
+		name string
+		tls  relay.TLSCfg
+	}{
+		{"missing file", relay.TLSCfg{CAFile: filepath.Join(t.TempDir(), "missing.pem")}},
+		{"invalid ca", relay.TLSCfg{CA: "not a certificate"}},
+		{"file and inline", relay.TLSCfg{CertFile: writeFile(t, "cert.pem", certPEM), Cert: string(certPEM), Key: string(keyPEM)}},
+		{"cert without key", relay.TLSCfg{Cert: string(certPEM)}},
+		{"mismatched key", relay.TLSCfg{Cert: string(certPEM), Key: "not a key"}},
+		{"unknown version", relay.TLSCfg{MinVersion: "1.4"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &relay.RemoteClientCfg{Address: "https://example.com", TLS: &tc.tls}
+			err := cfg.Validate()
+			require.ErrorIs(t, err, relay.ErrInvalidTLSConfig)
+			assert.Equal(t, relay.ConfigErrorInvalidTLS, relay.ConfigErrorCategoryOf(err))
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// ConfigErrorCategory classifies configuration problems
+// It's reported to Lambda as the error type of a failed init, eg 'Extension.InvalidRemoteAddress'
+type ConfigErrorCategory string
+
+const (
+	ConfigErrorInvalidSetting       ConfigErrorCategory = "Extension.InvalidSetting"
+	ConfigErrorInvalidConfigFile    ConfigErrorCategory = "Extension.InvalidConfigFile"
+	ConfigErrorInvalidRemoteAddress ConfigErrorCategory = "Extension.InvalidRemoteAddress"
+	ConfigErrorInvalidAuth          ConfigErrorCategory = "Extension.InvalidAuth"
+	ConfigErrorInvalidHeaders       ConfigErrorCategory = "Extension.InvalidHeaders"
+	ConfigErrorInvalidTLS           ConfigErrorCategory = "Extension.InvalidTLS"
+	ConfigErrorUnresolvedSecret     ConfigErrorCategory = "Extension.UnresolvedSecret"
+)
+
+var ErrInvalidConfig = errors.New("invalid config")
+
+// ConfigError is a configuration problem, it wraps ErrInvalidConfig
+type ConfigError struct {
+	Category ConfigErrorCategory
+	Err      error
+}
+
+func NewConfigError(category ConfigErrorCategory, format string, args ...interface{}) *ConfigError {
+	return &ConfigError{Category: category, Err: fmt.Errorf(format, args...)}
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrInvalidConfig, e.Err)
+}
+
+func (e *ConfigError) Unwrap() []error {
+	return []error{ErrInvalidConfig, e.Err}
+}
+
+// ConfigErrorCategoryOf returns the category of the first ConfigError in err
+// Errors that are not a ConfigError are considered invalid settings
+func ConfigErrorCategoryOf(err error) ConfigErrorCategory {
+	var cfgErr *ConfigError
+	if errors.As(err, &cfgErr) {
+		return cfgErr.Category
+	}
+	return ConfigErrorInvalidSetting
+}
+
+// HasConfigErrorCategory reports whether any of the errors joined in err is a ConfigError of the given category
+func HasConfigErrorCategory(err error, category ConfigErrorCategory) bool {
+	var cfgErr *ConfigError
+	if errors.As(err, &cfgErr) && cfgErr.Category == category {
+		return true
+	}
+
+	switch err := err.(type) {
+	case interface{ Unwrap() []error }:
+		for _, e := range err.Unwrap() {
+			if HasConfigErrorCategory(e, category) {
+				return true
+			}
+		}
+	case interface{ Unwrap() error }:
+		return HasConfigErrorCategory(err.Unwrap(), category)
+	}
+	return false
+}
+
+// Validate checks the config, before defaults are applied
+func (c *RemoteClientCfg) Validate() error {
+	var errs []error
+
+	u, err := url.Parse(c.Address)
+	switch {
+	case err != nil:
+		errs = append(errs, NewConfigError(ConfigErrorInvalidRemoteAddress, "remote address '%s': %v", c.Address, err))
+	case u.Scheme != "http" && u.Scheme != "https":
+		errs = append(errs, NewConfigError(ConfigErrorInvalidRemoteAddress, "remote address '%s': scheme must be http or https", c.Address))
+	case u.Host == "":
+		errs = append(errs, NewConfigError(ConfigErrorInvalidRemoteAddress, "remote address '%s': missing host", c.Address))
+	}
+
+	hasBasicAuth := c.BasicAuthUser != "" || c.BasicAuthPassword != ""
+	if c.AuthToken != "" && hasBasicAuth {
+		errs = append(errs, NewConfigError(ConfigErrorInvalidAuth, "both an auth token and basic auth are set, only the token would be used"))
+	}
+	if hasBasicAuth && (c.BasicAuthUser == "" || c.BasicAuthPassword == "") {
+		errs = append(errs, NewConfigError(ConfigErrorInvalidAuth, "basic auth requires both a user and a password"))
+	}
+	if c.OAuth2 != nil {
+		if c.AuthToken != "" || hasBasicAuth {
+			errs = append(errs, NewConfigError(ConfigErrorInvalidAuth, "both oauth2 and an auth token or basic auth are set, only oauth2 would be used"))
+		}
+		errs = append(errs, c.OAuth2.Validate())
+	}
+
+	if c.HTTPHeadersJSON != "" {
+		var headers map[string]string
+		if err := json.Unmarshal([]byte(c.HTTPHeadersJSON), &headers); err != nil {
+			errs = append(errs, NewConfigError(ConfigErrorInvalidHeaders, "headers must be a JSON object of strings: %v", err))
+		}
+	}
+
+	if c.Timeout < 0 {
+		errs = append(errs, NewConfigError(ConfigErrorInvalidSetting, "timeout can't be negative: '%s'", c.Timeout))
+	}
+
+	if !c.TLS.IsZero() {
+		if _, err := c.TLS.build(); err != nil {
+			errs = append(errs, NewConfigError(ConfigErrorInvalidTLS, "%w", err))
+		}
+	}
+	if c.Transport != nil {
+		errs = append(errs, c.Transport.Validate())
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate checks the config, before defaults are applied
+func (c *OAuth2Cfg) Validate() error {
+	var errs []error
+
+	u, err := url.Parse(c.TokenURL)
+	switch {
+	case err != nil:
+		errs = append(errs, NewConfigError(ConfigErrorInvalidAuth, "oauth2 token url '%s': %v", c.TokenURL, err))
+	case u.Scheme != "http" && u.Scheme != "https":
+		errs = append(errs, NewConfigError(ConfigErrorInvalidAuth, "oauth2 token url '%s': scheme must be http or https", c.TokenURL))
+	case u.Host == "":
+		errs = append(errs, NewConfigError(ConfigErrorInvalidAuth, "oauth2 token url '%s': missing host", c.TokenURL))
+	}
+	if c.ClientID == "" || c.ClientSecret == "" {
+		errs = append(errs, NewConfigError(ConfigErrorInvalidAuth, "oauth2 requires both a client id and a client secret"))
+	}
+	if c.ExpiryMargin < 0 || c.Timeout < 0 {
+		errs = append(errs, NewConfigError(ConfigErrorInvalidSetting, "oauth2 expiry margin and timeout can't be negative: '%s', '%s'", c.ExpiryMargin, c.Timeout))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate checks the config, before defaults are applied
+func (c *TransportCfg) Validate() error {
+	var errs []error
+
+	if c.ProxyURL != "" {
+		if _, err := parseProxyURL(c.ProxyURL); err != nil {
+			errs = append(errs, NewConfigError(ConfigErrorInvalidSetting, "%v", err))
+		}
+	}
+	if c.DialTimeout < 0 || c.KeepAlive < 0 || c.TLSHandshakeTimeout < 0 || c.IdleConnTimeout < 0 {
+		errs = append(errs, NewConfigError(ConfigErrorInvalidSetting, "transport timeouts can't be negative: '%s', '%s', '%s', '%s'",
+			c.DialTimeout, c.KeepAlive, c.TLSHandshakeTimeout, c.IdleConnTimeout))
+	}
+	if c.PrewarmConnections < 0 {
+		errs = append(errs, NewConfigError(ConfigErrorInvalidSetting, "prewarm connections can't be negative: '%d'", c.PrewarmConnections))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate checks the config, the destinations of the routes are checked by the caller
+func (c *RouterCfg) Validate() error {
+	var errs []error
+
+	for _, r := range c.Routes {
+		if r.Match == "" {
+			errs = append(errs, NewConfigError(ConfigErrorInvalidSetting, "route to '%s' has no match", r.Destination))
+			continue
+		}
+		if _, err := parseMatch(r.Match); err != nil {
+			errs = append(errs, NewConfigError(ConfigErrorInvalidSetting, "route '%s': %v", r.Match, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate checks the config, before defaults are applied
+func (c *RelabelCfg) Validate() error {
+	var errs []error
+
+	for i, rule := range c.Rules {
+		if _, err := compileRelabelRule(rule); err != nil {
+			errs = append(errs, NewConfigError(ConfigErrorInvalidSetting, "relabel rule %d: %v", i, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate checks the config, before defaults are applied
+func (c *SamplerCfg) Validate() error {
+	errs := []error{c.SamplingCfg.validate("")}
+
+	for _, o := range c.Overrides {
+		if _, err := parseMatch(o.Match); err != nil {
+			errs = append(errs, NewConfigError(ConfigErrorInvalidSetting, "sampling override '%s': %v", o.Match, err))
+		}
+		if o.Rate != nil && *o.Rate == 0 {
+			errs = append(errs, NewConfigError(ConfigErrorInvalidSetting, "sampling override '%s': sampling rate must be greater than 0, use a relabel rule to drop all profiles", o.Match))
+		}
+		// unset values are the global ones, which are validated above
+		override := o.samplingCfg(SamplingCfg{})
+		errs = append(errs, override.validate(fmt.Sprintf("sampling override '%s': ", o.Match)))
+	}
+
+	return errors.Join(errs...)
+}
+
+// validate checks the config, prefix tells which one it is
+func (c *SamplingCfg) validate(prefix string) error {
+	var errs []error
+
+	if c.Rate < 0 || c.Rate > 1 {
+		errs = append(errs, NewConfigError(ConfigErrorInvalidSetting, "%ssampling rate must be between 0 and 1: '%g'", prefix, c.Rate))
+	}
+	if c.BytesPerSecond < 0 || c.ProfilesPerMinute < 0 {
+		errs = append(errs, NewConfigError(ConfigErrorInvalidSetting, "%srate limits can't be negative: '%d', '%d'", prefix, c.BytesPerSecond, c.ProfilesPerMinute))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate checks the config, before defaults are applied
+func (c *RemoteQueueCfg) Validate() error {
+	var errs []error
+
+	if c.NumWorkers < 0 {
+		errs = append(errs, NewConfigError(ConfigErrorInvalidSetting, "number of workers can't be negative: '%d'", c.NumWorkers))
+	}
+	if c.QueueSize < 0 {
+		errs = append(errs, NewConfigError(ConfigErrorInvalidSetting, "queue size can't be negative: '%d'", c.QueueSize))
+	}
+	if c.MaxQueueBytes < 0 {
+		errs = append(errs, NewConfigError(ConfigErrorInvalidSetting, "max queue bytes can't be negative: '%d'", c.MaxQueueBytes))
+	}
+	if c.BlockTimeout < 0 {
+		errs = append(errs, NewConfigError(ConfigErrorInvalidSetting, "block timeout can't be negative: '%s'", c.BlockTimeout))
+	}
+	if c.SpillOnStop && c.Spill == nil {
+		errs = append(errs, NewConfigError(ConfigErrorInvalidSetting, "spilling on stop requires spilling to be enabled"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate checks the config, before defaults are applied
+func (c *RetryCfg) Validate() error {
+	var errs []error
+
+	if c.MaxAttempts < 0 {
+		errs = append(errs, NewConfigError(ConfigErrorInvalidSetting, "max attempts can't be negative: '%d'", c.MaxAttempts))
+	}
+	if c.BaseBackoff < 0 || c.MaxBackoff < 0 {
+		errs = append(errs, NewConfigError(ConfigErrorInvalidSetting, "backoff can't be negative: '%s', '%s'", c.BaseBackoff, c.MaxBackoff))
+	}
+	if c.MaxBackoff > 0 && c.BaseBackoff > c.MaxBackoff {
+		errs = append(errs, NewConfigError(ConfigErrorInvalidSetting, "base backoff '%s' is greater than max backoff '%s'", c.BaseBackoff, c.MaxBackoff))
+	}
+	if c.Jitter < 0 || c.Jitter > 1 {
+		errs = append(errs, NewConfigError(ConfigErrorInvalidSetting, "jitter must be between 0 and 1: '%g'", c.Jitter))
+	}
+	for _, code := range c.RetryableStatusCodes {
+		if code < 100 || code > 599 {
+			errs = append(errs, NewConfigError(ConfigErrorInvalidSetting, "invalid retryable status code: '%d'", code))
+		}
+	}
+
+	return errors.Join(errs...)
+}
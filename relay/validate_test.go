@@ -0,0 +1,93 @@
+package relay_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
+)
+
+func TestRemoteClientCfgValidate(t *testing.T) {
+	testCases := []struct {
+		name     string
+		config   relay.RemoteClientCfg
+		category relay.ConfigErrorCategory
+	}{
+		{"valid", relay.RemoteClientCfg{Address: "https://example.com", AuthToken: "token"}, ""},
+		{"valid basic auth", relay.RemoteClientCfg{Address: "http://localhost:4040", BasicAuthUser: "user", BasicAuthPassword: "pass"}, ""},
+		{"missing scheme", relay.RemoteClientCfg{Address: "example.com"}, relay.ConfigErrorInvalidRemoteAddress},
+		{"unsupported scheme", relay.RemoteClientCfg{Address: "ftp://example.com"}, relay.ConfigErrorInvalidRemoteAddress},
+		{"missing host", relay.RemoteClientCfg{Address: "http://"}, relay.ConfigErrorInvalidRemoteAddress},
+		{"token and basic auth", relay.RemoteClientCfg{Address: "https://example.com", AuthToken: "token", BasicAuthUser: "user", BasicAuthPassword: "pass"}, relay.ConfigErrorInvalidAuth},
+		{"basic auth without password", relay.RemoteClientCfg{Address: "https://example.com", BasicAuthUser: "user"}, relay.ConfigErrorInvalidAuth},
+		{"invalid headers", relay.RemoteClientCfg{Address: "https://example.com", HTTPHeadersJSON: `{"a": 1}`}, relay.ConfigErrorInvalidHeaders},
+		{"negative timeout", relay.RemoteClientCfg{Address: "https://example.com", Timeout: -time.Second}, relay.ConfigErrorInvalidSetting},
+		{"valid oauth2", relay.RemoteClientCfg{Address: "https://example.com", OAuth2: &relay.OAuth2Cfg{TokenURL: "https://idp.example.com/token", ClientID: "id", ClientSecret: "secret"}}, ""},
+		{"oauth2 and token", relay.RemoteClientCfg{Address: "https://example.com", AuthToken: "token", OAuth2: &relay.OAuth2Cfg{TokenURL: "https://idp.example.com/token", ClientID: "id", ClientSecret: "secret"}}, relay.ConfigErrorInvalidAuth},
+		{"oauth2 invalid token url", relay.RemoteClientCfg{Address: "https://example.com", OAuth2: &relay.OAuth2Cfg{TokenURL: "idp.example.com", ClientID: "id", ClientSecret: "secret"}}, relay.ConfigErrorInvalidAuth},
+		{"oauth2 without secret", relay.RemoteClientCfg{Address: "https://example.com", OAuth2: &relay.OAuth2Cfg{TokenURL: "https://idp.example.com/token", ClientID: "id"}}, relay.ConfigErrorInvalidAuth},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.config.Validate()
+			if tc.category == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, relay.ErrInvalidConfig)
+			assert.Equal(t, tc.category, relay.ConfigErrorCategoryOf(err))
+		})
+	}
+}
+
+func TestHasConfigErrorCategory(t *testing.T) {
+	authErr := relay.NewConfigError(relay.ConfigErrorInvalidAuth, "auth")
+	addressErr := relay.NewConfigError(relay.ConfigErrorInvalidRemoteAddress, "address")
+
+	assert.False(t, relay.HasConfigErrorCategory(nil, relay.ConfigErrorInvalidRemoteAddress))
+	assert.False(t, relay.HasConfigErrorCategory(authErr, relay.ConfigErrorInvalidRemoteAddress))
+	assert.True(t, relay.HasConfigErrorCategory(addressErr, relay.ConfigErrorInvalidRemoteAddress))
+	assert.True(t, relay.HasConfigErrorCategory(errors.Join(authErr, addressErr), relay.ConfigErrorInvalidRemoteAddress), "not the first error")
+	assert.True(t, relay.HasConfigErrorCategory(
+		errors.Join(authErr, fmt.Errorf("destination 'a': %w", errors.Join(nil, addressErr))),
+		relay.ConfigErrorInvalidRemoteAddress,
+	), "nested")
+}
+
+func TestQueueAndRetryCfgValidate(t *testing.T) {
+	assert.NoError(t, (&relay.RemoteQueueCfg{}).Validate())
+	assert.NoError(t, (&relay.RetryCfg{MaxAttempts: 3, Jitter: 0.2, RetryableStatusCodes: []int{429}}).Validate())
+
+	assert.ErrorIs(t, (&relay.RemoteQueueCfg{NumWorkers: -1}).Validate(), relay.ErrInvalidConfig)
+	assert.ErrorIs(t, (&relay.RemoteQueueCfg{QueueSize: -1}).Validate(), relay.ErrInvalidConfig)
+	assert.ErrorIs(t, (&relay.RetryCfg{Jitter: 2}).Validate(), relay.ErrInvalidConfig)
+	assert.ErrorIs(t, (&relay.RetryCfg{BaseBackoff: time.Second, MaxBackoff: time.Millisecond}).Validate(), relay.ErrInvalidConfig)
+	assert.ErrorIs(t, (&relay.RetryCfg{RetryableStatusCodes: []int{42}}).Validate(), relay.ErrInvalidConfig)
+}
+
+func TestRemoteClientHeaders(t *testing.T) {
+	remoteServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "bar", r.Header.Get("X-Foo"))
+		}),
+	)
+	defer remoteServer.Close()
+
+	remoteClient := relay.NewRemoteClient(noopLogger(), &relay.RemoteClientCfg{
+		Address:         remoteServer.URL,
+		HTTPHeadersJSON: `{"X-Foo": "bar"}`,
+	})
+
+	req, err := http.NewRequest(http.MethodPost, "/ingest?name=my.app%7B%7D", bytes.NewReader(nil))
+	require.NoError(t, err)
+	assert.NoError(t, remoteClient.Send(req))
+}
@@ -0,0 +1,207 @@
+// Package secrets resolves settings that reference AWS SSM Parameter Store parameters or Secrets Manager secrets
+// eg 'ssm:/pyroscope/auth-token' or 'secretsmanager:pyroscope#token', where '#token' picks a key of a JSON secret
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	SourceSSM            = "ssm"
+	SourceSecretsManager = "secretsmanager"
+)
+
+var (
+	ErrInvalidReference = errors.New("invalid secret reference")
+	ErrFetchingSecret   = errors.New("failed to fetch secret")
+)
+
+// SSMAPI is the subset of the SSM client used to fetch parameters
+type SSMAPI interface {
+	GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
+}
+
+// SecretsManagerAPI is the subset of the Secrets Manager client used to fetch secrets
+type SecretsManagerAPI interface {
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// Reference points to a secret value
+type Reference struct {
+	Source string
+	ID     string
+	// JSONKey picks a key of a secret stored as a JSON object, optional
+	JSONKey string
+}
+
+// ParseReference parses a setting value, it returns false if it's not a reference
+func ParseReference(v string) (Reference, bool) {
+	source, id, ok := strings.Cut(v, ":")
+	if !ok || (source != SourceSSM && source != SourceSecretsManager) {
+		return Reference{}, false
+	}
+
+	ref := Reference{Source: source, ID: id}
+	if source == SourceSecretsManager {
+		ref.ID, ref.JSONKey, _ = strings.Cut(id, "#")
+	}
+	return ref, true
+}
+
+// IsReference returns whether any of the values references a secret
+func IsReference(values ...string) bool {
+	for _, v := range values {
+		if _, ok := ParseReference(v); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolver fetches and caches referenced secrets
+type Resolver struct {
+	log            *logrus.Entry
+	ssm            SSMAPI
+	secretsManager SecretsManagerAPI
+
+	mu    sync.Mutex
+	cache map[string]*cachedSecret
+}
+
+type cachedSecret struct {
+	ref   Reference
+	value string
+}
+
+func NewResolver(log *logrus.Entry, ssmClient SSMAPI, secretsManagerClient SecretsManagerAPI) *Resolver {
+	return &Resolver{
+		log:            log.WithField("comp", "secrets"),
+		ssm:            ssmClient,
+		secretsManager: secretsManagerClient,
+		cache:          make(map[string]*cachedSecret),
+	}
+}
+
+// Resolve returns the secret referenced by value, or value itself if it's not a reference
+// Secrets are only fetched the first time, subsequent calls return the cached value until Refresh is called
+func (r *Resolver) Resolve(ctx context.Context, value string) (string, error) {
+	ref, ok := ParseReference(value)
+	if !ok {
+		return value, nil
+	}
+
+	r.mu.Lock()
+	cached, ok := r.cache[value]
+	r.mu.Unlock()
+	if ok {
+		return cached.value, nil
+	}
+
+	secret, err := r.fetch(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+
+	r.mu.Lock()
+	r.cache[value] = &cachedSecret{ref: ref, value: secret}
+	r.mu.Unlock()
+	return secret, nil
+}
+
+// Refresh fetches again the cached secrets, to pick up rotations
+// Secrets that fail to be fetched keep their cached value, the errors are returned
+func (r *Resolver) Refresh(ctx context.Context) error {
+	r.mu.Lock()
+	refs := make(map[string]Reference, len(r.cache))
+	for value, cached := range r.cache {
+		refs[value] = cached.ref
+	}
+	r.mu.Unlock()
+
+	var errs []error
+	for value, ref := range refs {
+		secret, err := r.fetch(ctx, ref)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		r.mu.Lock()
+		cached := r.cache[value]
+		if cached.value != secret {
+			r.log.Infof("Secret '%s:%s' was rotated", ref.Source, ref.ID)
+		}
+		cached.value = secret
+		r.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Resolver) fetch(ctx context.Context, ref Reference) (string, error) {
+	if ref.ID == "" {
+		return "", fmt.Errorf("%w: missing id in '%s:'", ErrInvalidReference, ref.Source)
+	}
+
+	switch ref.Source {
+	case SourceSSM:
+		if r.ssm == nil {
+			return "", fmt.Errorf("%w: no SSM client", ErrFetchingSecret)
+		}
+		out, err := r.ssm.GetParameter(ctx, &ssm.GetParameterInput{
+			Name:           aws.String(ref.ID),
+			WithDecryption: aws.Bool(true),
+		})
+		if err != nil {
+			return "", fmt.Errorf("%w: '%s:%s': %v", ErrFetchingSecret, ref.Source, ref.ID, err)
+		}
+		if out.Parameter == nil {
+			return "", fmt.Errorf("%w: '%s:%s': empty parameter", ErrFetchingSecret, ref.Source, ref.ID)
+		}
+		return aws.ToString(out.Parameter.Value), nil
+
+	case SourceSecretsManager:
+		if r.secretsManager == nil {
+			return "", fmt.Errorf("%w: no Secrets Manager client", ErrFetchingSecret)
+		}
+		out, err := r.secretsManager.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+			SecretId: aws.String(ref.ID),
+		})
+		if err != nil {
+			return "", fmt.Errorf("%w: '%s:%s': %v", ErrFetchingSecret, ref.Source, ref.ID, err)
+		}
+		secret := aws.ToString(out.SecretString)
+		if ref.JSONKey == "" {
+			return secret, nil
+		}
+		return jsonKey(secret, ref.JSONKey)
+
+	default:
+		return "", fmt.Errorf("%w: unknown source '%s'", ErrInvalidReference, ref.Source)
+	}
+}
+
+// jsonKey returns a key of a secret stored as a JSON object
+func jsonKey(secret string, key string) (string, error) {
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(secret), &values); err != nil {
+		return "", fmt.Errorf("%w: secret is not a JSON object: %v", ErrFetchingSecret, err)
+	}
+	v, ok := values[key]
+	if !ok {
+		return "", fmt.Errorf("%w: key '%s' not found in secret", ErrFetchingSecret, key)
+	}
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(v), nil
+}
@@ -0,0 +1,206 @@
+package secrets_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/secrets"
+)
+
+func noopLogger() *logrus.Entry {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	return logger.WithFields(logrus.Fields{})
+}
+
+// fakeAWS implements the subset of the SSM and Secrets Manager APIs used by the resolver
+// Unexpected requests are recorded, to be checked from the test with err
+type fakeAWS struct {
+	mu     sync.Mutex
+	values map[string]string
+	calls  int
+	errs   []error
+}
+
+func (f *fakeAWS) set(id string, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.values[id] = value
+}
+
+func (f *fakeAWS) err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return errors.Join(f.errs...)
+}
+
+func (f *fakeAWS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		f.errs = append(f.errs, fmt.Errorf("request to %s is not signed with SigV4", r.Header.Get("X-Amz-Target")))
+	}
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		f.errs = append(f.errs, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	switch r.Header.Get("X-Amz-Target") {
+	case "AmazonSSM.GetParameter":
+		if body["WithDecryption"] != true {
+			f.errs = append(f.errs, errors.New("parameters are fetched without decryption"))
+		}
+		value, ok := f.values[body["Name"].(string)]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type": "ParameterNotFound", "message": "not found"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"Parameter": map[string]interface{}{"Name": body["Name"], "Value": value},
+		})
+	case "secretsmanager.GetSecretValue":
+		value, ok := f.values[body["SecretId"].(string)]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type": "ResourceNotFoundException", "message": "not found"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"SecretString": value})
+	default:
+		f.errs = append(f.errs, fmt.Errorf("unexpected target '%s'", r.Header.Get("X-Amz-Target")))
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// newTestResolver creates a resolver sending its requests to endpoint
+func newTestResolver(endpoint string) *secrets.Resolver {
+	cfg := aws.Config{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+	}
+	ssmClient := ssm.NewFromConfig(cfg, func(o *ssm.Options) {
+		o.BaseEndpoint = aws.String(endpoint)
+	})
+	secretsManagerClient := secretsmanager.NewFromConfig(cfg, func(o *secretsmanager.Options) {
+		o.BaseEndpoint = aws.String(endpoint)
+	})
+	return secrets.NewResolver(noopLogger(), ssmClient, secretsManagerClient)
+}
+
+func TestParseReference(t *testing.T) {
+	testCases := []struct {
+		value string
+		ref   secrets.Reference
+		ok    bool
+	}{
+		{"plain-token", secrets.Reference{}, false},
+		{"https://example.com", secrets.Reference{}, false},
+		{"ssm:/pyroscope/token", secrets.Reference{Source: "ssm", ID: "/pyroscope/token"}, true},
+		{"secretsmanager:pyroscope", secrets.Reference{Source: "secretsmanager", ID: "pyroscope"}, true},
+		{
+			"secretsmanager:arn:aws:secretsmanager:us-east-1:123456789012:secret:pyroscope#token",
+			secrets.Reference{Source: "secretsmanager", ID: "arn:aws:secretsmanager:us-east-1:123456789012:secret:pyroscope", JSONKey: "token"},
+			true,
+		},
+	}
+
+	for _, tc := range testCases {
+		ref, ok := secrets.ParseReference(tc.value)
+		assert.Equal(t, tc.ok, ok, tc.value)
+		assert.Equal(t, tc.ref, ref, tc.value)
+	}
+}
+
+func TestResolver(t *testing.T) {
+	fake := &fakeAWS{values: map[string]string{
+		"/pyroscope/token": "ssm-token",
+		"pyroscope":        `{"user": "admin", "password": "secret"}`,
+		"plain":            "plain-secret",
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	resolver := newTestResolver(server.URL)
+	ctx := context.Background()
+
+	v, err := resolver.Resolve(ctx, "not-a-reference")
+	require.NoError(t, err)
+	assert.Equal(t, "not-a-reference", v)
+
+	v, err = resolver.Resolve(ctx, "ssm:/pyroscope/token")
+	require.NoError(t, err)
+	assert.Equal(t, "ssm-token", v)
+
+	v, err = resolver.Resolve(ctx, "secretsmanager:pyroscope#password")
+	require.NoError(t, err)
+	assert.Equal(t, "secret", v)
+
+	v, err = resolver.Resolve(ctx, "secretsmanager:plain")
+	require.NoError(t, err)
+	assert.Equal(t, "plain-secret", v)
+
+	_, err = resolver.Resolve(ctx, "ssm:/missing")
+	assert.ErrorIs(t, err, secrets.ErrFetchingSecret)
+
+	_, err = resolver.Resolve(ctx, "secretsmanager:pyroscope#missing")
+	assert.ErrorIs(t, err, secrets.ErrFetchingSecret)
+
+	calls := fake.calls
+	_, err = resolver.Resolve(ctx, "ssm:/pyroscope/token")
+	require.NoError(t, err)
+	assert.Equal(t, calls, fake.calls, "values are cached")
+	assert.NoError(t, fake.err())
+}
+
+func TestResolverRefresh(t *testing.T) {
+	fake := &fakeAWS{values: map[string]string{"/pyroscope/token": "old"}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	resolver := newTestResolver(server.URL)
+	ctx := context.Background()
+
+	_, err := resolver.Resolve(ctx, "ssm:/pyroscope/token")
+	require.NoError(t, err)
+
+	fake.set("/pyroscope/token", "new")
+	v, err := resolver.Resolve(ctx, "ssm:/pyroscope/token")
+	require.NoError(t, err)
+	assert.Equal(t, "old", v, "cached until refreshed")
+
+	require.NoError(t, resolver.Refresh(ctx))
+	v, err = resolver.Resolve(ctx, "ssm:/pyroscope/token")
+	require.NoError(t, err)
+	assert.Equal(t, "new", v)
+
+	// a failed refresh keeps the cached value
+	fake.mu.Lock()
+	delete(fake.values, "/pyroscope/token")
+	fake.mu.Unlock()
+	assert.ErrorIs(t, resolver.Refresh(ctx), secrets.ErrFetchingSecret)
+	v, err = resolver.Resolve(ctx, "ssm:/pyroscope/token")
+	require.NoError(t, err)
+	assert.Equal(t, "new", v)
+	assert.NoError(t, fake.err())
+}
@@ -2,51 +2,111 @@ package selfprofiler
 
 import (
 	"context"
+	"net/http"
+	"time"
 
 	"github.com/grafana/pyroscope-go"
+	"github.com/grafana/pyroscope-go/upstream/remote"
 	"github.com/sirupsen/logrus"
+
+	"github.com/pyroscope-io/pyroscope-lambda-extension/relay"
 )
 
 type SelfProfiler struct {
-	ps         *pyroscope.Profiler
-	log        *logrus.Entry
-	enabled    bool
-	remoteAddr string
-	authToken  string
+	session     *pyroscope.Session
+	uploader    *remote.Remote
+	log         *logrus.Entry
+	enabled     bool
+	remoteAddr  string
+	credentials relay.CredentialsProvider
 }
 
-func New(log *logrus.Entry, enabled bool, remoteAddr string, authToken string) *SelfProfiler {
+// New creates a self profiler
+// credentials are the same as the relay's, so that rotated secrets and refreshed tokens are picked up
+func New(log *logrus.Entry, enabled bool, remoteAddr string, credentials relay.CredentialsProvider) *SelfProfiler {
 	log = log.WithField("comp", "self-profiler")
-	return &SelfProfiler{log: log, enabled: enabled, remoteAddr: remoteAddr, authToken: authToken}
+	return &SelfProfiler{log: log, enabled: enabled, remoteAddr: remoteAddr, credentials: credentials}
 }
 
 // Start starts the self profiler
 // It should never return an error
-// TODO(eh-am): refactor this
+// It does what pyroscope.Start does, with an http client authenticating each upload
 func (s *SelfProfiler) Start() error {
 	if !s.enabled {
 		return nil
 	}
 
-	ps, err := pyroscope.Start(pyroscope.Config{
-		ApplicationName: "pyroscope.lambda.extension",
-		ServerAddress:   s.remoteAddr,
-		Logger:          s.log,
-		AuthToken:       s.authToken,
+	uploader, err := remote.NewRemote(remote.Config{
+		Address:    s.remoteAddr,
+		Threads:    5,
+		Timeout:    30 * time.Second,
+		Logger:     s.log,
+		HTTPClient: &credentialsClient{credentials: s.credentials, client: newHTTPClient(30 * time.Second)},
 	})
-	s.ps = ps
+	if err != nil {
+		s.log.Error(err)
+		return nil
+	}
 
+	session, err := pyroscope.NewSession(pyroscope.SessionConfig{
+		Upstream:       uploader,
+		Logger:         s.log,
+		AppName:        "pyroscope.lambda.extension",
+		ProfilingTypes: pyroscope.DefaultProfileTypes,
+	})
 	if err != nil {
 		s.log.Error(err)
+		return nil
+	}
+
+	uploader.Start()
+	if err := session.Start(); err != nil {
+		s.log.Error(err)
+		uploader.Stop()
+		return nil
 	}
+	s.session, s.uploader = session, uploader
 
 	return nil
 }
 
 func (s *SelfProfiler) Stop(context.Context) error {
-	if s.ps != nil {
+	if s.session != nil {
 		s.log.Debug("Flushing self profiler data")
-		return s.ps.Stop()
+		s.session.Stop()
+		s.uploader.Stop()
 	}
 	return nil
 }
+
+// newHTTPClient creates a client like the one of pyroscope.Start
+func newHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		// the Authorization header would be dropped on redirects, eg http -> https
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Timeout: timeout,
+	}
+}
+
+// credentialsClient authenticates requests with the current credentials
+// Rejected ones are invalidated, so that the next upload refreshes them
+type credentialsClient struct {
+	credentials relay.CredentialsProvider
+	client      *http.Client
+}
+
+func (c *credentialsClient) Do(req *http.Request) (*http.Response, error) {
+	credentials, err := c.credentials.Credentials(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	credentials.Apply(req)
+
+	res, err := c.client.Do(req)
+	if err == nil && (res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden) {
+		c.credentials.Invalidate(credentials)
+	}
+	return res, err
+}